@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const logRecordAdd string = "add"
+const logRecordDelete string = "delete"
+const logRecordCounter string = "counter"
+
+// One line of the token log, add records carry the token metadata
+type logRecord struct {
+	Op    string `json:"op"`
+	Token string `json:"token,omitempty"`
+	TokenInfo
+}
+
+// FileSession keeps tokens in an append-only JSON log, one record per line,
+// so tokens and their IDs survive restarts. The log is compacted when it is
+// opened.
+type FileSession struct {
+	InMemory
+	path string
+	file *os.File
+	mut  sync.Mutex
+}
+
+func NewFileSession(path string, keyPair *KeyPair) (*FileSession, error) {
+	fs := &FileSession{
+		path: path,
+	}
+	fs.KeyPair = keyPair
+	fs.store = make(map[string]TokenInfo)
+
+	err := fs.replay()
+	if err != nil {
+		return nil, err
+	}
+	err = fs.compact()
+	if err != nil {
+		return nil, err
+	}
+	fs.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileSession) replay() error {
+	file, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line += 1
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := logRecord{}
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", fs.path, line, err)
+		}
+		switch record.Op {
+		case logRecordAdd:
+			fs.store[record.Token] = record.TokenInfo
+		case logRecordDelete:
+			delete(fs.store, record.Token)
+		case logRecordCounter:
+		default:
+			return fmt.Errorf("%s:%d: unknown operation %q", fs.path, line, record.Op)
+		}
+		if record.ID > fs.count {
+			fs.count = record.ID
+		}
+	}
+	return scanner.Err()
+}
+
+// Rewrite the log with only the live tokens, the counter record keeps IDs
+// of deleted tokens from being handed out again
+func (fs *FileSession) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(fs.path), filepath.Base(fs.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	err = encoder.Encode(logRecord{Op: logRecordCounter, TokenInfo: TokenInfo{ID: fs.count}})
+	for token, info := range fs.store {
+		if err != nil {
+			break
+		}
+		err = encoder.Encode(logRecord{Op: logRecordAdd, Token: token, TokenInfo: info})
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+func (fs *FileSession) append(record logRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	_, err = fs.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return fs.file.Sync()
+}
+
+func (fs *FileSession) GenerateKey(info TokenInfo) (string, TokenInfo, error) {
+	key, info, _ := fs.tokenStore.GenerateKey(info)
+	err := fs.append(logRecord{Op: logRecordAdd, Token: key, TokenInfo: info})
+	if err != nil {
+		// A token which is not in the log would be gone after a restart
+		fs.tokenStore.DeleteKey(key)
+		return "", TokenInfo{}, err
+	}
+	return key, info, nil
+}
+
+func (fs *FileSession) DeleteKey(key string) error {
+	id := fs.Store()[key].ID
+	err := fs.append(logRecord{Op: logRecordDelete, Token: key, TokenInfo: TokenInfo{ID: id}})
+	if err != nil {
+		return err
+	}
+	return fs.tokenStore.DeleteKey(key)
+}
+
+func (fs *FileSession) Close() error {
+	fs.mut.Lock()
+	defer fs.mut.Unlock()
+	return fs.file.Close()
+}
@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const JwtAlgorithm string = "EdDSA"
+
+var ErrInvalidJwt = errors.New("Token is not a valid JWT")
+var ErrJwtSignature = errors.New("JWT signature does not match the issuer key")
+var ErrJwtExpired = errors.New("JWT is expired or not valid yet")
+var ErrJwtNoSubject = errors.New("JWT has no subject")
+var ErrTokensIssuedOffline = errors.New("Tokens are signed with the issuer key, use issue-token")
+var ErrRevokeWithList = errors.New("Tokens are revoked by adding their ID to the revocation list")
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// JwtClaims are the registered claims the proxy checks and the limits of
+// TokenInfo, times are unix seconds
+type JwtClaims struct {
+	ID          string   `json:"jti,omitempty"`
+	Subject     string   `json:"sub"`
+	IssuedAt    int64    `json:"iat,omitempty"`
+	NotBefore   int64    `json:"nbf,omitempty"`
+	Expires     int64    `json:"exp,omitempty"`
+	Label       string   `json:"label,omitempty"`
+	Subdomains  []string `json:"subdomains,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+	AllowTcp    bool     `json:"allow_tcp,omitempty"`
+}
+
+func (c *JwtClaims) Valid(now time.Time) bool {
+	if c.Expires != 0 && now.Unix() >= c.Expires {
+		return false
+	}
+	return c.NotBefore == 0 || now.Unix() >= c.NotBefore
+}
+
+func (c *JwtClaims) TokenInfo() TokenInfo {
+	info := TokenInfo{
+		Subject:     c.Subject,
+		Label:       c.Label,
+		Subdomains:  c.Subdomains,
+		MaxSessions: c.MaxSessions,
+		AllowTcp:    c.AllowTcp,
+	}
+	if c.IssuedAt != 0 {
+		info.Created = time.Unix(c.IssuedAt, 0).UTC()
+	}
+	if c.Expires != 0 {
+		info.Expires = time.Unix(c.Expires, 0).UTC()
+	}
+	return info
+}
+
+var jwtEncoding = base64.RawURLEncoding
+
+// Sign the claims into a compact JWT with the issuer key
+func SignJwt(claims JwtClaims, kp *KeyPair) (string, error) {
+	header, err := json.Marshal(jwtHeader{Alg: JwtAlgorithm, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := jwtEncoding.EncodeToString(header) + "." + jwtEncoding.EncodeToString(payload)
+	return signingInput + "." + jwtEncoding.EncodeToString(kp.Sign([]byte(signingInput))), nil
+}
+
+// Verify the signature of a compact JWT and decode its claims, the times in
+// the claims are not checked
+func ParseJwt(token string, publicKey ed25519.PublicKey) (JwtClaims, error) {
+	claims := JwtClaims{}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, ErrInvalidJwt
+	}
+	headerBytes, err := jwtEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrInvalidJwt
+	}
+	header := jwtHeader{}
+	err = json.Unmarshal(headerBytes, &header)
+	if err != nil {
+		return claims, ErrInvalidJwt
+	}
+	// The algorithm is fixed, a token can't pick a weaker one
+	if header.Alg != JwtAlgorithm {
+		return claims, fmt.Errorf("%w; unsupported algorithm %q", ErrInvalidJwt, header.Alg)
+	}
+	signature, err := jwtEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, ErrInvalidJwt
+	}
+	if !ed25519.Verify(publicKey, []byte(parts[0]+"."+parts[1]), signature) {
+		return claims, ErrJwtSignature
+	}
+	payload, err := jwtEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, ErrInvalidJwt
+	}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return claims, ErrInvalidJwt
+	}
+	return claims, nil
+}
+
+// RevocationList is a file with the IDs of revoked tokens, one per line.
+// Lines starting with # are comments.
+type RevocationList struct {
+	path    string
+	ids     map[string]struct{}
+	modTime time.Time
+	mut     sync.RWMutex
+}
+
+func LoadRevocationList(path string) (*RevocationList, error) {
+	rl := &RevocationList{
+		path: path,
+	}
+	_, err := rl.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return rl, nil
+}
+
+// Load the list again if the file changed since the last load, returns
+// whether the list was replaced
+func (rl *RevocationList) Reload() (bool, error) {
+	info, err := os.Stat(rl.path)
+	if err != nil {
+		return false, err
+	}
+	rl.mut.RLock()
+	unchanged := rl.ids != nil && info.ModTime().Equal(rl.modTime)
+	rl.mut.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(rl.path)
+	if err != nil {
+		return false, err
+	}
+	ids := make(map[string]struct{})
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ids[line] = struct{}{}
+	}
+	if scanner.Err() != nil {
+		return false, scanner.Err()
+	}
+
+	rl.mut.Lock()
+	rl.ids = ids
+	rl.modTime = info.ModTime()
+	rl.mut.Unlock()
+	return true, nil
+}
+
+func (rl *RevocationList) Revoked(id string) bool {
+	rl.mut.RLock()
+	defer rl.mut.RUnlock()
+	_, revoked := rl.ids[id]
+	return revoked
+}
+
+func (rl *RevocationList) Len() int {
+	rl.mut.RLock()
+	defer rl.mut.RUnlock()
+	return len(rl.ids)
+}
+
+// JwtSession accepts self-contained tokens signed by the issuer key, so
+// proxies don't need a shared token store. Tokens are issued offline and
+// only revoked IDs are kept on the proxy.
+type JwtSession struct {
+	PublicKey   ed25519.PublicKey
+	Revocations *RevocationList
+}
+
+func NewJwtSession(publicKey ed25519.PublicKey, revocations *RevocationList) *JwtSession {
+	return &JwtSession{
+		PublicKey:   publicKey,
+		Revocations: revocations,
+	}
+}
+
+func (js *JwtSession) Store() map[string]TokenInfo {
+	return map[string]TokenInfo{}
+}
+
+func (js *JwtSession) Count() int {
+	return 0
+}
+
+func (js *JwtSession) GenerateKey(info TokenInfo) (string, TokenInfo, error) {
+	return "", TokenInfo{}, ErrTokensIssuedOffline
+}
+
+func (js *JwtSession) DeleteKey(key string) error {
+	return ErrRevokeWithList
+}
+
+// Claims of a valid token, the error tells why a token is not valid
+func (js *JwtSession) Claims(token string) (JwtClaims, error) {
+	claims, err := ParseJwt(token, js.PublicKey)
+	if err != nil {
+		return claims, err
+	}
+	if !claims.Valid(time.Now()) {
+		return claims, ErrJwtExpired
+	}
+	// The subject owns the tunnels opened with the token
+	if claims.Subject == "" {
+		return claims, ErrJwtNoSubject
+	}
+	if claims.ID != "" && js.Revocations != nil && js.Revocations.Revoked(claims.ID) {
+		return claims, fmt.Errorf("Token %s is revoked", claims.ID)
+	}
+	return claims, nil
+}
+
+func (js *JwtSession) Token(token string) (TokenInfo, bool) {
+	claims, err := js.Claims(token)
+	if err != nil {
+		return TokenInfo{}, false
+	}
+	return claims.TokenInfo(), true
+}
+
+func (js *JwtSession) IsValidAuthToken(token string) bool {
+	_, valid := js.Token(token)
+	return valid
+}
+
+// There is no admin key, tokens are managed by whoever holds the issuer key
+func (js *JwtSession) IsValidRequest(signature []byte, msg []byte) bool {
+	return false
+}
+
+// Load the public key tokens are verified with, a private key file works as
+// well
+func LoadIssuerPublicKey(file string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	kp := &KeyPair{}
+	if kp.LoadPublicKey(data) == nil {
+		return kp.PublicKey, nil
+	}
+	err = kp.LoadPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading %s: %w", file, err)
+	}
+	return kp.PublicKey, nil
+}
@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Token with a header of its own, signed or not
+func forgeJwt(header jwtHeader, claims JwtClaims, kp *KeyPair) string {
+	headerBytes, _ := json.Marshal(header)
+	payload, _ := json.Marshal(claims)
+	signingInput := jwtEncoding.EncodeToString(headerBytes) + "." + jwtEncoding.EncodeToString(payload)
+	signature := []byte{}
+	if kp != nil {
+		signature = kp.Sign([]byte(signingInput))
+	}
+	return signingInput + "." + jwtEncoding.EncodeToString(signature)
+}
+
+func TestJwtClaims(t *testing.T) {
+	issuer, _ := GenerateKeyPair()
+	other, _ := GenerateKeyPair()
+	revocations := filepath.Join(t.TempDir(), "revoked")
+	os.WriteFile(revocations, []byte("# revoked tokens\nrevoked-id\n"), 0600)
+	list, err := LoadRevocationList(revocations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewJwtSession(issuer.PublicKey, list)
+
+	now := time.Now().Unix()
+	valid := JwtClaims{ID: "id", Subject: "ci", Expires: now + 60, Subdomains: []string{"app-*"}, AllowTcp: true}
+	sign := func(claims JwtClaims, kp *KeyPair) string {
+		token, err := SignJwt(claims, kp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", sign(valid, issuer), nil},
+		{"no expiry", sign(JwtClaims{Subject: "ci"}, issuer), nil},
+		{"expired", sign(JwtClaims{Subject: "ci", Expires: now - 1}, issuer), ErrJwtExpired},
+		{"not valid yet", sign(JwtClaims{Subject: "ci", NotBefore: now + 60}, issuer), ErrJwtExpired},
+		{"no subject", sign(JwtClaims{Expires: now + 60}, issuer), ErrJwtNoSubject},
+		{"other issuer", sign(valid, other), ErrJwtSignature},
+		{"unsigned", forgeJwt(jwtHeader{Alg: "none"}, valid, nil), ErrInvalidJwt},
+		{"other algorithm", forgeJwt(jwtHeader{Alg: "HS256"}, valid, issuer), ErrInvalidJwt},
+		{"tampered claims", strings.Replace(sign(valid, issuer), ".", ".e", 1), ErrJwtSignature},
+		{"not a jwt", "secret-token", ErrInvalidJwt},
+	}
+	for _, test := range tests {
+		_, err := session.Claims(test.token)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	info, ok := session.Token(sign(valid, issuer))
+	if !ok || info.Subject != "ci" || !info.AllowTcp || !info.AllowsSubdomain("app-1") || info.AllowsSubdomain("web") {
+		t.Errorf("token info %+v", info)
+	}
+	if _, err := session.Claims(sign(JwtClaims{ID: "revoked-id", Subject: "ci"}, issuer)); err == nil {
+		t.Error("revoked token accepted")
+	}
+}
+
+// IDs added to the file are revoked once the list is loaded again
+func TestRevocationListReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revoked")
+	os.WriteFile(file, []byte("first\n"), 0600)
+	list, err := LoadRevocationList(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := list.Reload(); reloaded || err != nil {
+		t.Errorf("unchanged list reloaded %v with error %v", reloaded, err)
+	}
+
+	os.WriteFile(file, []byte("first\n\n# comment\nsecond\n"), 0600)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(file, later, later)
+	if reloaded, err := list.Reload(); !reloaded || err != nil {
+		t.Fatalf("changed list reloaded %v with error %v", reloaded, err)
+	}
+	if !list.Revoked("first") || !list.Revoked("second") || list.Revoked("# comment") || list.Len() != 2 {
+		t.Errorf("revoked ids after reload, %d in the list", list.Len())
+	}
+}
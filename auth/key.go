@@ -1,28 +1,34 @@
 package auth
 
 import (
-	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha1"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
+	"os"
 )
 
 const KeyLen int = 43
 
+// KeyPair signs and verifies admin requests. The proxy verifies with the
+// public key but holds the private key as well, it writes the key file the
+// admin commands sign with. Anyone who can read that file can issue tokens.
 type KeyPair struct {
-	PrivateKey *rsa.PrivateKey
-	PublicKey  *rsa.PublicKey
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
 }
 
-func (kp *KeyPair) Encrypt(msg []byte) ([]byte, error) {
-	return rsa.EncryptOAEP(sha1.New(), rand.Reader, kp.PublicKey, msg, nil)
+func (kp *KeyPair) Sign(msg []byte) []byte {
+	return ed25519.Sign(kp.PrivateKey, msg)
 }
 
-func (kp *KeyPair) Decrypt(msg []byte) ([]byte, error) {
-	return kp.PrivateKey.Decrypt(nil, msg, &rsa.OAEPOptions{Hash: crypto.SHA1})
+func (kp *KeyPair) Verify(msg []byte, signature []byte) bool {
+	if len(kp.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(kp.PublicKey, msg, signature)
 }
 
 func (kp *KeyPair) DumpPublicKey() ([]byte, error) {
@@ -31,7 +37,7 @@ func (kp *KeyPair) DumpPublicKey() ([]byte, error) {
 		return []byte(""), err
 	}
 	pubBytes := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
+		Type:  "PUBLIC KEY",
 		Bytes: pubASN1,
 	})
 	return pubBytes, nil
@@ -47,22 +53,96 @@ func (kp *KeyPair) LoadPublicKey(pubBytes []byte) error {
 		return err
 	}
 	switch pub := pub.(type) {
-	case *rsa.PublicKey:
+	case ed25519.PublicKey:
 		kp.PublicKey = pub
 		return nil
 	default:
 		break // fall through
 	}
-	return errors.New("Key type is not RSA")
+	return errors.New("Key type is not Ed25519")
+}
+
+func (kp *KeyPair) DumpPrivateKey() ([]byte, error) {
+	privASN1, err := x509.MarshalPKCS8PrivateKey(kp.PrivateKey)
+	if err != nil {
+		return []byte(""), err
+	}
+	privBytes := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privASN1,
+	})
+	return privBytes, nil
+}
+
+func (kp *KeyPair) LoadPrivateKey(privBytes []byte) error {
+	block, _ := pem.Decode(privBytes)
+	if block == nil {
+		return errors.New("Failed to parse PEM block containing the key")
+	}
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	switch priv := priv.(type) {
+	case ed25519.PrivateKey:
+		kp.PrivateKey = priv
+		kp.PublicKey = priv.Public().(ed25519.PublicKey)
+		return nil
+	default:
+		break // fall through
+	}
+	return errors.New("Key type is not Ed25519")
+}
+
+// Write the private key to a file only the owner can read
+// Write the private key to a file only the owner can read, an existing
+// file keeps its mode on write so it is set again
+func (kp *KeyPair) SavePrivateKey(file string) error {
+	data, err := kp.DumpPrivateKey()
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(file, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(file, 0600)
+}
+
+// Load the key pair from the file, a new key pair is generated and written
+// to the file if it does not exist yet
+func LoadOrGenerateKeyPair(file string) (*KeyPair, bool, error) {
+	data, err := os.ReadFile(file)
+	if err == nil {
+		kp := &KeyPair{}
+		err = kp.LoadPrivateKey(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("Error loading %s: %w", file, err)
+		}
+		return kp, false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		return nil, false, err
+	}
+	err = kp.SavePrivateKey(file)
+	if err != nil {
+		return nil, false, err
+	}
+	return kp, true, nil
 }
 
 func GenerateKeyPair() (*KeyPair, error) {
 	kp := &KeyPair{}
-	privateKey, err := rsa.GenerateKey(rand.Reader, 340)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return kp, err
 	}
 	kp.PrivateKey = privateKey
-	kp.PublicKey = &privateKey.PublicKey
+	kp.PublicKey = publicKey
 	return kp, nil
 }
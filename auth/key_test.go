@@ -0,0 +1,28 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The admin key file is only readable by its owner, even if it was written
+// with a wider mode before
+func TestSavePrivateKeyMode(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "admin.key")
+	os.WriteFile(file, nil, 0644)
+	kp, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kp.SavePrivateKey(file); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("key file mode %o, want 600", mode)
+	}
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Max difference between the clock of the admin and the proxy, signed
+// requests older than this are rejected
+const MaxRequestAge time.Duration = 5 * time.Minute
+
+// Shortest nonce accepted, the admin commands send 16 random bytes base64
+// encoded
+const MinNonceLen int = 22
+
+var ErrStaleRequest = errors.New("Request timestamp is outside of the accepted window")
+var ErrReplayedRequest = errors.New("Request nonce was already used")
+var ErrInvalidNonce = errors.New("Request nonce is missing or too short")
+
+// NonceCache remembers the nonces of signed requests for as long as their
+// timestamp is accepted, so a captured request can't be sent again
+type NonceCache struct {
+	window time.Duration
+	seen   map[string]time.Time
+	mut    sync.Mutex
+}
+
+func NewNonceCache(window time.Duration) *NonceCache {
+	return &NonceCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Accept a request once, if its timestamp is within the window
+func (nc *NonceCache) Check(timestamp time.Time, nonce string) error {
+	if len(nonce) < MinNonceLen {
+		return ErrInvalidNonce
+	}
+	now := time.Now()
+	if timestamp.Before(now.Add(-nc.window)) || timestamp.After(now.Add(nc.window)) {
+		return ErrStaleRequest
+	}
+
+	nc.mut.Lock()
+	defer nc.mut.Unlock()
+	for seen, expires := range nc.seen {
+		if expires.Before(now) {
+			delete(nc.seen, seen)
+		}
+	}
+	if _, ok := nc.seen[nonce]; ok {
+		return ErrReplayedRequest
+	}
+	// A nonce has to be remembered until its timestamp is too old
+	nc.seen[nonce] = timestamp.Add(nc.window)
+	return nil
+}
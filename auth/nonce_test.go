@@ -0,0 +1,31 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNonceCheck(t *testing.T) {
+	nonce := strings.Repeat("a", MinNonceLen)
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		nonce     string
+		err       error
+	}{
+		{"fresh", time.Now(), nonce, nil},
+		{"replayed", time.Now(), nonce, ErrReplayedRequest},
+		{"other nonce", time.Now(), nonce + "b", nil},
+		{"empty nonce", time.Now(), "", ErrInvalidNonce},
+		{"short nonce", time.Now(), nonce[1:], ErrInvalidNonce},
+		{"too old", time.Now().Add(-2 * MaxRequestAge), "c" + nonce, ErrStaleRequest},
+		{"in the future", time.Now().Add(2 * MaxRequestAge), "d" + nonce, ErrStaleRequest},
+	}
+	cache := NewNonceCache(MaxRequestAge)
+	for _, test := range tests {
+		if err := cache.Check(test.timestamp, test.nonce); err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
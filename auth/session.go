@@ -4,6 +4,8 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -14,97 +16,109 @@ func Sha256(data []byte) string {
 	return strings.ToLower(base64.URLEncoding.EncodeToString(s.Sum(nil))[:KeyLen])
 }
 
+// AuthSession implementations are shared by every connection handler and
+// have to be safe for concurrent use
 type AuthSession interface {
-	Store() map[string]int
+	// Copy of the token -> token info mapping
+	Store() map[string]TokenInfo
 	Count() int
-	GenerateKey() string
-	DeleteKey(key string)
+	// Generate a token with the given metadata, the ID and creation time
+	// are assigned by the store
+	GenerateKey(info TokenInfo) (string, TokenInfo, error)
+	DeleteKey(key string) error
+	// Metadata of a valid token, expired tokens are not valid
+	Token(token string) (TokenInfo, bool)
 	IsValidAuthToken(token string) bool
-	IsValidRequest(key []byte, msg string) bool
+	// Whether the admin request message carries a valid signature
+	IsValidRequest(signature []byte, msg []byte) bool
 }
 
-type InMemory struct {
-	KeyPair *KeyPair
-	store   map[string]int
-	count   int
+// Token storage shared by the session implementations
+type tokenStore struct {
+	store map[string]TokenInfo
+	count int
+	mut   sync.RWMutex
 }
 
-func (im *InMemory) Store() map[string]int {
-	return im.store
+func (ts *tokenStore) Store() map[string]TokenInfo {
+	ts.mut.RLock()
+	defer ts.mut.RUnlock()
+	store := make(map[string]TokenInfo, len(ts.store))
+	for key, info := range ts.store {
+		store[key] = info
+	}
+	return store
 }
 
-func (im *InMemory) Count() int {
-	return im.count
+func (ts *tokenStore) Count() int {
+	ts.mut.RLock()
+	defer ts.mut.RUnlock()
+	return ts.count
 }
 
-func (im *InMemory) GenerateKey() string {
-	im.count += 1
+func (ts *tokenStore) GenerateKey(info TokenInfo) (string, TokenInfo, error) {
 	key := Sha256([]byte(uuid.New().String()))
-	im.store[key] = im.count
-	return key
-}
-
-func (im *InMemory) DeleteKey(key string) {
-	delete(im.store, key)
-}
-
-func (im *InMemory) IsValidAuthToken(token string) bool {
-	return im.store[token] > 0
-}
-
-func (im *InMemory) IsValidRequest(key []byte, msg string) bool {
-	requestedMsg, err := im.KeyPair.Decrypt(key)
-	if err != nil {
-		return false
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	ts.count += 1
+	info.ID = ts.count
+	info.Created = time.Now().UTC().Truncate(time.Second)
+	ts.store[key] = info
+	return key, info, nil
+}
+
+func (ts *tokenStore) DeleteKey(key string) error {
+	ts.mut.Lock()
+	defer ts.mut.Unlock()
+	delete(ts.store, key)
+	return nil
+}
+
+func (ts *tokenStore) Token(token string) (TokenInfo, bool) {
+	ts.mut.RLock()
+	info, ok := ts.store[token]
+	ts.mut.RUnlock()
+	if !ok || info.Expired(time.Now()) {
+		return TokenInfo{}, false
 	}
-	return string(requestedMsg) == msg
+	return info, true
 }
 
-type DefaultSession struct {
-	store map[string]int
-	count int
-}
-
-func (im *DefaultSession) Store() map[string]int {
-	return im.store
-}
-
-func (im *DefaultSession) Count() int {
-	return im.count
+func (ts *tokenStore) IsValidAuthToken(token string) bool {
+	_, ok := ts.Token(token)
+	return ok
 }
 
-func (im *DefaultSession) GenerateKey() string {
-	im.count += 1
-	key := Sha256([]byte(uuid.New().String()))
-	im.store[key] = im.count
-	return key
+type InMemory struct {
+	tokenStore
+	KeyPair *KeyPair
 }
 
-func (im *DefaultSession) DeleteKey(key string) {
-	delete(im.store, key)
+func (im *InMemory) IsValidRequest(signature []byte, msg []byte) bool {
+	return im.KeyPair.Verify(msg, signature)
 }
 
-func (im *DefaultSession) IsValidAuthToken(token string) bool {
-	return im.store[token] > 0
+type DefaultSession struct {
+	tokenStore
 }
 
-func (im *DefaultSession) IsValidRequest(key []byte, msg string) bool {
+func (im *DefaultSession) IsValidRequest(signature []byte, msg []byte) bool {
 	return true
 }
 
 func NewDefaultSession(key string) *DefaultSession {
-	ds := &DefaultSession{
-		store: map[string]int{
-			key: 1,
-		},
+	ds := &DefaultSession{}
+	ds.store = map[string]TokenInfo{
+		key: {ID: 1, AllowTcp: true},
 	}
 	ds.count = 1
 	return ds
 }
 
 func NewInMemorySession(keyPair *KeyPair) *InMemory {
-	return &InMemory{
+	im := &InMemory{
 		KeyPair: keyPair,
-		store:   make(map[string]int),
 	}
+	im.store = make(map[string]TokenInfo)
+	return im
 }
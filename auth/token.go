@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"path"
+	"time"
+)
+
+// TokenInfo is the metadata a token is issued with, it limits what the
+// token can be used for
+type TokenInfo struct {
+	ID    int    `json:"id"`
+	Label string `json:"label,omitempty"`
+	// Who the token was issued to, only set for signed tokens
+	Subject string    `json:"subject,omitempty"`
+	Created time.Time `json:"created"`
+	// The token is valid forever if zero
+	Expires time.Time `json:"expires"`
+	// Patterns of subdomains the token can claim, like myapp or *-staging.
+	// Any subdomain is allowed if empty.
+	Subdomains []string `json:"subdomains,omitempty"`
+	// Subdomains kept for the token even while it has no tunnel open, no
+	// other token can claim them
+	Reserved []string `json:"reserved,omitempty"`
+	// Max number of tunnels open with the token at the same time, zero
+	// means no limit
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// Whether the token can open TCP and UDP tunnels
+	AllowTcp bool `json:"allow_tcp,omitempty"`
+}
+
+func (ti *TokenInfo) Expired(now time.Time) bool {
+	return !ti.Expires.IsZero() && !now.Before(ti.Expires)
+}
+
+// Whether the subdomain is reserved for the token
+func (ti *TokenInfo) Reserves(subdomain string) bool {
+	for _, reserved := range ti.Reserved {
+		if reserved == subdomain {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the subdomain matches one of the patterns of the token, reserved
+// subdomains are always allowed
+func (ti *TokenInfo) AllowsSubdomain(subdomain string) bool {
+	if len(ti.Subdomains) == 0 || ti.Reserves(subdomain) {
+		return true
+	}
+	for _, pattern := range ti.Subdomains {
+		matched, err := path.Match(pattern, subdomain)
+		if err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the token is limited to a set of subdomains
+func (ti *TokenInfo) Scoped() bool {
+	return len(ti.Subdomains) > 0
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const DefaultWebhookCacheTTL time.Duration = time.Minute
+const DefaultWebhookTimeout time.Duration = 5 * time.Second
+
+// Expired decisions are dropped once the cache grows past this size
+const webhookCacheSweepSize int = 1024
+
+var ErrTokensManagedByWebhook = errors.New("Tokens are managed by the auth webhook")
+
+// AuthRequest describes the tunnel a token is used to open
+type AuthRequest struct {
+	Token     string `json:"token"`
+	ClientIp  string `json:"client_ip"`
+	Subdomain string `json:"subdomain,omitempty"`
+	Protocol  string `json:"protocol"`
+}
+
+// Authorizer is implemented by sessions which decide per tunnel instead of
+// per token
+type Authorizer interface {
+	Authorize(request AuthRequest) (TokenInfo, bool)
+}
+
+// Body of the webhook response, the limits work like the ones of issued
+// tokens. Subdomain forces the tunnel onto that subdomain. Subject owns the
+// tunnels, every token is its own subject if it is left out.
+type WebhookResponse struct {
+	Allow       bool     `json:"allow"`
+	Subject     string   `json:"subject,omitempty"`
+	Subdomain   string   `json:"subdomain,omitempty"`
+	Subdomains  []string `json:"subdomains,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+	AllowTcp    bool     `json:"allow_tcp,omitempty"`
+}
+
+func (wr *WebhookResponse) TokenInfo(token string) TokenInfo {
+	info := TokenInfo{
+		Subject:     wr.Subject,
+		Subdomains:  wr.Subdomains,
+		MaxSessions: wr.MaxSessions,
+		AllowTcp:    wr.AllowTcp,
+	}
+	if info.Subject == "" {
+		info.Subject = "token-" + Sha256([]byte(token))
+	}
+	if wr.Subdomain != "" {
+		info.Subdomains = []string{wr.Subdomain}
+	}
+	return info
+}
+
+type webhookDecision struct {
+	info    TokenInfo
+	allow   bool
+	expires time.Time
+}
+
+// WebhookSession asks an external HTTP service whether a token may open a
+// tunnel. The service gets the request as JSON in a POST and answers with a
+// WebhookResponse, any other status than 200 denies the tunnel. Decisions
+// are cached for the TTL, failed calls are not cached.
+type WebhookSession struct {
+	URL    string
+	TTL    time.Duration
+	Client *http.Client
+	// Failed webhook calls are logged if set
+	Logger *slog.Logger
+	cache  map[AuthRequest]webhookDecision
+	mut    sync.Mutex
+}
+
+func NewWebhookSession(url string, ttl time.Duration) *WebhookSession {
+	if ttl <= 0 {
+		ttl = DefaultWebhookCacheTTL
+	}
+	return &WebhookSession{
+		URL:    url,
+		TTL:    ttl,
+		Client: &http.Client{Timeout: DefaultWebhookTimeout},
+		cache:  make(map[AuthRequest]webhookDecision),
+	}
+}
+
+func (ws *WebhookSession) cached(request AuthRequest, now time.Time) (webhookDecision, bool) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	decision, ok := ws.cache[request]
+	if !ok || !now.Before(decision.expires) {
+		return webhookDecision{}, false
+	}
+	return decision, true
+}
+
+func (ws *WebhookSession) remember(request AuthRequest, decision webhookDecision, now time.Time) {
+	ws.mut.Lock()
+	defer ws.mut.Unlock()
+	if len(ws.cache) >= webhookCacheSweepSize {
+		for key, cached := range ws.cache {
+			if !now.Before(cached.expires) {
+				delete(ws.cache, key)
+			}
+		}
+	}
+	ws.cache[request] = decision
+}
+
+// Call the webhook without looking at the cache
+func (ws *WebhookSession) Ask(request AuthRequest) (WebhookResponse, error) {
+	decision := WebhookResponse{}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return decision, err
+	}
+	response, err := ws.Client.Post(ws.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return decision, err
+	}
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return decision, nil
+	default:
+		return decision, fmt.Errorf("Auth webhook answered with %s", response.Status)
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<16)).Decode(&decision)
+	if err != nil {
+		return decision, fmt.Errorf("Error decoding auth webhook response: %w", err)
+	}
+	return decision, nil
+}
+
+func (ws *WebhookSession) Authorize(request AuthRequest) (TokenInfo, bool) {
+	now := time.Now()
+	decision, ok := ws.cached(request, now)
+	if ok {
+		return decision.info, decision.allow
+	}
+	response, err := ws.Ask(request)
+	if err != nil {
+		if ws.Logger != nil {
+			ws.Logger.Error("Auth webhook error", "url", ws.URL, "error", err)
+		}
+		return TokenInfo{}, false
+	}
+	decision = webhookDecision{
+		info:    response.TokenInfo(request.Token),
+		allow:   response.Allow,
+		expires: now.Add(ws.TTL),
+	}
+	ws.remember(request, decision, now)
+	return decision.info, decision.allow
+}
+
+func (ws *WebhookSession) Store() map[string]TokenInfo {
+	return map[string]TokenInfo{}
+}
+
+func (ws *WebhookSession) Count() int {
+	return 0
+}
+
+func (ws *WebhookSession) GenerateKey(info TokenInfo) (string, TokenInfo, error) {
+	return "", TokenInfo{}, ErrTokensManagedByWebhook
+}
+
+func (ws *WebhookSession) DeleteKey(key string) error {
+	return ErrTokensManagedByWebhook
+}
+
+// Decision for the token alone, without a client or subdomain
+func (ws *WebhookSession) Token(token string) (TokenInfo, bool) {
+	return ws.Authorize(AuthRequest{Token: token})
+}
+
+func (ws *WebhookSession) IsValidAuthToken(token string) bool {
+	_, valid := ws.Token(token)
+	return valid
+}
+
+func (ws *WebhookSession) IsValidRequest(signature []byte, msg []byte) bool {
+	return false
+}
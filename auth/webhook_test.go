@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Webhook which answers with the status and body, counting its calls
+func newTestWebhook(t *testing.T, status int, body string) (*WebhookSession, *atomic.Int32) {
+	calls := &atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		request := AuthRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Error decoding the auth request: %v", err)
+		}
+		if r.Method != http.MethodPost || request.Token == "" {
+			t.Errorf("Unexpected auth request %s %+v", r.Method, request)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return NewWebhookSession(server.URL, time.Minute), calls
+}
+
+func TestWebhookAuthorize(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		allow  bool
+		info   TokenInfo
+	}{
+		{
+			name:   "allowed",
+			status: http.StatusOK,
+			body:   `{"allow": true, "subject": "alice", "subdomain": "alice", "max_sessions": 2, "allow_tcp": true}`,
+			allow:  true,
+			info:   TokenInfo{Subject: "alice", Subdomains: []string{"alice"}, MaxSessions: 2, AllowTcp: true},
+		},
+		{
+			name:   "patterns",
+			status: http.StatusOK,
+			body:   `{"allow": true, "subject": "bob", "subdomains": ["bob-*"]}`,
+			allow:  true,
+			info:   TokenInfo{Subject: "bob", Subdomains: []string{"bob-*"}},
+		},
+		{
+			name:   "denied in body",
+			status: http.StatusOK,
+			body:   `{"allow": false}`,
+		},
+		{
+			name:   "unauthorized",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "forbidden",
+			status: http.StatusForbidden,
+		},
+		{
+			name:   "server error",
+			status: http.StatusInternalServerError,
+		},
+		{
+			name:   "invalid body",
+			status: http.StatusOK,
+			body:   `{"allow": tru`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ws, _ := newTestWebhook(t, test.status, test.body)
+			info, allow := ws.Authorize(AuthRequest{Token: "token", Protocol: "http"})
+			if allow != test.allow {
+				t.Fatalf("allow = %v, want %v", allow, test.allow)
+			}
+			if !allow {
+				return
+			}
+			if info.Subject != test.info.Subject || info.MaxSessions != test.info.MaxSessions || info.AllowTcp != test.info.AllowTcp {
+				t.Errorf("info = %+v, want %+v", info, test.info)
+			}
+			if len(info.Subdomains) != len(test.info.Subdomains) || len(info.Subdomains) > 0 && info.Subdomains[0] != test.info.Subdomains[0] {
+				t.Errorf("subdomains = %v, want %v", info.Subdomains, test.info.Subdomains)
+			}
+		})
+	}
+}
+
+func TestWebhookSubjectFromToken(t *testing.T) {
+	ws, _ := newTestWebhook(t, http.StatusOK, `{"allow": true}`)
+	alice, _ := ws.Authorize(AuthRequest{Token: "alice-token"})
+	bob, _ := ws.Authorize(AuthRequest{Token: "bob-token"})
+	again, _ := ws.Authorize(AuthRequest{Token: "alice-token", Subdomain: "other"})
+	if alice.Subject == "" || alice.Subject == bob.Subject {
+		t.Errorf("tokens without a subject share an owner; %q and %q", alice.Subject, bob.Subject)
+	}
+	if alice.Subject != again.Subject {
+		t.Errorf("subject of the same token changed; %q and %q", alice.Subject, again.Subject)
+	}
+}
+
+func TestWebhookCache(t *testing.T) {
+	ws, calls := newTestWebhook(t, http.StatusOK, `{"allow": true, "subject": "alice"}`)
+	request := AuthRequest{Token: "token", Protocol: "http"}
+	for i := 0; i < 3; i++ {
+		if _, allow := ws.Authorize(request); !allow {
+			t.Fatal("Token was denied")
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("webhook called %d times, want 1", calls.Load())
+	}
+	ws.Authorize(AuthRequest{Token: "token", Protocol: "tcp"})
+	if calls.Load() != 2 {
+		t.Errorf("webhook called %d times for another request, want 2", calls.Load())
+	}
+
+	ws.TTL = -time.Second
+	ws.Authorize(AuthRequest{Token: "other"})
+	ws.Authorize(AuthRequest{Token: "other"})
+	if calls.Load() != 4 {
+		t.Errorf("expired decisions were used, webhook called %d times, want 4", calls.Load())
+	}
+}
+
+func TestWebhookErrorsNotCached(t *testing.T) {
+	ws, calls := newTestWebhook(t, http.StatusBadGateway, "")
+	ws.Authorize(AuthRequest{Token: "token"})
+	ws.Authorize(AuthRequest{Token: "token"})
+	if calls.Load() != 2 {
+		t.Errorf("failed call was cached, webhook called %d times, want 2", calls.Load())
+	}
+}
@@ -0,0 +1,386 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/angrybayblade/tunnel/config"
+	"github.com/angrybayblade/tunnel/proxy"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/urfave/cli/v2"
+)
+
+// Every config key can be overridden with an environment variable, named
+// after its path, eg. TUNNEL_TLS_PORT for the port key of the tls table.
+// Flags given on the command line win over both.
+const configEnvPrefix string = "TUNNEL_"
+
+var configFlag cli.Flag = &cli.PathFlag{
+	Name:  "config",
+	Usage: "Config file, flags and environment variables take precedence over it",
+}
+
+// Config keys of tunnel listen and the flags they set, keys without a flag
+// are read by the listen command itself
+var listenConfigKeys = map[string]string{
+	"host":                      "host",
+	"port":                      "port",
+	"tcp_ports":                 "tcp-ports",
+	"udp_ports":                 "udp-ports",
+	"offline_page":              "offline-page",
+	"drain_timeout":             "drain-timeout",
+	"tls.port":                  "tls-port",
+	"tls.cert":                  "tls-cert",
+	"tls.key":                   "tls-key",
+	"tls.redirect":              "https-redirect",
+	"tls.acme":                  "acme",
+	"tls.acme_directory":        "acme-directory",
+	"tls.acme_email":            "acme-email",
+	"tls.acme_cache":            "acme-cache",
+	"tls.acme_ca_root":          "acme-ca-root",
+	"control_tls.cert":          "control-tls-cert",
+	"control_tls.key":           "control-tls-key",
+	"control_tls.client_ca":     "control-client-ca",
+	"control_tls.require":       "require-control-tls",
+	"auth.backend":              "",
+	"auth.store":                "auth-store",
+	"auth.admin_key":            "admin-key",
+	"auth.jwt_key":              "jwt-key",
+	"auth.jwt_revocations":      "jwt-revocations",
+	"auth.webhook":              "auth-webhook",
+	"auth.webhook_ttl":          "auth-webhook-ttl",
+	"limits.queue_size":         "queue-size",
+	"limits.queue_timeout":      "queue-timeout",
+	"limits.udp_idle_timeout":   "udp-idle-timeout",
+	"limits.resume_grace":       "resume-grace",
+	"limits.heartbeat_interval": "heartbeat-interval",
+	"limits.heartbeat_timeout":  "heartbeat-timeout",
+	"domains.base":              "domain",
+	"domains.store":             "domain-store",
+	"admin_api.host":            "admin-api-host",
+	"admin_api.port":            "admin-api-port",
+	"admin_api.token":           "admin-api-token",
+	"admin_api.tls_cert":        "admin-api-tls-cert",
+	"admin_api.tls_key":         "admin-api-tls-key",
+	"admin_api.client_ca":       "admin-api-client-ca",
+	"metrics.host":              "metrics-host",
+	"metrics.port":              "metrics-port",
+	"log.file":                  "log",
+	"log.level":                 "log-level",
+	"log.format":                "log-format",
+	"log.access_log":            "access-log",
+	"log.access_format":         "access-log-format",
+}
+
+// Config keys of tunnel forward and the flags they set, the tunnels are
+// described by the tables under tunnels
+var forwardConfigKeys = map[string]string{
+	"proxy":              "proxy",
+	"key":                "key",
+	"heartbeat_interval": "heartbeat-interval",
+	"heartbeat_timeout":  "heartbeat-timeout",
+	"tls.enabled":        "tls",
+	"tls.ca":             "tls-ca",
+	"tls.pin":            "tls-pin",
+	"tls.cert":           "tls-cert",
+	"tls.key":            "tls-key",
+	"metrics.host":       "metrics-host",
+	"metrics.port":       "metrics-port",
+	"log.file":           "log",
+	"log.level":          "log-level",
+	"log.format":         "log-format",
+}
+
+// Authentication backends a listen config can pick, and the key each one
+// needs
+const authBackendPath string = "auth.backend"
+
+var authBackends = map[string]string{
+	"default": "",
+	"uima":    "",
+	"jwt":     "auth.jwt_key",
+	"webhook": "auth.webhook",
+}
+
+const tunnelsTable string = "tunnels"
+
+var tunnelKeys = []string{"local", "subdomain", "protocol", "key"}
+
+// A tunnel of a forward config
+type tunnelConfig struct {
+	Name      string
+	Local     proxy.Addr
+	Subdomain string
+	Protocol  string
+	Key       string
+	// Line of the table in the config file
+	line int
+}
+
+// Environment variable which overrides the config key
+func configEnv(path string) string {
+	return configEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(path))
+}
+
+// Load the config file of the --config flag, nil if it is not set
+func loadConfig(cCtx *cli.Context) (*config.File, error) {
+	path := cCtx.Path("config")
+	if path == "" {
+		return nil, nil
+	}
+	return config.Load(path)
+}
+
+// Set the flags which are not given on the command line from the
+// environment and the config file. Keys under the tables are left to the
+// caller.
+func applyConfig(cCtx *cli.Context, file *config.File, keys map[string]string, tables ...string) error {
+	flags := make(map[string]cli.Flag)
+	for _, flag := range cCtx.Command.Flags {
+		for _, name := range flag.Names() {
+			flags[name] = flag
+		}
+	}
+
+	if file != nil {
+		for _, path := range file.Paths() {
+			if _, ok := keys[path]; ok || inTables(path, tables) {
+				continue
+			}
+			return file.Errorf(file.Get(path).Line, "Unknown key; %s", path)
+		}
+	}
+
+	paths := make([]string, 0, len(keys))
+	for path := range keys {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		name := keys[path]
+		if name == "" || cCtx.IsSet(name) {
+			continue
+		}
+		env, ok := os.LookupEnv(configEnv(path))
+		if ok {
+			err := cCtx.Set(name, env)
+			if err != nil {
+				return fmt.Errorf("Invalid value in %s; %w", configEnv(path), err)
+			}
+			continue
+		}
+		if file == nil || file.Get(path) == nil {
+			continue
+		}
+		value := file.Get(path)
+		raw, err := flagValue(flags[name], value.Value, filepath.Dir(file.Name))
+		if err == nil {
+			err = cCtx.Set(name, raw)
+		}
+		if err != nil {
+			return file.Errorf(value.Line, "%s; %w", path, err)
+		}
+	}
+	return nil
+}
+
+func inTables(path string, tables []string) bool {
+	for _, table := range tables {
+		if strings.HasPrefix(path, table+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Flag value of a config value, paths are relative to the directory of the
+// config file
+func flagValue(flag cli.Flag, value any, dir string) (string, error) {
+	switch flag.(type) {
+	case *cli.IntFlag:
+		number, ok := value.(int64)
+		if !ok {
+			return "", fmt.Errorf("Should be an integer")
+		}
+		return strconv.FormatInt(number, 10), nil
+	case *cli.BoolFlag:
+		enabled, ok := value.(bool)
+		if !ok {
+			return "", fmt.Errorf("Should be true or false")
+		}
+		return strconv.FormatBool(enabled), nil
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("Should be a string")
+	}
+	if _, ok := flag.(*cli.PathFlag); ok && text != "" && text != "-" && !filepath.IsAbs(text) {
+		text = filepath.Join(dir, text)
+	}
+	return text, nil
+}
+
+// Pick the authentication backend of the listen config, the flags of the
+// other backends have to be left alone
+func applyAuthBackend(cCtx *cli.Context, file *config.File) error {
+	backend := os.Getenv(configEnv(authBackendPath))
+	line := 0
+	if backend == "" && file != nil && file.Get(authBackendPath) != nil {
+		value := file.Get(authBackendPath)
+		line = value.Line
+		text, ok := value.Value.(string)
+		if !ok {
+			return file.Errorf(line, "%s; Should be a string", authBackendPath)
+		}
+		backend = text
+	}
+	if backend == "" {
+		return nil
+	}
+	needs, ok := authBackends[backend]
+	if !ok {
+		return configError(file, line, "%s; %w", authBackendPath, ErrUnknownAuthBackend)
+	}
+	if backend == "uima" && !cCtx.IsSet("uima") {
+		cCtx.Set("uima", "true")
+	}
+	if needs != "" && !cCtx.IsSet(listenConfigKeys[needs]) {
+		return configError(file, line, "%s = %s needs %s", authBackendPath, backend, needs)
+	}
+	return nil
+}
+
+// Error on a line of the config file, or a plain error when the value came
+// from the environment
+func configError(file *config.File, line int, format string, args ...any) error {
+	if file == nil || line == 0 {
+		return fmt.Errorf(format, args...)
+	}
+	return file.Errorf(line, format, args...)
+}
+
+// Tunnels described by the config file, keys default to the key flag
+func loadTunnels(cCtx *cli.Context, file *config.File) ([]tunnelConfig, error) {
+	if file == nil {
+		return nil, nil
+	}
+	tunnels := []tunnelConfig{}
+	for _, name := range file.Tables(tunnelsTable) {
+		table := tunnelsTable + "." + name
+		line := file.TableLine(table)
+		values := make(map[string]string)
+		for _, path := range file.Paths() {
+			key, ok := strings.CutPrefix(path, table+".")
+			if !ok {
+				continue
+			}
+			value := file.Get(path)
+			if !isTunnelKey(key) {
+				return nil, file.Errorf(value.Line, "Unknown key; %s", path)
+			}
+			text, ok := value.Value.(string)
+			if !ok {
+				return nil, file.Errorf(value.Line, "%s; Should be a string", path)
+			}
+			values[key] = text
+			if line == 0 {
+				line = value.Line
+			}
+		}
+		for _, key := range tunnelKeys {
+			if env, ok := os.LookupEnv(configEnv(table + "." + key)); ok {
+				values[key] = env
+			}
+		}
+
+		tunnel := tunnelConfig{
+			Name:      name,
+			Subdomain: values["subdomain"],
+			Protocol:  values["protocol"],
+			Key:       values["key"],
+			line:      line,
+		}
+		if tunnel.Key == "" {
+			tunnel.Key = cCtx.String("key")
+		}
+		if tunnel.Protocol == "" {
+			tunnel.Protocol = headers.TunnelProtocolHttp
+		}
+		switch tunnel.Protocol {
+		case headers.TunnelProtocolHttp, headers.TunnelProtocolTcp, headers.TunnelProtocolUdp:
+		default:
+			return nil, file.Errorf(lineOf(file, table+".protocol", line), "%s.protocol; %w", table, proxy.ErrProxyUnknownProtocol)
+		}
+		if values["local"] == "" {
+			return nil, file.Errorf(line, "%s needs local, the address of the local server", table)
+		}
+		local, err := parseLocalAddr(values["local"])
+		if err != nil {
+			return nil, file.Errorf(lineOf(file, table+".local", line), "%s.local; %w", table, err)
+		}
+		tunnel.Local = local
+		tunnels = append(tunnels, tunnel)
+	}
+	return tunnels, checkTunnels(file, tunnels)
+}
+
+// HTTP tunnels are found by their subdomain, or by their key if they have
+// none. Two tunnels which share one would replace each other on the proxy
+// every time they reconnect. TCP and UDP tunnels always get keys of their
+// own.
+func checkTunnels(file *config.File, tunnels []tunnelConfig) error {
+	seen := make(map[string]tunnelConfig)
+	for _, tunnel := range tunnels {
+		if tunnel.Protocol != headers.TunnelProtocolHttp {
+			continue
+		}
+		id := "key:" + tunnel.Key
+		if tunnel.Subdomain != "" {
+			id = "subdomain:" + tunnel.Subdomain
+		}
+		if other, ok := seen[id]; ok {
+			return file.Errorf(tunnel.line, "%w; %s.%s and %s.%s", ErrDuplicateTunnel, tunnelsTable, other.Name, tunnelsTable, tunnel.Name)
+		}
+		seen[id] = tunnel
+	}
+	return nil
+}
+
+func isTunnelKey(key string) bool {
+	for _, tunnelKey := range tunnelKeys {
+		if key == tunnelKey {
+			return true
+		}
+	}
+	return false
+}
+
+// Line of the value, or the fallback if it is not in the file
+func lineOf(file *config.File, path string, fallback int) int {
+	if value := file.Get(path); value != nil {
+		return value.Line
+	}
+	return fallback
+}
+
+// Local address as host:port, or just a port on 127.0.0.1
+func parseLocalAddr(local string) (proxy.Addr, error) {
+	host, port := "127.0.0.1", local
+	if strings.Contains(local, ":") {
+		var err error
+		host, port, err = net.SplitHostPort(local)
+		if err != nil {
+			return proxy.Addr{}, err
+		}
+	}
+	number, err := strconv.Atoi(port)
+	if err != nil || number <= 0 || number > 65535 {
+		return proxy.Addr{}, fmt.Errorf("Invalid port; %s", port)
+	}
+	return proxy.Addr{Host: host, Port: number}, nil
+}
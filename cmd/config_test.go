@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/angrybayblade/tunnel/config"
+	"github.com/angrybayblade/tunnel/proxy"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/urfave/cli/v2"
+)
+
+func TestCheckTunnels(t *testing.T) {
+	file := &config.File{Name: "forward.toml"}
+	tunnel := func(name string, protocol string, subdomain string, key string, line int) tunnelConfig {
+		return tunnelConfig{Name: name, Protocol: protocol, Subdomain: subdomain, Key: key, line: line}
+	}
+	tests := []struct {
+		name    string
+		tunnels []tunnelConfig
+		line    int
+	}{
+		{
+			name: "different subdomains",
+			tunnels: []tunnelConfig{
+				tunnel("web", headers.TunnelProtocolHttp, "web", "key", 3),
+				tunnel("api", headers.TunnelProtocolHttp, "api", "key", 7),
+			},
+		},
+		{
+			name: "same subdomain",
+			tunnels: []tunnelConfig{
+				tunnel("web", headers.TunnelProtocolHttp, "web", "key", 3),
+				tunnel("api", headers.TunnelProtocolHttp, "web", "other", 7),
+			},
+			line: 7,
+		},
+		{
+			name: "same key without subdomains",
+			tunnels: []tunnelConfig{
+				tunnel("web", headers.TunnelProtocolHttp, "", "key", 3),
+				tunnel("api", headers.TunnelProtocolHttp, "api", "key", 7),
+				tunnel("docs", headers.TunnelProtocolHttp, "", "key", 11),
+			},
+			line: 11,
+		},
+		{
+			name: "different keys without subdomains",
+			tunnels: []tunnelConfig{
+				tunnel("web", headers.TunnelProtocolHttp, "", "key", 3),
+				tunnel("api", headers.TunnelProtocolHttp, "", "other", 7),
+			},
+		},
+		{
+			name: "tcp and udp tunnels with the same key",
+			tunnels: []tunnelConfig{
+				tunnel("ssh", headers.TunnelProtocolTcp, "", "key", 3),
+				tunnel("db", headers.TunnelProtocolTcp, "", "key", 7),
+				tunnel("dns", headers.TunnelProtocolUdp, "", "key", 11),
+				tunnel("web", headers.TunnelProtocolHttp, "", "key", 15),
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkTunnels(file, test.tunnels)
+			if test.line == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			configErr := &config.Error{}
+			if !errors.As(err, &configErr) || configErr.Line != test.line {
+				t.Fatalf("error %v, want one on line %d", err, test.line)
+			}
+			if !errors.Is(err, ErrDuplicateTunnel) {
+				t.Errorf("error %v, want %v", err, ErrDuplicateTunnel)
+			}
+		})
+	}
+}
+
+func TestParseLocalAddr(t *testing.T) {
+	tests := []struct {
+		local string
+		addr  proxy.Addr
+		valid bool
+	}{
+		{"3000", proxy.Addr{Host: "127.0.0.1", Port: 3000}, true},
+		{"localhost:8080", proxy.Addr{Host: "localhost", Port: 8080}, true},
+		{"[::1]:22", proxy.Addr{Host: "::1", Port: 22}, true},
+		{"0", proxy.Addr{}, false},
+		{"65536", proxy.Addr{}, false},
+		{"web", proxy.Addr{}, false},
+		{"host:", proxy.Addr{}, false},
+		{"::1", proxy.Addr{}, false},
+	}
+	for _, test := range tests {
+		addr, err := parseLocalAddr(test.local)
+		if (err == nil) != test.valid || addr != test.addr {
+			t.Errorf("parseLocalAddr(%q) = %v, %v", test.local, addr, err)
+		}
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	tests := map[string]string{
+		"port":                 "TUNNEL_PORT",
+		"tls.port":             "TUNNEL_TLS_PORT",
+		"tunnels.web-app.key":  "TUNNEL_TUNNELS_WEB_APP_KEY",
+		"log.access_format":    "TUNNEL_LOG_ACCESS_FORMAT",
+		"control_tls.require":  "TUNNEL_CONTROL_TLS_REQUIRE",
+		"limits.resume_grace":  "TUNNEL_LIMITS_RESUME_GRACE",
+		"admin_api.client_ca":  "TUNNEL_ADMIN_API_CLIENT_CA",
+		"metrics.host":         "TUNNEL_METRICS_HOST",
+		"domains.store":        "TUNNEL_DOMAINS_STORE",
+		"auth.webhook_ttl":     "TUNNEL_AUTH_WEBHOOK_TTL",
+		"heartbeat_interval":   "TUNNEL_HEARTBEAT_INTERVAL",
+		"tunnels.api.protocol": "TUNNEL_TUNNELS_API_PROTOCOL",
+	}
+	for path, env := range tests {
+		if got := configEnv(path); got != env {
+			t.Errorf("configEnv(%q) = %q, want %q", path, got, env)
+		}
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	dir := filepath.Join("etc", "tunnel")
+	tests := []struct {
+		name  string
+		flag  cli.Flag
+		value any
+		want  string
+		valid bool
+	}{
+		{"int", &cli.IntFlag{Name: "port"}, int64(80), "80", true},
+		{"int from string", &cli.IntFlag{Name: "port"}, "80", "", false},
+		{"bool", &cli.BoolFlag{Name: "acme"}, true, "true", true},
+		{"bool from int", &cli.BoolFlag{Name: "acme"}, int64(1), "", false},
+		{"string", &cli.StringFlag{Name: "host"}, "0.0.0.0", "0.0.0.0", true},
+		{"string from int", &cli.StringFlag{Name: "host"}, int64(1), "", false},
+		{"duration", &cli.DurationFlag{Name: "queue-timeout"}, "10s", "10s", true},
+		{"relative path", &cli.PathFlag{Name: "tls-cert"}, "cert.pem", filepath.Join(dir, "cert.pem"), true},
+		{"absolute path", &cli.PathFlag{Name: "tls-cert"}, "/cert.pem", "/cert.pem", true},
+		{"stdout", &cli.PathFlag{Name: "log"}, "-", "-", true},
+	}
+	for _, test := range tests {
+		got, err := flagValue(test.flag, test.value, dir)
+		if (err == nil) != test.valid || got != test.want {
+			t.Errorf("%s: flagValue = %q, %v", test.name, got, err)
+		}
+	}
+}
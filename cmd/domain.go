@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/angrybayblade/tunnel/proxy"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/urfave/cli/v2"
+)
+
+func domain(cCtx *cli.Context) error {
+	if cCtx.String("domain") == "" {
+		return errors.New("A domain is required")
+	}
+	request := &headers.ProxyFrame{
+		Code: headers.RequestDomain,
+		Key:  cCtx.String("key"),
+		Payload: headers.MarshalPayload(headers.DomainRequest{
+			Domain:    cCtx.String("domain"),
+			Subdomain: cCtx.String("subdomain"),
+			Remove:    cCtx.Bool("remove"),
+		}),
+	}
+
+	tlsConfig, err := getControlTlsConfig(cCtx)
+	if err != nil {
+		return err
+	}
+	proxyDial, _ := proxy.ConnectTo(cCtx.String("proxy"), true, 80, tlsConfig)
+	defer proxyDial.Close()
+	response, err := proxy.SendProxyRequest(proxyDial, request)
+	if err != nil {
+		return err
+	}
+
+	if response.Code == headers.ResponseAuthError {
+		return fmt.Errorf("Request rejected; %w", response.Err())
+	}
+
+	if response.Code != headers.ResponseSuccess {
+		return response.Err()
+	}
+
+	result := headers.DomainResponse{}
+	err = response.Decode(&result)
+	if err != nil {
+		return err
+	}
+
+	if cCtx.Bool("remove") {
+		fmt.Println("Removed", result.Domain)
+		return nil
+	}
+	if result.Verified {
+		fmt.Println("Domain", result.Domain, "is verified and routed to", result.Subdomain)
+		return nil
+	}
+	fmt.Println("Domain", result.Domain, "is waiting for verification, it will be routed to", result.Subdomain)
+	fmt.Println("Point the domain at the proxy with a CNAME record and prove you control it with")
+	fmt.Println("  a TXT record:", result.TxtRecord, "with the value", result.Challenge)
+	fmt.Println("The proxy checks again every", proxy.DomainVerifyInterval, "or when this command is run again")
+	return nil
+}
+
+var Domain *cli.Command = &cli.Command{
+	Name:   "domain",
+	Usage:  "Point a custom domain at a tunnel subdomain",
+	Action: domain,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "domain",
+			Usage: "Custom domain, eg. preview.example.com",
+		},
+		&cli.StringFlag{
+			Name:  "subdomain",
+			Usage: "Subdomain of the tunnel the domain points at, the first reserved subdomain of the key if not set",
+		},
+		&cli.BoolFlag{
+			Name:  "remove",
+			Usage: "Remove the domain",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Value: proxy.DUMMY_KEY,
+			Usage: "API key for proxy server",
+		},
+		&cli.StringFlag{
+			Name:  "proxy",
+			Value: "localhost:3000",
+			Usage: "URI for proxy server",
+		},
+	}, controlTlsFlags...),
+}
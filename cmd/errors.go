@@ -3,3 +3,10 @@ package cmd
 import "errors"
 
 var ErrSigterm = errors.New("Termination signal received.")
+var ErrHandoff = errors.New("Listeners handed over to a new process.")
+var ErrHandoffTimeout = errors.New("Timed out waiting for the new process")
+var ErrUnknownLogLevel = errors.New("Log level should be debug, info, warn or error")
+var ErrUnknownLogFormat = errors.New("Log format should be text or json")
+var ErrUnknownAuthBackend = errors.New("Auth backend should be default, uima, jwt or webhook")
+var ErrDuplicateTunnel = errors.New("Tunnels need different subdomains, or different keys if they have none")
+var ErrHandoffUnsupported = errors.New("Listener handoff is not supported on this platform")
@@ -1,45 +1,132 @@
 package cmd
 
 import (
+	"fmt"
+
 	"github.com/angrybayblade/tunnel/proxy"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/metrics"
 	"github.com/urfave/cli/v2"
 )
 
-func forward(cCtx *cli.Context) error {
-	var err error
-	var port int = cCtx.Int("port")
-	var host string = cCtx.String("host")
-	var key string = cCtx.String("key")
-	var addr string = cCtx.String("proxy")
+// Flags which describe the single tunnel of a forward without a config
+var tunnelFlags = []string{"port", "host", "subdomain", "tcp", "udp"}
 
-	logger, err := getLogger("RP", cCtx.String("log"))
+// Tunnels to open, the ones of the config file or the one the flags describe
+func getTunnels(cCtx *cli.Context) ([]tunnelConfig, error) {
+	file, err := loadConfig(cCtx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	err = applyConfig(cCtx, file, forwardConfigKeys, tunnelsTable)
+	if err != nil {
+		return nil, err
+	}
+	tunnels, err := loadTunnels(cCtx, file)
+	if err != nil {
+		return nil, err
+	}
+	if len(tunnels) > 0 {
+		for _, name := range tunnelFlags {
+			if cCtx.IsSet(name) {
+				return nil, fmt.Errorf("--%s can't be used with the tunnels of %s", name, file.Name)
+			}
+		}
+		return tunnels, nil
 	}
 
-	quitCh := make(chan error)
-	proxy := &proxy.ReverseProxy{
-		Addr: proxy.Addr{
-			Host: host,
-			Port: port,
+	var protocol string = headers.TunnelProtocolHttp
+	if cCtx.Bool("tcp") && cCtx.Bool("udp") {
+		return nil, fmt.Errorf("Only one of --tcp and --udp can be used")
+	}
+	if cCtx.Bool("tcp") {
+		protocol = headers.TunnelProtocolTcp
+	}
+	if cCtx.Bool("udp") {
+		protocol = headers.TunnelProtocolUdp
+	}
+	return []tunnelConfig{{
+		Local: proxy.Addr{
+			Host: cCtx.String("host"),
+			Port: cCtx.Int("port"),
 		},
-		Key:    key,
-		Proxy:  addr,
-		Logger: logger,
+		Subdomain: cCtx.String("subdomain"),
+		Protocol:  protocol,
+		Key:       cCtx.String("key"),
+	}}, nil
+}
+
+func forward(cCtx *cli.Context) error {
+	tunnels, err := getTunnels(cCtx)
+	if err != nil {
+		return err
 	}
-	err = proxy.Connect()
+
+	logger, err := getLogger(cCtx, "reverse-proxy")
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := getControlTlsConfig(cCtx)
 	if err != nil {
 		return err
 	}
 
-	go proxy.Listen()
+	proxies := make([]*proxy.ReverseProxy, 0, len(tunnels))
+	disconnect := func() {
+		for _, rp := range proxies {
+			rp.Disconnect()
+		}
+	}
+	for _, tunnel := range tunnels {
+		tunnelLogger := logger
+		if tunnel.Name != "" {
+			tunnelLogger = logger.With("tunnel", tunnel.Name)
+		}
+		rp := &proxy.ReverseProxy{
+			Addr:              tunnel.Local,
+			Key:               tunnel.Key,
+			Proxy:             cCtx.String("proxy"),
+			Logger:            tunnelLogger,
+			Protocol:          tunnel.Protocol,
+			Subdomain:         tunnel.Subdomain,
+			Tls:               tlsConfig,
+			HeartbeatInterval: cCtx.Duration("heartbeat-interval"),
+			HeartbeatTimeout:  cCtx.Duration("heartbeat-timeout"),
+		}
+		err = rp.Connect()
+		if err != nil {
+			disconnect()
+			if tunnel.Name != "" {
+				return fmt.Errorf("Tunnel %s; %w", tunnel.Name, err)
+			}
+			return err
+		}
+		proxies = append(proxies, rp)
+	}
+
+	if addr := getMetricsAddr(cCtx); addr != nil {
+		server, err := proxy.ServeMetrics(*addr, logger, func(w *metrics.Writer) {
+			proxy.WriteReverseProxyMetrics(w, proxies)
+		})
+		if err != nil {
+			disconnect()
+			return err
+		}
+		defer server.Close()
+	}
+
+	quitCh := make(chan error)
 	go waitForTerminationSignal(quitCh)
-	go func(waitChannel chan error, quitChannel chan error) {
-		quitCh <- <-quitChannel
-	}(quitCh, proxy.Quitch)
+	for _, rp := range proxies {
+		go rp.Listen()
+		go func(waitChannel chan error, quitChannel chan error) {
+			quitCh <- <-quitChannel
+		}(quitCh, rp.Quitch)
+	}
 
 	err = <-quitCh
-	proxy.Disconnect()
+	disconnect()
 	return err
 }
 
@@ -47,7 +134,8 @@ var Forward *cli.Command = &cli.Command{
 	Name:   "forward",
 	Usage:  "Forward the port to the given proxy service",
 	Action: forward,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
+		configFlag,
 		&cli.IntFlag{
 			Name:  "port",
 			Value: 3000,
@@ -68,9 +156,27 @@ var Forward *cli.Command = &cli.Command{
 			Value: "localhost:3000",
 			Usage: "URI for proxy server",
 		},
+		&cli.BoolFlag{
+			Name:  "tcp",
+			Usage: "Forward raw TCP connections instead of HTTP requests",
+		},
+		&cli.BoolFlag{
+			Name:  "udp",
+			Usage: "Forward UDP datagrams instead of HTTP requests",
+		},
 		&cli.StringFlag{
-			Name:  "log",
-			Usage: "Logfile",
+			Name:  "subdomain",
+			Usage: "Subdomain to serve the HTTP tunnel on",
+		},
+		&cli.DurationFlag{
+			Name:  "heartbeat-interval",
+			Value: proxy.DefaultHeartbeatInterval,
+			Usage: "How often the control connection is pinged, zero disables pings",
+		},
+		&cli.DurationFlag{
+			Name:  "heartbeat-timeout",
+			Value: proxy.DefaultHeartbeatTimeout,
+			Usage: "How long a ping may take before the proxy is considered gone",
 		},
-	},
+	}, append(controlTlsFlags, append(logFlags, metricsFlags...)...)...),
 }
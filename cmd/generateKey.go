@@ -3,6 +3,8 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/angrybayblade/tunnel/proxy"
 	"github.com/angrybayblade/tunnel/proxy/headers"
@@ -10,39 +12,64 @@ import (
 )
 
 func generateKey(cCtx *cli.Context) error {
-	kp, err := loadPublicKey(cCtx)
+	kp, err := loadSigningKey(cCtx)
 	if err != nil {
 		return err
 	}
 
-	requestEnc, err := kp.Encrypt([]byte(headers.ProxyRequestGenerateKey))
+	request := &headers.ProxyFrame{
+		Code: headers.RequestGenerateKey,
+		Payload: headers.MarshalPayload(headers.GenerateKeyRequest{
+			AdminRequest: headers.NewAdminRequest(),
+			TTL:          int64(cCtx.Duration("ttl").Seconds()),
+			Label:        cCtx.String("label"),
+			Subdomains:   cCtx.StringSlice("subdomain"),
+			MaxSessions:  cCtx.Int("max-sessions"),
+			AllowTcp:     cCtx.Bool("allow-tcp"),
+			Reserved:     cCtx.StringSlice("reserve"),
+		}),
+	}
+	proxy.SignAdminRequest(request, kp)
+
+	tlsConfig, err := getControlTlsConfig(cCtx)
 	if err != nil {
 		return err
 	}
-
-	proxyDial, _ := proxy.ConnectTo(cCtx.String("proxy"), true, 80)
-	request := &headers.ProxyHeader{
-		Code: headers.ProxyRequestGenerateKey,
-		Key:  string(requestEnc),
+	proxyDial, _ := proxy.ConnectTo(cCtx.String("proxy"), true, 80, tlsConfig)
+	defer proxyDial.Close()
+	response, err := proxy.SendProxyRequest(proxyDial, request)
+	if err != nil {
+		return err
 	}
-	request.Write(proxyDial)
-	response := &headers.ProxyHeader{}
-	response.Read(proxyDial)
 
-	if response.Code == headers.ProxyResponseNotInUimaMode {
+	if response.Code == headers.ResponseNotInUimaMode {
 		return errors.New("Proxy not running in the UIMA mode")
 	}
 
-	if response.Code == headers.ProxyResponseAuthError {
-		return errors.New("Invalid signing key")
+	if response.Code == headers.ResponseAuthError {
+		return fmt.Errorf("Request rejected; %w", response.Err())
 	}
 
-	// TOFIX: Increase header size to allow different communication type
-	if response.Code == headers.ProxyResponseUIMAError {
-		return errors.New("Max number of keys have been created, cannot create more")
+	if response.Code != headers.ResponseSuccess {
+		return response.Err()
 	}
 
-	fmt.Println("Generated", "\n  ID:", response.Message, "\n  Key:", response.Key)
+	generated := headers.GenerateKeyResponse{}
+	err = response.Decode(&generated)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Generated", "\n  ID:", generated.ID, "\n  Key:", generated.Key)
+	if generated.Expires != 0 {
+		fmt.Println("  Expires:", time.Unix(generated.Expires, 0).Format(time.RFC3339))
+	}
+	if subdomains := cCtx.StringSlice("subdomain"); len(subdomains) > 0 {
+		fmt.Println("  Subdomains:", strings.Join(subdomains, ", "))
+	}
+	if reserved := cCtx.StringSlice("reserve"); len(reserved) > 0 {
+		fmt.Println("  Reserved:", strings.Join(reserved, ", "))
+	}
 	return nil
 }
 
@@ -50,15 +77,40 @@ var GenerateKey *cli.Command = &cli.Command{
 	Name:   "generate-key",
 	Usage:  "Generate authentication key",
 	Action: generateKey,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.PathFlag{
 			Name:  "key",
-			Usage: "Key for signing the request",
+			Value: "admin.key",
+			Usage: "Admin key for signing the request",
 		},
 		&cli.StringFlag{
 			Name:  "proxy",
 			Value: "localhost:3000",
 			Usage: "URI for proxy server",
 		},
-	},
+		&cli.DurationFlag{
+			Name:  "ttl",
+			Usage: "Lifetime of the key, the key never expires if not set",
+		},
+		&cli.StringFlag{
+			Name:  "label",
+			Usage: "Label to tell keys apart",
+		},
+		&cli.StringSliceFlag{
+			Name:  "subdomain",
+			Usage: "Subdomain pattern the key is limited to, like myapp or *-staging; can be repeated",
+		},
+		&cli.IntFlag{
+			Name:  "max-sessions",
+			Usage: "Max number of tunnels open with the key at the same time, no limit if zero",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-tcp",
+			Usage: "Allow the key to open TCP and UDP tunnels",
+		},
+		&cli.StringSliceFlag{
+			Name:  "reserve",
+			Usage: "Subdomain to keep for the key even while it is offline, the first one is used by default; can be repeated",
+		},
+	}, controlTlsFlags...),
 }
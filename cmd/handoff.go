@@ -0,0 +1,127 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy"
+)
+
+// Comma separated names of the listeners a new process inherits, the
+// listeners start at fd 4 in this order. The new process writes a byte to
+// fd 3 once it serves requests.
+const handoffEnv string = "TUNNEL_LISTEN_FDS"
+const handoffReadyFd uintptr = 3
+const handoffFirstListenerFd int = 4
+
+// How long the new process may take to start serving
+const handoffTimeout time.Duration = time.Minute
+
+// Listeners handed over by the process which started this one
+func inheritedListeners() (map[string]net.Listener, error) {
+	names := os.Getenv(handoffEnv)
+	if names == "" {
+		return nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+	listeners := make(map[string]net.Listener)
+	for idx, name := range strings.Split(names, ",") {
+		file := os.NewFile(uintptr(handoffFirstListenerFd+idx), name)
+		ln, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Error taking over the %s listener: %w", name, err)
+		}
+		listeners[name] = ln
+	}
+	return listeners, nil
+}
+
+// Tell the process which handed the listeners over that this one is serving
+func notifyReady(inherited map[string]net.Listener) {
+	if inherited == nil {
+		return
+	}
+	ready := os.NewFile(handoffReadyFd, "ready")
+	ready.Write([]byte{1})
+	ready.Close()
+}
+
+// Start a new process of the proxy with the listeners of this one, returns
+// once the new process serves requests
+func handoff(fp *proxy.ForwardProxy) (int, error) {
+	files, err := fp.ListenerFiles()
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	if err != nil {
+		return 0, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+
+	names := make([]string, 0, len(files))
+	extraFiles := []*os.File{readyWriter}
+	for name, file := range files {
+		names = append(names, name)
+		extraFiles = append(extraFiles, file)
+	}
+	process := exec.Command(executable, os.Args[1:]...)
+	process.Stdin = os.Stdin
+	process.Stdout = os.Stdout
+	process.Stderr = os.Stderr
+	process.ExtraFiles = extraFiles
+	process.Env = append(os.Environ(), handoffEnv+"="+strings.Join(names, ","))
+	err = process.Start()
+	readyWriter.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// The read fails if the new process exits without getting ready
+	readCh := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		readCh <- err
+	}()
+	timer := time.NewTimer(handoffTimeout)
+	defer timer.Stop()
+	select {
+	case err = <-readCh:
+	case <-timer.C:
+		err = ErrHandoffTimeout
+	}
+	if err != nil {
+		process.Process.Kill()
+		process.Wait()
+		return 0, fmt.Errorf("New process did not start serving: %w", err)
+	}
+	go process.Wait()
+	return process.Process.Pid, nil
+}
+
+// Call handoff every time SIGUSR2 is received
+func onHandoffSignal(handoff func()) {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGUSR2)
+	for range signalChannel {
+		handoff()
+	}
+}
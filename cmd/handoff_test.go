@@ -0,0 +1,87 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs in the process started by TestInheritedListeners, prints the
+// listeners it took over and reports ready
+func TestHandoffProcess(t *testing.T) {
+	if os.Getenv("TUNNEL_TEST_HANDOFF") == "" {
+		t.Skip("only runs as the new process of a handoff")
+	}
+	inherited, err := inheritedListeners()
+	if err != nil {
+		fmt.Println("error", err)
+		os.Exit(1)
+	}
+	names := make([]string, 0, len(inherited))
+	for name, ln := range inherited {
+		names = append(names, name+"="+ln.Addr().String())
+	}
+	sort.Strings(names)
+	fmt.Println(strings.Join(names, ","), os.Getenv(handoffEnv) == "")
+	notifyReady(inherited)
+	os.Exit(0)
+}
+
+// A new process takes the listeners over from the fds named in the
+// environment and tells the old one when it is ready
+func TestInheritedListeners(t *testing.T) {
+	names := []string{"http", "https"}
+	files := []*os.File{}
+	addrs := []string{}
+	for _, name := range names {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		file, err := ln.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		files = append(files, file)
+		addrs = append(addrs, name+"="+ln.Addr().String())
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ready.Close()
+
+	process := exec.Command(os.Args[0], "-test.run=^TestHandoffProcess$")
+	process.Env = append(os.Environ(), "TUNNEL_TEST_HANDOFF=1", handoffEnv+"="+strings.Join(names, ","))
+	process.ExtraFiles = append([]*os.File{readyWriter}, files...)
+	stdout, err := process.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := process.Start(); err != nil {
+		t.Fatal(err)
+	}
+	readyWriter.Close()
+
+	line, _ := bufio.NewReader(stdout).ReadString('\n')
+	if want := strings.Join(addrs, ",") + " true\n"; line != want {
+		t.Errorf("new process reported %q, want %q", line, want)
+	}
+	ready.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := ready.Read(make([]byte, 1)); n != 1 {
+		t.Errorf("new process did not report ready: %v", err)
+	}
+	if err := process.Wait(); err != nil {
+		t.Error(err)
+	}
+}
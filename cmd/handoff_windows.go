@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"net"
+
+	"github.com/angrybayblade/tunnel/proxy"
+)
+
+// Listener handoff needs fd passing and SIGUSR2, neither exists on Windows
+
+func inheritedListeners() (map[string]net.Listener, error) {
+	return nil, nil
+}
+
+func notifyReady(inherited map[string]net.Listener) {}
+
+func handoff(fp *proxy.ForwardProxy) (int, error) {
+	return 0, ErrHandoffUnsupported
+}
+
+func onHandoffSignal(handoff func()) {}
@@ -1,18 +1,93 @@
 package cmd
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/angrybayblade/tunnel/auth"
+	"github.com/angrybayblade/tunnel/proxy"
 	"github.com/urfave/cli/v2"
 )
 
-func loadPublicKey(cCtx *cli.Context) (*auth.KeyPair, error) {
+// Flags for connecting to the proxy control channel over TLS
+var controlTlsFlags []cli.Flag = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "tls",
+		Usage: "Connect to the proxy over TLS",
+	},
+	&cli.PathFlag{
+		Name:  "tls-ca",
+		Usage: "CA certificate to verify the proxy with instead of the system roots",
+	},
+	&cli.StringFlag{
+		Name:  "tls-pin",
+		Usage: "Public key pin of the proxy certificate, eg. sha256/<base64>",
+	},
+	&cli.PathFlag{
+		Name:  "tls-cert",
+		Usage: "Client certificate to authenticate with instead of an API key",
+	},
+	&cli.PathFlag{
+		Name:  "tls-key",
+		Usage: "Private key for the client certificate",
+	},
+}
+
+// TLS config for the control channel, nil if TLS is not enabled
+func getControlTlsConfig(cCtx *cli.Context) (*tls.Config, error) {
+	enabled := cCtx.Bool("tls") ||
+		cCtx.Path("tls-ca") != "" ||
+		cCtx.String("tls-pin") != "" ||
+		cCtx.Path("tls-cert") != ""
+	if !enabled {
+		return nil, nil
+	}
+	serverName := cCtx.String("proxy")
+	if host, _, err := net.SplitHostPort(serverName); err == nil {
+		serverName = host
+	}
+	return proxy.NewClientTlsConfig(proxy.ClientTlsOptions{
+		ServerName: serverName,
+		CAFile:     cCtx.Path("tls-ca"),
+		Pin:        cCtx.String("tls-pin"),
+		CertFile:   cCtx.Path("tls-cert"),
+		KeyFile:    cCtx.Path("tls-key"),
+	})
+}
+
+// Flags for serving Prometheus metrics
+var metricsFlags []cli.Flag = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "metrics-port",
+		Usage: "Port to serve Prometheus metrics on at /metrics, metrics are disabled if not set",
+	},
+	&cli.StringFlag{
+		Name:  "metrics-host",
+		Value: "127.0.0.1",
+		Usage: "Host to serve Prometheus metrics on",
+	},
+}
+
+// Address to serve metrics on, nil if metrics are not enabled
+func getMetricsAddr(cCtx *cli.Context) *proxy.Addr {
+	if cCtx.Int("metrics-port") <= 0 {
+		return nil
+	}
+	return &proxy.Addr{
+		Host: cCtx.String("metrics-host"),
+		Port: cCtx.Int("metrics-port"),
+	}
+}
+
+// Load the admin key the proxy writes when it starts in UIMA mode
+func loadSigningKey(cCtx *cli.Context) (*auth.KeyPair, error) {
 	var file string = cCtx.Path("key")
 	if file == "" {
 		return nil, errors.New("Please provide key file path")
@@ -22,25 +97,78 @@ func loadPublicKey(cCtx *cli.Context) (*auth.KeyPair, error) {
 		return nil, err
 	}
 	kp := &auth.KeyPair{}
-	err = kp.LoadPublicKey(data)
+	err = kp.LoadPrivateKey(data)
 	if err != nil {
 		return nil, err
 	}
 	return kp, nil
 }
 
-func getLogger(name string, logFile string) (*log.Logger, error) {
-	var logger *log.Logger = log.New(
-		os.Stdout, name+": ", log.Ltime,
-	)
-	if logFile != "" {
-		fp, err := os.OpenFile(logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-		if err != nil {
-			return logger, fmt.Errorf("Error opening file: %v", err)
-		}
-		logger.SetOutput(fp)
+const logFormatText string = "text"
+const logFormatJson string = "json"
+
+// Flags for the log output of the proxies
+var logFlags []cli.Flag = []cli.Flag{
+	&cli.PathFlag{
+		Name:  "log",
+		Usage: "Logfile",
+	},
+	&cli.StringFlag{
+		Name:  "log-level",
+		Value: "info",
+		Usage: "Lowest level of messages to log; debug, info, warn or error",
+	},
+	&cli.StringFlag{
+		Name:  "log-format",
+		Value: logFormatText,
+		Usage: "Format of log messages; text or json",
+	},
+}
+
+// Open a file to append log lines to, stdout if the path is empty or -
+func openLogFile(path string) (io.Writer, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, nil
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening file: %v", err)
+	}
+	return file, nil
+}
+
+// Logger with the level and format of the log flags, every message carries
+// the component
+func getLogger(cCtx *cli.Context, component string) (*slog.Logger, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(cCtx.String("log-level")))
+	if err != nil {
+		return nil, fmt.Errorf("%w; %s", ErrUnknownLogLevel, cCtx.String("log-level"))
+	}
+	w, err := openLogFile(cCtx.Path("log"))
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch cCtx.String("log-format") {
+	case logFormatText:
+		handler = slog.NewTextHandler(w, options)
+	case logFormatJson:
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return nil, fmt.Errorf("%w; %s", ErrUnknownLogFormat, cCtx.String("log-format"))
+	}
+	return slog.New(handler).With("component", component), nil
+}
+
+// Call reload every time SIGHUP is received
+func onReloadSignal(reload func()) {
+	signalChannel := make(chan os.Signal, 1)
+	signal.Notify(signalChannel, syscall.SIGHUP)
+	for range signalChannel {
+		reload()
 	}
-	return logger, nil
 }
 
 func waitForTerminationSignal(waitChannel chan error) {
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/angrybayblade/tunnel/auth"
+	"github.com/google/uuid"
+	"github.com/urfave/cli/v2"
+)
+
+func issueToken(cCtx *cli.Context) error {
+	keyFile := cCtx.Path("key")
+	kp, created, err := auth.LoadOrGenerateKeyPair(keyFile)
+	if err != nil {
+		return err
+	}
+	if created {
+		// The proxy only needs the public half
+		publicKey, err := kp.DumpPublicKey()
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(keyFile+".pub", publicKey, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Generated issuer key pair; start the proxy with --jwt-key", keyFile+".pub")
+	}
+
+	now := time.Now()
+	claims := auth.JwtClaims{
+		ID:          uuid.New().String(),
+		Subject:     cCtx.String("subject"),
+		IssuedAt:    now.Unix(),
+		Label:       cCtx.String("label"),
+		Subdomains:  cCtx.StringSlice("subdomain"),
+		MaxSessions: cCtx.Int("max-sessions"),
+		AllowTcp:    cCtx.Bool("allow-tcp"),
+	}
+	if cCtx.Duration("ttl") > 0 {
+		claims.Expires = now.Add(cCtx.Duration("ttl")).Unix()
+	}
+	token, err := auth.SignJwt(claims, kp)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Issued", "\n  ID:", claims.ID, "\n  Subject:", claims.Subject, "\n  Key:", token)
+	if claims.Expires != 0 {
+		fmt.Println("  Expires:", time.Unix(claims.Expires, 0).Format(time.RFC3339))
+	}
+	return nil
+}
+
+var IssueToken *cli.Command = &cli.Command{
+	Name:   "issue-token",
+	Usage:  "Sign an authentication token for proxies running with --jwt-key",
+	Action: issueToken,
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:  "key",
+			Value: "issuer.key",
+			Usage: "Issuer key for signing the token, generated if it does not exist",
+		},
+		&cli.StringFlag{
+			Name:     "subject",
+			Required: true,
+			Usage:    "Who the token is issued to, tunnels of the same subject share the session limit",
+		},
+		&cli.DurationFlag{
+			Name:  "ttl",
+			Value: 24 * time.Hour,
+			Usage: "Lifetime of the token, the token never expires if zero",
+		},
+		&cli.StringFlag{
+			Name:  "label",
+			Usage: "Label to tell tokens apart",
+		},
+		&cli.StringSliceFlag{
+			Name:  "subdomain",
+			Usage: "Subdomain pattern the token is limited to, like myapp or *-staging; can be repeated",
+		},
+		&cli.IntFlag{
+			Name:  "max-sessions",
+			Usage: "Max number of tunnels open with the subject at the same time, no limit if zero",
+		},
+		&cli.BoolFlag{
+			Name:  "allow-tcp",
+			Usage: "Allow the token to open TCP and UDP tunnels",
+		},
+	},
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/urfave/cli/v2"
+)
+
+func formatUnix(ts int64, zero string) string {
+	if ts == 0 {
+		return zero
+	}
+	return time.Unix(ts, 0).Format(time.RFC3339)
+}
+
+func listKeys(cCtx *cli.Context) error {
+	kp, err := loadSigningKey(cCtx)
+	if err != nil {
+		return err
+	}
+	request := &headers.ProxyFrame{
+		Code: headers.RequestListKeys,
+		Payload: headers.MarshalPayload(headers.ListKeysRequest{
+			AdminRequest: headers.NewAdminRequest(),
+		}),
+	}
+	proxy.SignAdminRequest(request, kp)
+
+	tlsConfig, err := getControlTlsConfig(cCtx)
+	if err != nil {
+		return err
+	}
+	proxyDial, _ := proxy.ConnectTo(cCtx.String("proxy"), true, 80, tlsConfig)
+	defer proxyDial.Close()
+	response, err := proxy.SendProxyRequest(proxyDial, request)
+	if err != nil {
+		return err
+	}
+
+	if response.Code == headers.ResponseNotInUimaMode {
+		return errors.New("Proxy not running in the UIMA mode")
+	}
+
+	if response.Code == headers.ResponseAuthError {
+		return fmt.Errorf("Request rejected; %w", response.Err())
+	}
+
+	if response.Code != headers.ResponseSuccess {
+		return response.Err()
+	}
+
+	listed := headers.ListKeysResponse{}
+	err = response.Decode(&listed)
+	if err != nil {
+		return err
+	}
+
+	if cCtx.Bool("json") {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(listed.Keys)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tLABEL\tCREATED\tEXPIRES\tLAST USED\tSESSIONS\tRESERVED\tKEY")
+	for _, key := range listed.Keys {
+		sessions := strconv.Itoa(key.Sessions)
+		if key.MaxSessions > 0 {
+			sessions += "/" + strconv.Itoa(key.MaxSessions)
+		}
+		label := key.Label
+		if label == "" {
+			label = "-"
+		}
+		reserved := strings.Join(key.Reserved, ",")
+		if reserved == "" {
+			reserved = "-"
+		}
+		fmt.Fprintf(
+			writer,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			key.ID,
+			label,
+			formatUnix(key.Created, "-"),
+			formatUnix(key.Expires, "never"),
+			formatUnix(key.LastUsed, "never"),
+			sessions,
+			reserved,
+			key.Key,
+		)
+	}
+	return writer.Flush()
+}
+
+var ListKeys *cli.Command = &cli.Command{
+	Name:   "list-keys",
+	Usage:  "List authentication keys",
+	Action: listKeys,
+	Flags: append([]cli.Flag{
+		&cli.PathFlag{
+			Name:  "key",
+			Value: "admin.key",
+			Usage: "Admin key for signing the request",
+		},
+		&cli.StringFlag{
+			Name:  "proxy",
+			Value: "localhost:3000",
+			Usage: "URI for proxy server",
+		},
+		&cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the keys as JSON",
+		},
+	}, controlTlsFlags...),
+}
@@ -2,17 +2,107 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/angrybayblade/tunnel/auth"
 	"github.com/angrybayblade/tunnel/proxy"
 	"github.com/urfave/cli/v2"
 )
 
 func listen(cCtx *cli.Context) error {
+	file, err := loadConfig(cCtx)
+	if err != nil {
+		return err
+	}
+	err = applyConfig(cCtx, file, listenConfigKeys)
+	if err != nil {
+		return err
+	}
+	err = applyAuthBackend(cCtx, file)
+	if err != nil {
+		return err
+	}
+
 	var port int = cCtx.Int("port")
 	var host string = cCtx.String("host")
 	var uima bool = cCtx.Bool("uima") // Use in-memory authentication server
 
-	logger, err := getLogger("FP", cCtx.String("log"))
+	logger, err := getLogger(cCtx, "forward-proxy")
+	if err != nil {
+		return err
+	}
+
+	var accessLog *proxy.AccessLog
+	if cCtx.Path("access-log") != "" {
+		w, err := openLogFile(cCtx.Path("access-log"))
+		if err != nil {
+			return err
+		}
+		accessLog, err = proxy.NewAccessLog(w, cCtx.String("access-log-format"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var tcpPortStart, tcpPortEnd int
+	if cCtx.String("tcp-ports") != "" {
+		tcpPortStart, tcpPortEnd, err = proxy.ParsePortRange(cCtx.String("tcp-ports"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var udpPortStart, udpPortEnd int
+	if cCtx.String("udp-ports") != "" {
+		udpPortStart, udpPortEnd, err = proxy.ParsePortRange(cCtx.String("udp-ports"))
+		if err != nil {
+			return err
+		}
+	}
+
+	var tlsConfig *proxy.TlsConfig
+	if cCtx.Int("tls-port") > 0 {
+		tlsConfig = &proxy.TlsConfig{
+			Addr: proxy.Addr{
+				Host: host,
+				Port: cCtx.Int("tls-port"),
+			},
+			CertFile:      cCtx.Path("tls-cert"),
+			KeyFile:       cCtx.Path("tls-key"),
+			Acme:          cCtx.Bool("acme"),
+			AcmeDirectory: cCtx.String("acme-directory"),
+			AcmeEmail:     cCtx.String("acme-email"),
+			AcmeCacheDir:  cCtx.Path("acme-cache"),
+			AcmeCaRoot:    cCtx.Path("acme-ca-root"),
+			Redirect:      cCtx.Bool("https-redirect"),
+		}
+	}
+
+	var controlTlsConfig *proxy.ControlTlsConfig
+	if cCtx.Path("control-tls-cert") != "" || cCtx.Path("control-client-ca") != "" || cCtx.Bool("require-control-tls") {
+		controlTlsConfig = &proxy.ControlTlsConfig{
+			CertFile:     cCtx.Path("control-tls-cert"),
+			KeyFile:      cCtx.Path("control-tls-key"),
+			ClientCAFile: cCtx.Path("control-client-ca"),
+			Require:      cCtx.Bool("require-control-tls"),
+		}
+	}
+
+	var adminApiConfig *proxy.AdminApiConfig
+	if cCtx.Int("admin-api-port") > 0 {
+		adminApiConfig = &proxy.AdminApiConfig{
+			Addr: proxy.Addr{
+				Host: cCtx.String("admin-api-host"),
+				Port: cCtx.Int("admin-api-port"),
+			},
+			Token:        cCtx.String("admin-api-token"),
+			CertFile:     cCtx.Path("admin-api-tls-cert"),
+			KeyFile:      cCtx.Path("admin-api-tls-key"),
+			ClientCAFile: cCtx.Path("admin-api-client-ca"),
+		}
+	}
+
+	inherited, err := inheritedListeners()
 	if err != nil {
 		return err
 	}
@@ -24,8 +114,33 @@ func listen(cCtx *cli.Context) error {
 			Host: host,
 			Port: port,
 		},
-		Logger: logger,
-		Uima:   uima,
+		Logger:            logger,
+		Uima:              uima,
+		QueueSize:         cCtx.Int("queue-size"),
+		QueueTimeout:      cCtx.Duration("queue-timeout"),
+		TcpPortStart:      tcpPortStart,
+		TcpPortEnd:        tcpPortEnd,
+		UdpPortStart:      udpPortStart,
+		UdpPortEnd:        udpPortEnd,
+		UdpIdleTimeout:    cCtx.Duration("udp-idle-timeout"),
+		Tls:               tlsConfig,
+		ControlTls:        controlTlsConfig,
+		AuthStore:         cCtx.Path("auth-store"),
+		AdminKeyFile:      cCtx.Path("admin-key"),
+		JwtKeyFile:        cCtx.Path("jwt-key"),
+		JwtRevocationFile: cCtx.Path("jwt-revocations"),
+		AuthWebhook:       cCtx.String("auth-webhook"),
+		AuthWebhookTTL:    cCtx.Duration("auth-webhook-ttl"),
+		DomainStore:       cCtx.Path("domain-store"),
+		BaseDomain:        strings.TrimSuffix(strings.ToLower(cCtx.String("domain")), "."),
+		ResumeGrace:       cCtx.Duration("resume-grace"),
+		HeartbeatInterval: cCtx.Duration("heartbeat-interval"),
+		HeartbeatTimeout:  cCtx.Duration("heartbeat-timeout"),
+		OfflinePage:       cCtx.Path("offline-page"),
+		AdminApi:          adminApiConfig,
+		AccessLog:         accessLog,
+		Metrics:           getMetricsAddr(cCtx),
+		Inherited:         inherited,
 	}
 
 	err = proxy.Setup()
@@ -34,13 +149,24 @@ func listen(cCtx *cli.Context) error {
 	}
 
 	go proxy.Listen()
+	notifyReady(inherited)
 	go waitForTerminationSignal(quitCh)
+	go onReloadSignal(proxy.Reload)
+	go onHandoffSignal(func() {
+		pid, err := handoff(proxy)
+		if err != nil {
+			logger.Error("Listener handoff failed", "error", err)
+			return
+		}
+		logger.Info("Handed the listeners over", "pid", pid)
+		quitCh <- ErrHandoff
+	})
 	go func(waitChannel chan error, quitChannel chan error) {
 		quitCh <- <-quitChannel
 	}(quitCh, proxy.Quitch)
 
 	err = <-quitCh
-	proxy.Stop()
+	proxy.Drain(cCtx.Duration("drain-timeout"))
 	return err
 }
 
@@ -48,7 +174,8 @@ var Listen *cli.Command = &cli.Command{
 	Name:   "listen",
 	Usage:  "Listen on a port for new forward requests",
 	Action: listen,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
+		configFlag,
 		&cli.IntFlag{
 			Name:  "port",
 			Value: 3000,
@@ -59,13 +186,179 @@ var Listen *cli.Command = &cli.Command{
 			Value: "127.0.0.1",
 			Usage: "Host to serve",
 		},
+		&cli.PathFlag{
+			Name:  "access-log",
+			Usage: "File to log visitor requests to, - for stdout",
+		},
 		&cli.StringFlag{
-			Name:  "log",
-			Usage: "Logfile",
+			Name:  "access-log-format",
+			Value: proxy.AccessLogCombined,
+			Usage: "Format of the access log; common, combined or json",
 		},
 		&cli.BoolFlag{
 			Name:  "uima",
 			Usage: "Use in-memory authentication server",
 		},
-	},
+		&cli.IntFlag{
+			Name:  "queue-size",
+			Value: proxy.DefaultQueueSize,
+			Usage: "Max number of requests waiting for a free connection per session",
+		},
+		&cli.DurationFlag{
+			Name:  "queue-timeout",
+			Value: proxy.DefaultQueueTimeout,
+			Usage: "Max time a request waits for a free connection",
+		},
+		&cli.StringFlag{
+			Name:  "tcp-ports",
+			Usage: "Range of public ports for TCP tunnels, eg. 20000-20100",
+		},
+		&cli.StringFlag{
+			Name:  "udp-ports",
+			Usage: "Range of public ports for UDP tunnels, eg. 30000-30100",
+		},
+		&cli.DurationFlag{
+			Name:  "udp-idle-timeout",
+			Value: proxy.DefaultUdpIdleTimeout,
+			Usage: "Close UDP flows which see no datagram for this long",
+		},
+		&cli.IntFlag{
+			Name:  "tls-port",
+			Usage: "Port to serve HTTPS on, HTTPS is disabled if not set",
+		},
+		&cli.PathFlag{
+			Name:  "tls-cert",
+			Usage: "Certificate file, eg. a wildcard certificate for *.tunnel.example.com",
+		},
+		&cli.PathFlag{
+			Name:  "tls-key",
+			Usage: "Private key file for the certificate",
+		},
+		&cli.BoolFlag{
+			Name:  "acme",
+			Usage: "Obtain certificates for tunnel hosts from an ACME server",
+		},
+		&cli.StringFlag{
+			Name:  "acme-directory",
+			Value: "https://acme-v02.api.letsencrypt.org/directory",
+			Usage: "Directory URL of the ACME server",
+		},
+		&cli.StringFlag{
+			Name:  "acme-email",
+			Usage: "Contact email for the ACME account",
+		},
+		&cli.PathFlag{
+			Name:  "acme-cache",
+			Value: proxy.DefaultAcmeCacheDir,
+			Usage: "Directory to store ACME account keys and certificates in",
+		},
+		&cli.PathFlag{
+			Name:  "acme-ca-root",
+			Usage: "Root certificate of the ACME server, for test servers like Pebble",
+		},
+		&cli.BoolFlag{
+			Name:  "https-redirect",
+			Value: true,
+			Usage: "Redirect plain HTTP visitors to HTTPS when HTTPS is enabled",
+		},
+		&cli.PathFlag{
+			Name:  "auth-store",
+			Usage: "File to persist UIMA tokens in, the admin key is stored next to it",
+		},
+		&cli.PathFlag{
+			Name:  "admin-key",
+			Usage: "File to load the admin key pair from, generated if it does not exist",
+		},
+		&cli.PathFlag{
+			Name:  "control-tls-cert",
+			Usage: "Certificate for the control channel, the HTTPS certificate is used if not set",
+		},
+		&cli.PathFlag{
+			Name:  "control-tls-key",
+			Usage: "Private key for the control channel certificate",
+		},
+		&cli.PathFlag{
+			Name:  "control-client-ca",
+			Usage: "CA for client certificates, clients with a valid certificate don't need an API key",
+		},
+		&cli.BoolFlag{
+			Name:  "require-control-tls",
+			Usage: "Reject control requests which are not sent over TLS",
+		},
+		&cli.PathFlag{
+			Name:  "jwt-key",
+			Usage: "Ed25519 public key of the token issuer, accepts signed tokens instead of issued ones",
+		},
+		&cli.PathFlag{
+			Name:  "jwt-revocations",
+			Usage: "File with the IDs of revoked tokens, one per line",
+		},
+		&cli.StringFlag{
+			Name:  "auth-webhook",
+			Usage: "URL to ask whether a token may open a tunnel",
+		},
+		&cli.DurationFlag{
+			Name:  "auth-webhook-ttl",
+			Value: auth.DefaultWebhookCacheTTL,
+			Usage: "How long webhook decisions are cached",
+		},
+		&cli.StringFlag{
+			Name:  "domain",
+			Usage: "Domain the tunnels are served under, eg. tunnel.example.com, custom domains can't be registered under it",
+		},
+		&cli.PathFlag{
+			Name:  "domain-store",
+			Usage: "File to keep custom domains in, they are lost on restart if not set",
+		},
+		&cli.DurationFlag{
+			Name:  "resume-grace",
+			Value: proxy.DefaultResumeGrace,
+			Usage: "How long a tunnel waits for its client to reconnect, zero closes tunnels right away",
+		},
+		&cli.PathFlag{
+			Name:  "offline-page",
+			Usage: "HTML page visitors get while a tunnel is reconnecting",
+		},
+		&cli.IntFlag{
+			Name:  "admin-api-port",
+			Usage: "Port to serve the admin API on, the API is disabled if not set",
+		},
+		&cli.StringFlag{
+			Name:  "admin-api-host",
+			Value: "127.0.0.1",
+			Usage: "Host to serve the admin API on",
+		},
+		&cli.StringFlag{
+			Name:    "admin-api-token",
+			EnvVars: []string{"PROXY_ADMIN_API_TOKEN"},
+			Usage:   "Bearer token for the admin API",
+		},
+		&cli.PathFlag{
+			Name:  "admin-api-tls-cert",
+			Usage: "Certificate to serve the admin API over TLS with",
+		},
+		&cli.PathFlag{
+			Name:  "admin-api-tls-key",
+			Usage: "Private key for the admin API certificate",
+		},
+		&cli.PathFlag{
+			Name:  "admin-api-client-ca",
+			Usage: "CA which signs client certificates for the admin API, clients with a valid certificate don't need the token",
+		},
+		&cli.DurationFlag{
+			Name:  "drain-timeout",
+			Value: proxy.DefaultDrainTimeout,
+			Usage: "How long requests in flight get to finish on shutdown or handoff",
+		},
+		&cli.DurationFlag{
+			Name:  "heartbeat-interval",
+			Value: proxy.DefaultHeartbeatInterval,
+			Usage: "How often idle tunnel connections are pinged, zero disables pings",
+		},
+		&cli.DurationFlag{
+			Name:  "heartbeat-timeout",
+			Value: proxy.DefaultHeartbeatTimeout,
+			Usage: "How long a ping may take before the connection is dropped",
+		},
+	}, append(logFlags, metricsFlags...)...),
 }
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
@@ -12,39 +11,58 @@ import (
 )
 
 func revokeKey(cCtx *cli.Context) error {
-	var keyId uint16 = uint16(cCtx.Int("id"))
-	if keyId == 0 {
-		return errors.New("Auth token ID cannot be 0")
+	var keyId int = cCtx.Int("id")
+	if keyId <= 0 {
+		return errors.New("Auth token ID has to be greater than 0")
 	}
 
-	kp, err := loadPublicKey(cCtx)
+	kp, err := loadSigningKey(cCtx)
 	if err != nil {
 		return err
 	}
-	messageBytes := make([]byte, 2)
-	binary.LittleEndian.PutUint16(messageBytes, keyId)
-	requestEnc, err := kp.Encrypt(messageBytes[:1])
-	proxyDial, _ := proxy.ConnectTo(cCtx.String("proxy"), true, 80)
-	request := &headers.ProxyHeader{
-		Code: headers.ProxyRequestRevokeKey,
-		Key:  string(requestEnc),
+	request := &headers.ProxyFrame{
+		Code: headers.RequestRevokeKey,
+		Payload: headers.MarshalPayload(headers.RevokeKeyRequest{
+			AdminRequest: headers.NewAdminRequest(),
+			ID:           keyId,
+		}),
 	}
-	request.Write(proxyDial)
-	response := &headers.ProxyHeader{}
-	response.Read(proxyDial)
-	if response.Code == headers.ProxyResponseNotInUimaMode {
+	proxy.SignAdminRequest(request, kp)
+
+	tlsConfig, err := getControlTlsConfig(cCtx)
+	if err != nil {
+		return err
+	}
+	proxyDial, _ := proxy.ConnectTo(cCtx.String("proxy"), true, 80, tlsConfig)
+	defer proxyDial.Close()
+	response, err := proxy.SendProxyRequest(proxyDial, request)
+	if err != nil {
+		return err
+	}
+
+	if response.Code == headers.ResponseNotInUimaMode {
 		return errors.New("Proxy not running in the UIMA mode")
 	}
 
-	if response.Code == headers.ProxyResponseAuthError {
-		return errors.New("Invalid signing key")
+	if response.Code == headers.ResponseAuthError {
+		return fmt.Errorf("Request rejected; %w", response.Err())
 	}
 
-	if response.Key == string(make([]byte, 43)) {
-		return errors.New("Key was not found with ID: " + strconv.Itoa(int(keyId)))
+	if response.Code == headers.ResponseKeyNotFound {
+		return errors.New("Key was not found with ID: " + strconv.Itoa(keyId))
 	}
 
-	fmt.Println("Deleted", "\n  ID:", keyId, "\n  Key:", response.Key)
+	if response.Code != headers.ResponseSuccess {
+		return response.Err()
+	}
+
+	revoked := headers.RevokeKeyResponse{}
+	err = response.Decode(&revoked)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Deleted", "\n  ID:", revoked.ID, "\n  Key:", revoked.Key)
 	return nil
 }
 
@@ -52,19 +70,20 @@ var RevokeKey *cli.Command = &cli.Command{
 	Name:   "revoke-key",
 	Usage:  "Revoke authentication key",
 	Action: revokeKey,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		&cli.IntFlag{
 			Name:  "id",
 			Usage: "ID of the auth token",
 		},
-		&cli.StringFlag{
+		&cli.PathFlag{
 			Name:  "key",
-			Usage: "Key for signing the request",
+			Value: "admin.key",
+			Usage: "Admin key for signing the request",
 		},
 		&cli.StringFlag{
 			Name:  "proxy",
 			Value: "localhost:3000",
 			Usage: "URI for proxy server",
 		},
-	},
+	}, controlTlsFlags...),
 }
@@ -0,0 +1,284 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Config files are a subset of TOML
+// _____________________________________
+// | # comment                         |
+// | key = "string" | 'literal' | 42 | true |
+// | [table]                           |
+// | [table.sub]                       |
+// | key = "value" # comment           |
+// -------------------------------------
+//
+// Keys are bare, letters, digits, dashes and underscores. Arrays, inline
+// tables, floats, dates and multi-line strings are not supported.
+
+var ErrInvalidKey = errors.New("Keys can only have letters, digits, dashes and underscores")
+var ErrDuplicateKey = errors.New("Key is already set")
+var ErrDuplicateTable = errors.New("Table is already defined")
+var ErrInvalidValue = errors.New("Value should be a string, an integer or a boolean")
+var ErrUnterminatedString = errors.New("String is not terminated")
+var ErrTrailingCharacters = errors.New("Unexpected characters after the value")
+
+// Error points at the line of the config file it is about
+type Error struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Value is a string, an int64 or a bool with the line it was set on
+type Value struct {
+	Line  int
+	Value any
+}
+
+// File holds the values of a config file by dotted path, eg. tls.port for
+// the port key of the tls table
+type File struct {
+	Name   string
+	values map[string]*Value
+	tables map[string]int
+}
+
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+func Parse(name string, data []byte) (*File, error) {
+	file := &File{
+		Name:   name,
+		values: make(map[string]*Value),
+		tables: make(map[string]int),
+	}
+	table := ""
+	for idx, line := range strings.Split(string(data), "\n") {
+		lineNumber := idx + 1
+		line = strings.TrimSpace(strings.TrimSuffix(line, "\r"))
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			name, err := parseTable(line)
+			if err != nil {
+				return nil, file.Errorf(lineNumber, "%w", err)
+			}
+			if _, ok := file.tables[name]; ok {
+				return nil, file.Errorf(lineNumber, "%w; %s", ErrDuplicateTable, name)
+			}
+			file.tables[name] = lineNumber
+			table = name + "."
+			continue
+		}
+
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, file.Errorf(lineNumber, "Expected key = value or [table]")
+		}
+		key = strings.TrimSpace(key)
+		if !isBareKey(key) {
+			return nil, file.Errorf(lineNumber, "%w; %s", ErrInvalidKey, key)
+		}
+		value, err := parseValue(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, file.Errorf(lineNumber, "%w", err)
+		}
+		path := table + key
+		if previous, ok := file.values[path]; ok {
+			return nil, file.Errorf(lineNumber, "%w on line %d; %s", ErrDuplicateKey, previous.Line, path)
+		}
+		file.values[path] = &Value{Line: lineNumber, Value: value}
+	}
+	return file, nil
+}
+
+// Error on a line of the file
+func (f *File) Errorf(line int, format string, args ...any) error {
+	return &Error{File: f.Name, Line: line, Err: fmt.Errorf(format, args...)}
+}
+
+// Value at the dotted path, nil if it is not set
+func (f *File) Get(path string) *Value {
+	return f.values[path]
+}
+
+// Dotted paths of every value, sorted
+func (f *File) Paths() []string {
+	paths := make([]string, 0, len(f.values))
+	for path := range f.values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Names of the tables under the parent table, sorted
+func (f *File) Tables(parent string) []string {
+	prefix := parent + "."
+	seen := make(map[string]bool)
+	names := []string{}
+	add := func(path string) {
+		rest, ok := strings.CutPrefix(path, prefix)
+		if !ok {
+			return
+		}
+		name, _, nested := strings.Cut(rest, ".")
+		if nested && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	for path := range f.values {
+		add(path)
+	}
+	for path := range f.tables {
+		add(path + ".")
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Line a table is defined on, zero if it has no header
+func (f *File) TableLine(path string) int {
+	return f.tables[path]
+}
+
+func isBareKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+func parseTable(line string) (string, error) {
+	end := strings.IndexByte(line, ']')
+	if end < 0 || strings.HasPrefix(line, "[[") {
+		return "", fmt.Errorf("Expected [table]")
+	}
+	if err := checkTrailing(line[end+1:]); err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(line[1:end])
+	for _, key := range strings.Split(name, ".") {
+		if !isBareKey(strings.TrimSpace(key)) {
+			return "", fmt.Errorf("%w; %s", ErrInvalidKey, name)
+		}
+	}
+	return strings.ReplaceAll(name, " ", ""), nil
+}
+
+// Only whitespace and a comment may follow a value
+func checkTrailing(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && rest[0] != '#' {
+		return fmt.Errorf("%w; %s", ErrTrailingCharacters, rest)
+	}
+	return nil
+}
+
+func parseValue(raw string) (any, error) {
+	if raw == "" {
+		return nil, ErrInvalidValue
+	}
+	switch raw[0] {
+	case '"':
+		return parseBasicString(raw)
+	case '\'':
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return nil, ErrUnterminatedString
+		}
+		return raw[1 : end+1], checkTrailing(raw[end+2:])
+	}
+
+	token, rest := raw, ""
+	if end := strings.IndexAny(raw, " \t#"); end >= 0 {
+		token, rest = raw[:end], raw[end:]
+	}
+	var value any
+	switch token {
+	case "true":
+		value = true
+	case "false":
+		value = false
+	default:
+		digits := strings.ReplaceAll(token, "_", "")
+		number, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil || strings.HasPrefix(token, "_") || strings.HasSuffix(token, "_") || strings.Contains(token, "__") {
+			return nil, fmt.Errorf("%w; %s", ErrInvalidValue, token)
+		}
+		value = number
+	}
+	return value, checkTrailing(rest)
+}
+
+func parseBasicString(raw string) (string, error) {
+	var value strings.Builder
+	for idx := 1; idx < len(raw); idx++ {
+		c := raw[idx]
+		switch c {
+		case '"':
+			return value.String(), checkTrailing(raw[idx+1:])
+		case '\\':
+			idx++
+			if idx >= len(raw) {
+				return "", ErrUnterminatedString
+			}
+			switch raw[idx] {
+			case '"', '\\':
+				value.WriteByte(raw[idx])
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			case 'r':
+				value.WriteByte('\r')
+			case 'u', 'U':
+				size := 4
+				if raw[idx] == 'U' {
+					size = 8
+				}
+				if idx+size >= len(raw) {
+					return "", ErrUnterminatedString
+				}
+				code, err := strconv.ParseUint(raw[idx+1:idx+1+size], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", fmt.Errorf("Invalid unicode escape; %s", raw[idx-1:idx+1+size])
+				}
+				value.WriteRune(rune(code))
+				idx += size
+			default:
+				return "", fmt.Errorf("Invalid escape; \\%c", raw[idx])
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", ErrUnterminatedString
+}
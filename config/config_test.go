@@ -0,0 +1,170 @@
+package config
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseValues(t *testing.T) {
+	data := `# proxy settings
+host = "0.0.0.0"
+port = 8_080 # comment
+debug = true
+quiet = false
+literal = 'C:\path\#not a comment'
+escaped = "a\tb\n\"c\" \\ \u00e9 \U0001F600 # not a comment"
+empty = ""
+negative = -42
+
+[tls]
+port = 443
+
+[ tunnels.web ]
+local = "3000"
+`
+	file, err := Parse("test.toml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path  string
+		value any
+		line  int
+	}{
+		{"host", "0.0.0.0", 2},
+		{"port", int64(8080), 3},
+		{"debug", true, 4},
+		{"quiet", false, 5},
+		{"literal", `C:\path\#not a comment`, 6},
+		{"escaped", "a\tb\n\"c\" \\ \u00e9 \U0001F600 # not a comment", 7},
+		{"empty", "", 8},
+		{"negative", int64(-42), 9},
+		{"tls.port", int64(443), 12},
+		{"tunnels.web.local", "3000", 15},
+	}
+	for _, test := range tests {
+		value := file.Get(test.path)
+		if value == nil {
+			t.Errorf("%s is not set", test.path)
+			continue
+		}
+		if value.Value != test.value || value.Line != test.line {
+			t.Errorf("%s = %#v on line %d, want %#v on line %d", test.path, value.Value, value.Line, test.value, test.line)
+		}
+	}
+	if file.Get("missing") != nil {
+		t.Error("missing key is set")
+	}
+	if file.TableLine("tunnels.web") != 14 {
+		t.Errorf("tunnels.web is on line %d, want 14", file.TableLine("tunnels.web"))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		line int
+		err  error
+	}{
+		{"duplicate key", "a = 1\nb = 2\na = 3", 3, ErrDuplicateKey},
+		{"duplicate key in table", "[t]\na = 1\n[u]\n[t.v]\n", 0, nil},
+		{"duplicate table", "[t]\na = 1\n[t]", 3, ErrDuplicateTable},
+		{"invalid key", "a b = 1", 1, ErrInvalidKey},
+		{"invalid table", "[a b]", 1, ErrInvalidKey},
+		{"missing value", "a =", 1, ErrInvalidValue},
+		{"float", "a = 1.5", 1, ErrInvalidValue},
+		{"array", "\na = [1, 2]", 2, ErrInvalidValue},
+		{"bare word", "a = yes", 1, ErrInvalidValue},
+		{"leading underscore", "a = _1", 1, ErrInvalidValue},
+		{"double underscore", "a = 1__0", 1, ErrInvalidValue},
+		{"unterminated string", "a = \"abc", 1, ErrUnterminatedString},
+		{"unterminated escape", "a = \"abc\\", 1, ErrUnterminatedString},
+		{"unterminated literal", "a = 'abc", 1, ErrUnterminatedString},
+		{"short unicode escape", "a = \"\\u00\"", 1, ErrUnterminatedString},
+		{"trailing after string", "a = \"abc\" def", 1, ErrTrailingCharacters},
+		{"trailing after literal", "a = 'abc' def", 1, ErrTrailingCharacters},
+		{"trailing after number", "a = 1 2", 1, ErrTrailingCharacters},
+		{"trailing after table", "[t] x", 1, ErrTrailingCharacters},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse("test.toml", []byte(test.data))
+			if test.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+			configErr := &Error{}
+			if !errors.As(err, &configErr) {
+				t.Fatalf("error %v is not a config error", err)
+			}
+			if configErr.Line != test.line || configErr.File != "test.toml" {
+				t.Errorf("error on %s:%d, want test.toml:%d", configErr.File, configErr.Line, test.line)
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestParseInvalidEscapes(t *testing.T) {
+	for _, data := range []string{
+		`a = "\x41"`,
+		`a = "\uZZZZ"`,
+		`a = "\uD800"`,
+		`a = "\U00110000"`,
+		"a = [[t]]",
+		"just text",
+	} {
+		_, err := Parse("test.toml", []byte(data))
+		configErr := &Error{}
+		if !errors.As(err, &configErr) || configErr.Line != 1 {
+			t.Errorf("Parse(%q) = %v, want an error on line 1", data, err)
+		}
+	}
+}
+
+func TestErrorFormat(t *testing.T) {
+	file := &File{Name: "listen.toml"}
+	err := file.Errorf(12, "%s; %w", "limits.queue_size", ErrInvalidValue)
+	want := "listen.toml:12: limits.queue_size; " + ErrInvalidValue.Error()
+	if err.Error() != want {
+		t.Errorf("error %q, want %q", err.Error(), want)
+	}
+	if !errors.Is(err, ErrInvalidValue) {
+		t.Error("error does not wrap the cause")
+	}
+}
+
+func TestPathsAndTables(t *testing.T) {
+	data := `
+b = 1
+a = 2
+[tunnels.web]
+local = "3000"
+[tunnels.api]
+local = "8080"
+[tunnels.empty]
+[tunnels.deep.nested]
+x = 1
+`
+	file, err := Parse("test.toml", []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := []string{"a", "b", "tunnels.api.local", "tunnels.deep.nested.x", "tunnels.web.local"}
+	if got := file.Paths(); !reflect.DeepEqual(got, paths) {
+		t.Errorf("paths %v, want %v", got, paths)
+	}
+	tables := []string{"api", "deep", "empty", "web"}
+	if got := file.Tables("tunnels"); !reflect.DeepEqual(got, tables) {
+		t.Errorf("tables %v, want %v", got, tables)
+	}
+	if got := file.Tables("missing"); len(got) != 0 {
+		t.Errorf("tables of a missing table %v", got)
+	}
+}
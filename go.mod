@@ -5,10 +5,13 @@ go 1.21.1
 require (
 	github.com/google/uuid v1.3.1
 	github.com/urfave/cli/v2 v2.25.7
+	golang.org/x/crypto v0.31.0
 )
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
@@ -17,11 +17,14 @@ func main() {
 			cmd.Forward,
 			cmd.GenerateKey,
 			cmd.RevokeKey,
+			cmd.ListKeys,
+			cmd.IssueToken,
+			cmd.Domain,
 		},
 	}
 
 	err := app.Run(os.Args)
-	if err == nil || err == cmd.ErrSigterm {
+	if err == nil || err == cmd.ErrSigterm || err == cmd.ErrHandoff {
 		return
 	}
 
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+)
+
+// Formats of the visitor access log. Common and combined lines end with the
+// host and the duration in seconds, after the fields of the standard format.
+const AccessLogCommon string = "common"
+const AccessLogCombined string = "combined"
+const AccessLogJson string = "json"
+
+const clfTimeLayout string = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLog writes a line for every visitor request the forward proxy
+// answers, safe to use from multiple goroutines
+type AccessLog struct {
+	format string
+	w      io.Writer
+	mut    sync.Mutex
+}
+
+func NewAccessLog(w io.Writer, format string) (*AccessLog, error) {
+	switch format {
+	case AccessLogCommon, AccessLogCombined, AccessLogJson:
+	default:
+		return nil, ErrUnknownAccessLogFormat
+	}
+	return &AccessLog{format: format, w: w}, nil
+}
+
+type AccessEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIp  string    `json:"client_ip"`
+	Host      string    `json:"host"`
+	Session   string    `json:"session,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Protocol  string    `json:"protocol"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+// Entry for a visitor request, the status, bytes and duration are filled
+// in once it is answered
+func newAccessEntry(request *headers.HttpRequestHeader, conn net.Conn, host string, session string) *AccessEntry {
+	clientIp := conn.RemoteAddr().String()
+	if ip, _, err := net.SplitHostPort(clientIp); err == nil {
+		clientIp = ip
+	}
+	return &AccessEntry{
+		Time:      time.Now(),
+		ClientIp:  clientIp,
+		Host:      host,
+		Session:   session,
+		Method:    request.Method,
+		Path:      request.Path,
+		Protocol:  request.Protocol,
+		Referer:   request.Get("Referer"),
+		UserAgent: request.Get("User-Agent"),
+	}
+}
+
+func (entry *AccessEntry) done(status int, bytes int64) {
+	entry.Status = status
+	entry.Bytes = bytes
+	entry.Duration = time.Since(entry.Time).Seconds()
+}
+
+func (al *AccessLog) Log(entry *AccessEntry) {
+	var line []byte
+	if al.format == AccessLogJson {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = al.clf(entry)
+	}
+	line = append(line, '\n')
+	al.mut.Lock()
+	defer al.mut.Unlock()
+	al.w.Write(line)
+}
+
+func clfField(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func (al *AccessLog) clf(entry *AccessEntry) []byte {
+	line := make([]byte, 0, 256)
+	line = append(line, clfField(entry.ClientIp)...)
+	line = append(line, " - - ["...)
+	line = entry.Time.AppendFormat(line, clfTimeLayout)
+	line = append(line, "] "...)
+	line = strconv.AppendQuote(line, entry.Method+" "+entry.Path+" "+entry.Protocol)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, int64(entry.Status), 10)
+	line = append(line, ' ')
+	if entry.Bytes > 0 {
+		line = strconv.AppendInt(line, entry.Bytes, 10)
+	} else {
+		line = append(line, '-')
+	}
+	if al.format == AccessLogCombined {
+		line = append(line, ' ')
+		line = strconv.AppendQuote(line, clfField(entry.Referer))
+		line = append(line, ' ')
+		line = strconv.AppendQuote(line, clfField(entry.UserAgent))
+	}
+	line = append(line, ' ')
+	line = append(line, clfField(entry.Host)...)
+	line = append(line, ' ')
+	line = strconv.AppendFloat(line, entry.Duration, 'f', 6, 64)
+	return line
+}
+
+func (fp *ForwardProxy) logAccess(entry *AccessEntry, status int, bytes int64) {
+	if fp.AccessLog == nil {
+		return
+	}
+	entry.done(status, bytes)
+	fp.AccessLog.Log(entry)
+}
+
+// Status of the response a visitor got from a forwarded request, failed
+// requests get a response from the proxy instead of the local server
+func forwardStatus(exchange *HttpExchange, err error) int {
+	switch {
+	case exchange != nil && exchange.Response != nil:
+		return exchange.Response.StatusCode
+	case errors.Is(err, ErrSessionClosed):
+		return headers.HttpResponseNoSessionFound.StatusCode
+	case errors.Is(err, ErrForwardFailedNoFreeConnection),
+		errors.Is(err, ErrForwardFailedQueueFull),
+		errors.Is(err, ErrForwardFailedQueueTimeout):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	entry := &AccessEntry{
+		Time:      time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		ClientIp:  "203.0.113.7",
+		Host:      "web.example.com",
+		Method:    "GET",
+		Path:      "/index.html",
+		Protocol:  "HTTP/1.1",
+		Status:    200,
+		Bytes:     512,
+		Duration:  0.25,
+		UserAgent: "curl/8.0",
+	}
+	tests := []struct {
+		format string
+		line   string
+	}{
+		{AccessLogCommon, `203.0.113.7 - - [01/Mar/2024:12:30:00 +0000] "GET /index.html HTTP/1.1" 200 512 web.example.com 0.250000` + "\n"},
+		{AccessLogCombined, `203.0.113.7 - - [01/Mar/2024:12:30:00 +0000] "GET /index.html HTTP/1.1" 200 512 "-" "curl/8.0" web.example.com 0.250000` + "\n"},
+	}
+	for _, test := range tests {
+		buffer := &bytes.Buffer{}
+		accessLog, err := NewAccessLog(buffer, test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accessLog.Log(entry)
+		if buffer.String() != test.line {
+			t.Errorf("%s line\n%q, want\n%q", test.format, buffer.String(), test.line)
+		}
+	}
+
+	buffer := &bytes.Buffer{}
+	accessLog, _ := NewAccessLog(buffer, AccessLogJson)
+	accessLog.Log(entry)
+	logged := &AccessEntry{}
+	if err := json.Unmarshal(buffer.Bytes(), logged); err != nil {
+		t.Fatal(err)
+	}
+	if *logged != *entry {
+		t.Errorf("json entry %+v, want %+v", logged, entry)
+	}
+
+	if _, err := NewAccessLog(buffer, "apache"); err != ErrUnknownAccessLogFormat {
+		t.Errorf("error %v, want %v", err, ErrUnknownAccessLogFormat)
+	}
+}
+
+func TestForwardStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		exchange *HttpExchange
+		err      error
+		status   int
+	}{
+		{"response", &HttpExchange{Response: &headers.HttpResponseHeader{StatusCode: http.StatusTeapot}}, nil, http.StatusTeapot},
+		{"session closed", nil, ErrSessionClosed, http.StatusNotFound},
+		{"no free stream", nil, ErrForwardFailedNoFreeConnection, http.StatusServiceUnavailable},
+		{"queue full", nil, ErrForwardFailedQueueFull, http.StatusServiceUnavailable},
+		{"queue timeout", nil, ErrForwardFailedQueueTimeout, http.StatusServiceUnavailable},
+		{"upstream", &HttpExchange{}, errors.New("reset"), http.StatusBadGateway},
+	}
+	for _, test := range tests {
+		if status := forwardStatus(test.exchange, test.err); status != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, status, test.status)
+		}
+	}
+}
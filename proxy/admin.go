@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/metrics"
+)
+
+// Name of the admin API listener when it is handed over to a new process
+const ListenerAdminApi string = "admin-api"
+
+const adminApiReadTimeout time.Duration = 10 * time.Second
+const adminApiMaxBodySize int64 = 1 << 16
+
+// AdminApiConfig enables the JSON admin API on a listener of its own.
+// Requests need the bearer token or a client certificate signed by the
+// client CA, health and readiness checks are open.
+type AdminApiConfig struct {
+	Addr  Addr
+	Token string
+	// Serve the API over TLS with this certificate
+	CertFile string
+	KeyFile  string
+	// CA which signs client certificates, needs TLS
+	ClientCAFile string
+}
+
+type adminStatus struct {
+	Status   string `json:"status"`
+	Sessions int    `json:"sessions"`
+}
+
+func (fp *ForwardProxy) setupAdminApi() error {
+	if fp.AdminApi.Token == "" && fp.AdminApi.ClientCAFile == "" {
+		return ErrAdminApiNeedsAuth
+	}
+	if fp.AdminApi.ClientCAFile != "" && fp.AdminApi.CertFile == "" {
+		return ErrAdminApiClientCaNeedsTls
+	}
+	ln, err := fp.listen(ListenerAdminApi, fp.AdminApi.Addr.ToString())
+	if err != nil {
+		return err
+	}
+	fp.adminApiLn = ln
+
+	if fp.AdminApi.CertFile != "" {
+		config, err := fp.adminApiTlsConfig()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, config)
+	}
+	fp.adminApi = &http.Server{
+		Handler:           fp.adminApiHandler(),
+		ReadHeaderTimeout: adminApiReadTimeout,
+		ErrorLog:          slog.NewLogLogger(fp.Logger.Handler(), slog.LevelError),
+	}
+	go fp.adminApi.Serve(ln)
+	fp.Logger.Info("Serving the admin API", "addr", fp.AdminApi.Addr.ToString())
+	return nil
+}
+
+func (fp *ForwardProxy) adminApiTlsConfig() (*tls.Config, error) {
+	store, err := LoadCertificateStore(fp.AdminApi.CertFile, fp.AdminApi.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	fp.adminApiCertificates = store
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return store.Certificate(), nil
+		},
+	}
+	if fp.AdminApi.ClientCAFile != "" {
+		data, err := os.ReadFile(fp.AdminApi.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s", fp.AdminApi.ClientCAFile)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func (fp *ForwardProxy) adminApiHandler() http.Handler {
+	router := http.NewServeMux()
+	router.HandleFunc("/health", fp.adminHealth)
+	router.HandleFunc("/ready", fp.adminReady)
+	router.HandleFunc("/sessions", fp.adminAuthorized(fp.adminSessions))
+	router.HandleFunc("/sessions/", fp.adminAuthorized(fp.adminSession))
+	router.HandleFunc("/tokens", fp.adminAuthorized(fp.adminTokens))
+	router.HandleFunc("/tokens/", fp.adminAuthorized(fp.adminToken))
+	router.HandleFunc("/metrics", fp.adminAuthorized(metrics.Handler(fp.WriteMetrics).ServeHTTP))
+	return router
+}
+
+// Let the request through with a verified client certificate or the token
+func (fp *ForwardProxy) adminAuthorized(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			handler(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && fp.AdminApi.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(fp.AdminApi.Token)) == 1 {
+			handler(w, r)
+			return
+		}
+		fp.authFailures.Add(1, authFailureAdminApi)
+		fp.Logger.Warn("Unauthorized admin API request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAdminError(w, http.StatusUnauthorized, ErrAdminApiUnauthorized)
+	}
+}
+
+func writeAdminJson(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	writeAdminJson(w, status, headers.ErrorPayload{Error: err.Error()})
+}
+
+// Answer with 405 unless the request uses one of the methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s is not allowed", r.Method))
+	return false
+}
+
+// The process is up
+func (fp *ForwardProxy) adminHealth(w http.ResponseWriter, r *http.Request) {
+	writeAdminJson(w, http.StatusOK, adminStatus{Status: "ok", Sessions: fp.sessions.Len()})
+}
+
+// The proxy takes new visitors and tunnels, not the case while draining
+func (fp *ForwardProxy) adminReady(w http.ResponseWriter, r *http.Request) {
+	if !fp.Runing() {
+		writeAdminJson(w, http.StatusServiceUnavailable, adminStatus{Status: "draining", Sessions: fp.sessions.Len()})
+		return
+	}
+	writeAdminJson(w, http.StatusOK, adminStatus{Status: "ready", Sessions: fp.sessions.Len()})
+}
+
+func (fp *ForwardProxy) adminSessions(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	sessions := []SessionInfo{}
+	for _, session := range fp.sessions.Sessions() {
+		sessions = append(sessions, session.Info())
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Key < sessions[j].Key })
+	writeAdminJson(w, http.StatusOK, sessions)
+}
+
+// Show or kick a single session
+func (fp *ForwardProxy) adminSession(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/sessions/")
+	if r.Method == http.MethodDelete {
+		session := fp.sessions.Delete(key)
+		if session == nil {
+			writeAdminError(w, http.StatusNotFound, ErrSessionNotFound)
+			return
+		}
+		fp.Logger.Info("Kicked through the admin API", "request", "DELETE", "session", key)
+		writeAdminJson(w, http.StatusOK, session.Info())
+		return
+	}
+	session := fp.sessions.Get(key)
+	if session == nil {
+		writeAdminError(w, http.StatusNotFound, ErrSessionNotFound)
+		return
+	}
+	writeAdminJson(w, http.StatusOK, session.Info())
+}
+
+// List or create tokens, only tokens the proxy stores itself can be managed
+func (fp *ForwardProxy) adminTokens(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if !fp.Uima {
+		writeAdminError(w, http.StatusConflict, ErrProxyNotInUimaMode)
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeAdminJson(w, http.StatusOK, fp.listKeys())
+		return
+	}
+
+	generate := headers.GenerateKeyRequest{}
+	err := json.NewDecoder(io.LimitReader(r.Body, adminApiMaxBodySize)).Decode(&generate)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	generated, err := fp.generateKey(generate)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+	fp.Logger.Info("Generated key through the admin API", "request", "GENERATE", "id", generated.ID)
+	writeAdminJson(w, http.StatusCreated, generated)
+}
+
+func (fp *ForwardProxy) adminToken(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodDelete) {
+		return
+	}
+	if !fp.Uima {
+		writeAdminError(w, http.StatusConflict, ErrProxyNotInUimaMode)
+		return
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/tokens/"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, ErrProxyKeyNotFound)
+		return
+	}
+	key, err := fp.revokeKey(id)
+	if errors.Is(err, ErrProxyKeyNotFound) {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fp.Logger.Info("Revoked key through the admin API", "request", "REVOKE", "id", id)
+	writeAdminJson(w, http.StatusOK, headers.RevokeKeyResponse{ID: id, Key: maskToken(key)})
+}
+
+// Close the admin API listener, requests which are running are cut off
+func (fp *ForwardProxy) stopAdminApi() {
+	if fp.adminApi != nil {
+		fp.adminApi.Close()
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/auth"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+)
+
+func newTestAdminApi() *ForwardProxy {
+	fp := newTestForwardProxy()
+	fp.AdminApi = &AdminApiConfig{Token: "admin-token"}
+	fp.auth = auth.NewInMemorySession(nil)
+	fp.running = true
+	return fp
+}
+
+func adminRequest(fp *ForwardProxy, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	fp.adminApiHandler().ServeHTTP(recorder, request)
+	return recorder
+}
+
+// Everything but the health checks needs the bearer token or a verified
+// client certificate
+func TestAdminApiAuth(t *testing.T) {
+	client := newTestCertificate(t, "admin", nil)
+	tests := []struct {
+		name   string
+		path   string
+		token  string
+		tls    *tls.ConnectionState
+		status int
+	}{
+		{"health without credentials", "/health", "", nil, http.StatusOK},
+		{"ready without credentials", "/ready", "", nil, http.StatusOK},
+		{"without credentials", "/sessions", "", nil, http.StatusUnauthorized},
+		{"wrong token", "/sessions", "other-token", nil, http.StatusUnauthorized},
+		{"bearer token", "/sessions", "admin-token", nil, http.StatusOK},
+		{"verified certificate", "/sessions", "", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{client.certificate}}}, http.StatusOK},
+		{"unverified certificate", "/sessions", "", &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client.certificate}}, http.StatusUnauthorized},
+		{"metrics", "/metrics", "admin-token", nil, http.StatusOK},
+		{"metrics without credentials", "/metrics", "", nil, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		fp := newTestAdminApi()
+		request := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.token != "" {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		request.TLS = test.tls
+		recorder := httptest.NewRecorder()
+		fp.adminApiHandler().ServeHTTP(recorder, request)
+		if recorder.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, recorder.Code, test.status)
+		}
+		if unauthorized := test.status == http.StatusUnauthorized; unauthorized != (recorder.Header().Get("WWW-Authenticate") == "Bearer") {
+			t.Errorf("%s: WWW-Authenticate %q", test.name, recorder.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+// Client certificates are checked against the client CA on a real handshake,
+// a certificate from another CA is not let through
+func TestAdminApiClientCertificate(t *testing.T) {
+	ca := newTestCertificate(t, "", nil)
+	server := newTestCertificate(t, "admin.test", nil)
+	fp := newTestAdminApi()
+	fp.AdminApi.Token = ""
+	fp.AdminApi.CertFile, fp.AdminApi.KeyFile = server.writeKeyPair(t)
+	fp.AdminApi.ClientCAFile = ca.writePem(t)
+	config, err := fp.adminApiTlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &http.Server{Handler: fp.adminApiHandler()}
+	go api.Serve(ln)
+	defer api.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.certificate)
+	tests := []struct {
+		name   string
+		client *testCertificate
+		status int
+	}{
+		{"signed by the client CA", newTestCertificate(t, "admin", ca), http.StatusOK},
+		{"without certificate", nil, http.StatusUnauthorized},
+		{"signed by another CA", newTestCertificate(t, "admin", nil), http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		clientConfig := &tls.Config{RootCAs: roots, ServerName: "admin.test"}
+		if test.client != nil {
+			clientConfig.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{test.client.certificate.Raw},
+				PrivateKey:  test.client.key,
+			}}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}, Timeout: 5 * time.Second}
+		response, err := client.Get("https://" + ln.Addr().String() + "/sessions")
+		status := 0
+		if err == nil {
+			status = response.StatusCode
+			response.Body.Close()
+		}
+		if status != test.status {
+			t.Errorf("%s: status %d with error %v, want %d", test.name, status, err, test.status)
+		}
+	}
+}
+
+func TestAdminApiSessions(t *testing.T) {
+	fp := newTestAdminApi()
+	fp.sessions.Add(NewSession("web", testLogger, 0, time.Second))
+	fp.sessions.Add(NewSession("api", testLogger, 0, time.Second))
+
+	response := adminRequest(fp, http.MethodGet, "/sessions", "", "admin-token")
+	sessions := []SessionInfo{}
+	json.NewDecoder(response.Body).Decode(&sessions)
+	if response.Code != http.StatusOK || len(sessions) != 2 || sessions[0].Key != "api" || sessions[1].Key != "web" {
+		t.Fatalf("sessions %d %+v", response.Code, sessions)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/sessions/web", http.StatusOK},
+		{http.MethodGet, "/sessions/missing", http.StatusNotFound},
+		{http.MethodPost, "/sessions/web", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/sessions/web", http.StatusOK},
+		{http.MethodDelete, "/sessions/web", http.StatusNotFound},
+		{http.MethodGet, "/sessions/web", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if response := adminRequest(fp, test.method, test.path, "", "admin-token"); response.Code != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, response.Code, test.status)
+		}
+	}
+	if fp.sessions.Lookup("api") == nil {
+		t.Error("kicking a session closed another one")
+	}
+}
+
+// Tokens are created, listed and revoked through the API, only when the
+// proxy stores them itself
+func TestAdminApiTokens(t *testing.T) {
+	fp := newTestAdminApi()
+	if response := adminRequest(fp, http.MethodGet, "/tokens", "", "admin-token"); response.Code != http.StatusConflict {
+		t.Errorf("tokens without uima: status %d, want %d", response.Code, http.StatusConflict)
+	}
+	fp.Uima = true
+
+	response := adminRequest(fp, http.MethodPost, "/tokens", `{"label": "ci", "allow_tcp": true}`, "admin-token")
+	generated := headers.GenerateKeyResponse{}
+	json.NewDecoder(response.Body).Decode(&generated)
+	if response.Code != http.StatusCreated || generated.Key == "" {
+		t.Fatalf("create token: status %d %+v", response.Code, generated)
+	}
+	if info, ok := fp.auth.Token(generated.Key); !ok || info.Label != "ci" || !info.AllowTcp {
+		t.Errorf("created token %+v valid %v", info, ok)
+	}
+
+	response = adminRequest(fp, http.MethodGet, "/tokens", "", "admin-token")
+	keys := []headers.KeyInfo{}
+	json.NewDecoder(response.Body).Decode(&keys)
+	if response.Code != http.StatusOK || len(keys) != 1 || keys[0].ID != generated.ID || keys[0].Key == generated.Key {
+		t.Errorf("list tokens: status %d %+v", response.Code, keys)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/tokens", "{", http.StatusBadRequest},
+		{http.MethodPut, "/tokens", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/tokens/invalid", "", http.StatusBadRequest},
+		{http.MethodDelete, "/tokens/12345", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		if response := adminRequest(fp, test.method, test.path, test.body, "admin-token"); response.Code != test.status {
+			t.Errorf("%s %s: status %d, want %d", test.method, test.path, response.Code, test.status)
+		}
+	}
+
+	path := "/tokens/" + strconv.Itoa(generated.ID)
+	if response := adminRequest(fp, http.MethodDelete, path, "", "admin-token"); response.Code != http.StatusOK {
+		t.Errorf("revoke token: status %d", response.Code)
+	}
+	if _, ok := fp.auth.Token(generated.Key); ok {
+		t.Error("revoked token is still valid")
+	}
+}
+
+// Readiness fails while the proxy drains so load balancers move on
+func TestAdminApiReady(t *testing.T) {
+	fp := newTestAdminApi()
+	fp.running = false
+	response := adminRequest(fp, http.MethodGet, "/ready", "", "")
+	status := adminStatus{}
+	json.NewDecoder(response.Body).Decode(&status)
+	if response.Code != http.StatusServiceUnavailable || status.Status != "draining" {
+		t.Errorf("ready while draining: status %d %+v", response.Code, status)
+	}
+}
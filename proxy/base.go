@@ -2,11 +2,33 @@ package proxy
 
 import (
 	"strconv"
+	"time"
 )
 
 const MaxConnectionPoolSize int = 5
 const HttpRequestPipeChunkSize int = 64
 
+// Visitor requests waiting for a free pool connection
+const DefaultQueueSize int = 32
+const DefaultQueueTimeout time.Duration = 10 * time.Second
+
+// Time a client has to resume its session after losing the control
+// connection, visitors are told to retry after OfflineRetryAfter meanwhile
+const DefaultResumeGrace time.Duration = 30 * time.Second
+const OfflineRetryAfter time.Duration = 5 * time.Second
+
+// Idle connections are pinged every interval and dropped if the pong does
+// not arrive within the timeout
+const DefaultHeartbeatInterval time.Duration = 15 * time.Second
+const DefaultHeartbeatTimeout time.Duration = 5 * time.Second
+
+// Time requests in flight get to finish when the proxy shuts down
+const DefaultDrainTimeout time.Duration = 30 * time.Second
+
+// Bounds of the delay between attempts to reconnect to the proxy
+const ReconnectBackoffMin time.Duration = 500 * time.Millisecond
+const ReconnectBackoffMax time.Duration = 30 * time.Second
+
 type Addr struct {
 	Host string
 	Port int
@@ -0,0 +1,421 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/angrybayblade/tunnel/auth"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/google/uuid"
+)
+
+const DomainVerifyInterval time.Duration = 30 * time.Second
+const DomainVerifyTimeout time.Duration = 5 * time.Second
+
+// Domains which are not verified within this time are dropped
+const DomainChallengeTTL time.Duration = 24 * time.Hour
+
+// TXT records are looked up on this label in front of the domain
+const DomainChallengeLabel string = "_tunnel-challenge"
+
+// Domain is a hostname outside of the proxy's wildcard domain which points
+// at a tunnel subdomain, usually through a CNAME
+type Domain struct {
+	Name      string    `json:"name"`
+	Subdomain string    `json:"subdomain"`
+	Owner     string    `json:"owner"`
+	Challenge string    `json:"challenge"`
+	Verified  bool      `json:"verified"`
+	Created   time.Time `json:"created"`
+}
+
+// DomainRegistry maps custom hostnames to tunnel subdomains, domains are
+// only routed once their owner proved control over them. The registry is
+// written to a JSON file if a path is set.
+type DomainRegistry struct {
+	path    string
+	domains map[string]*Domain
+	mut     sync.RWMutex
+}
+
+func LoadDomainRegistry(path string) (*DomainRegistry, error) {
+	dr := &DomainRegistry{
+		path:    path,
+		domains: make(map[string]*Domain),
+	}
+	if path == "" {
+		return dr, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return dr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	domains := []*Domain{}
+	err = json.Unmarshal(data, &domains)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading %s: %w", path, err)
+	}
+	for _, domain := range domains {
+		dr.domains[domain.Name] = domain
+	}
+	return dr, nil
+}
+
+// Write the registry to its file, the caller holds the lock
+func (dr *DomainRegistry) save() error {
+	if dr.path == "" {
+		return nil
+	}
+	domains := make([]*Domain, 0, len(dr.domains))
+	for _, domain := range dr.domains {
+		domains = append(domains, domain)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Name < domains[j].Name })
+	data, err := json.MarshalIndent(domains, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dr.path), filepath.Base(dr.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(tmp.Name(), dr.path)
+}
+
+// Copy of the domain registered with the name
+func (dr *DomainRegistry) Get(name string) (Domain, bool) {
+	dr.mut.RLock()
+	defer dr.mut.RUnlock()
+	domain, ok := dr.domains[name]
+	if !ok {
+		return Domain{}, false
+	}
+	return *domain, true
+}
+
+// Verified domain the host routes to
+func (dr *DomainRegistry) Route(host string) (Domain, bool) {
+	domain, ok := dr.Get(host)
+	if !ok || !domain.Verified {
+		return Domain{}, false
+	}
+	return domain, true
+}
+
+// Register a domain for the owner or point it at another subdomain, a new
+// domain gets a challenge it has to be verified with
+func (dr *DomainRegistry) Add(name string, subdomain string, owner string) (Domain, error) {
+	dr.mut.Lock()
+	defer dr.mut.Unlock()
+	domain, ok := dr.domains[name]
+	if ok && domain.Owner != owner {
+		return Domain{}, ErrProxyDomainTaken
+	}
+	previous := Domain{}
+	if ok {
+		previous = *domain
+		domain.Subdomain = subdomain
+	} else {
+		domain = &Domain{
+			Name:      name,
+			Subdomain: subdomain,
+			Owner:     owner,
+			Challenge: strings.ReplaceAll(uuid.New().String(), "-", ""),
+			Created:   time.Now().UTC().Truncate(time.Second),
+		}
+		dr.domains[name] = domain
+	}
+	err := dr.save()
+	if err != nil {
+		if ok {
+			*domain = previous
+		} else {
+			delete(dr.domains, name)
+		}
+		return Domain{}, err
+	}
+	return *domain, nil
+}
+
+func (dr *DomainRegistry) Remove(name string, owner string) error {
+	dr.mut.Lock()
+	defer dr.mut.Unlock()
+	domain, ok := dr.domains[name]
+	if !ok {
+		return ErrProxyDomainNotFound
+	}
+	if domain.Owner != owner {
+		return ErrProxyDomainTaken
+	}
+	delete(dr.domains, name)
+	err := dr.save()
+	if err != nil {
+		dr.domains[name] = domain
+	}
+	return err
+}
+
+func (dr *DomainRegistry) setVerified(name string, challenge string) error {
+	dr.mut.Lock()
+	defer dr.mut.Unlock()
+	domain, ok := dr.domains[name]
+	// The domain could have been removed and added again meanwhile
+	if !ok || domain.Challenge != challenge {
+		return ErrProxyDomainNotFound
+	}
+	domain.Verified = true
+	err := dr.save()
+	if err != nil {
+		domain.Verified = false
+	}
+	return err
+}
+
+// Drop domains which were not verified in time, returns their names
+func (dr *DomainRegistry) expire(now time.Time) []string {
+	dr.mut.Lock()
+	defer dr.mut.Unlock()
+	expired := []string{}
+	for name, domain := range dr.domains {
+		if !domain.Verified && now.Sub(domain.Created) > DomainChallengeTTL {
+			delete(dr.domains, name)
+			expired = append(expired, name)
+		}
+	}
+	if len(expired) > 0 {
+		dr.save()
+	}
+	return expired
+}
+
+func (dr *DomainRegistry) pending() []Domain {
+	dr.mut.RLock()
+	defer dr.mut.RUnlock()
+	pending := []Domain{}
+	for _, domain := range dr.domains {
+		if !domain.Verified {
+			pending = append(pending, *domain)
+		}
+	}
+	return pending
+}
+
+// Whether the hostname is a plausible domain name, the proxy never resolves
+// names it did not check. IP addresses are not, top level domains are never
+// all digits.
+func isDomainName(name string) bool {
+	if len(name) > 253 || !strings.Contains(name, ".") || net.ParseIP(name) != nil {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	for _, label := range labels {
+		if !isDnsLabel(label) {
+			return false
+		}
+	}
+	return !isDigits(labels[len(labels)-1])
+}
+
+func isDigits(label string) bool {
+	for _, c := range label {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the address belongs to the host or a private network
+func isInternalIp(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// Check a domain before it is registered. Names under the base domain
+// belong to the tunnels of the proxy, names which resolve to internal
+// addresses are no public domains. Names which don't resolve yet are fine,
+// the CNAME usually comes after the registration.
+func (fp *ForwardProxy) checkDomainName(name string) error {
+	if !isDomainName(name) {
+		return fmt.Errorf("%w; %s", ErrProxyInvalidDomain, name)
+	}
+	if fp.BaseDomain != "" && (name == fp.BaseDomain || strings.HasSuffix(name, "."+fp.BaseDomain)) {
+		return fmt.Errorf("%w; %s", ErrProxyDomainUnderBase, fp.BaseDomain)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DomainVerifyTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if isInternalIp(addr.IP) {
+			return fmt.Errorf("%w; %s resolves to %s", ErrProxyDomainInternal, name, addr.IP)
+		}
+	}
+	return nil
+}
+
+// Whether the owner of the domain proved control over it with a TXT record
+// holding the challenge. Nothing the proxy serves itself counts, every host
+// which points at the proxy would pass.
+func (fp *ForwardProxy) verifyDomain(domain Domain) bool {
+	if fp.checkDomainName(domain.Name) != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DomainVerifyTimeout)
+	defer cancel()
+	records, err := net.DefaultResolver.LookupTXT(ctx, DomainChallengeLabel+"."+domain.Name)
+	if err != nil {
+		return false
+	}
+	for _, record := range records {
+		if strings.TrimSpace(record) == domain.Challenge {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify the domain now and record the result, returns whether it is
+// verified
+func (fp *ForwardProxy) checkDomain(domain Domain) bool {
+	if domain.Verified {
+		return true
+	}
+	if !fp.verifyDomain(domain) {
+		return false
+	}
+	err := fp.domains.setVerified(domain.Name, domain.Challenge)
+	if err != nil {
+		fp.Logger.Error("Error storing verification", "request", "DOMAIN", "domain", domain.Name, "error", err)
+		return false
+	}
+	fp.Logger.Info("Verified domain", "request", "DOMAIN", "domain", domain.Name, "subdomain", domain.Subdomain)
+	return true
+}
+
+func (fp *ForwardProxy) watchDomains() {
+	ticker := time.NewTicker(DomainVerifyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, name := range fp.domains.expire(time.Now()) {
+				fp.Logger.Info("Dropped domain, not verified in time", "request", "DOMAIN", "domain", name)
+			}
+			for _, domain := range fp.domains.pending() {
+				fp.checkDomain(domain)
+			}
+		case <-fp.stopch:
+			return
+		}
+	}
+}
+
+// Register a custom domain for the tunnels of a token, the token has to be
+// allowed to use the subdomain the domain points at
+func (fp *ForwardProxy) handleDomain(request *headers.ProxyFrame, conn net.Conn) {
+	defer conn.Close()
+	domainRequest := headers.DomainRequest{}
+	err := request.Decode(&domainRequest)
+	if err != nil {
+		request.Response(headers.ResponseInvalidRequest, "", headers.MarshalError(err)).Write(conn)
+		fp.Logger.Warn("Invalid request", "request", "DOMAIN", "error", err)
+		return
+	}
+	name := strings.TrimSuffix(strings.ToLower(domainRequest.Domain), ".")
+
+	var info auth.TokenInfo
+	var owner string
+	identity := clientIdentity(conn)
+	if identity != "" {
+		owner = "cert:" + identity
+	} else {
+		var valid bool
+		info, valid = fp.auth.Token(request.Key)
+		if !valid {
+			fp.authFailures.Add(1, authFailureToken)
+			request.Response(headers.ResponseAuthError, "", headers.MarshalError(ErrProxyAuth)).Write(conn)
+			fp.Logger.Warn("Invalid token", "request", "DOMAIN", "token", maskToken(request.Key), "remote", conn.RemoteAddr().String())
+			return
+		}
+		owner = tokenOwner(&info)
+	}
+
+	if domainRequest.Remove {
+		err = fp.domains.Remove(name, owner)
+		if err != nil {
+			request.Response(headers.ResponseForbidden, "", headers.MarshalError(err)).Write(conn)
+			fp.Logger.Warn("Domain not removed", "request", "DOMAIN", "domain", name, "error", err)
+			return
+		}
+		request.Response(headers.ResponseSuccess, "", headers.MarshalPayload(headers.DomainResponse{Domain: name})).Write(conn)
+		fp.Logger.Info("Removed domain", "request", "DOMAIN", "domain", name)
+		return
+	}
+
+	subdomain := domainRequest.Subdomain
+	if subdomain == "" && len(info.Reserved) > 0 {
+		subdomain = info.Reserved[0]
+	}
+	err = fp.checkDomainName(name)
+	if err == nil {
+		if subdomain == "" {
+			err = ErrProxyDomainNeedsSubdomain
+		} else if !isDnsLabel(subdomain) {
+			err = ErrProxyInvalidSubdomain
+		} else if !info.AllowsSubdomain(subdomain) {
+			err = fmt.Errorf("%w; subdomain %s is not allowed", ErrProxyTokenScope, subdomain)
+		} else if id, reserved := fp.reservedBy(subdomain); reserved && !info.Reserves(subdomain) {
+			err = fmt.Errorf("%w; %s is reserved for key %d", ErrProxySubdomainReserved, subdomain, id)
+		}
+	}
+	if err != nil {
+		request.Response(headers.ResponseForbidden, "", headers.MarshalError(err)).Write(conn)
+		fp.Logger.Warn("Forbidden", "request", "DOMAIN", "domain", name, "error", err)
+		return
+	}
+
+	domain, err := fp.domains.Add(name, subdomain, owner)
+	if err != nil {
+		request.Response(headers.ResponseForbidden, "", headers.MarshalError(err)).Write(conn)
+		fp.Logger.Warn("Domain not added", "request", "DOMAIN", "domain", name, "error", err)
+		return
+	}
+	verified := fp.checkDomain(domain)
+	response := headers.DomainResponse{
+		Domain:    domain.Name,
+		Subdomain: domain.Subdomain,
+		Verified:  verified,
+		Challenge: domain.Challenge,
+		TxtRecord: DomainChallengeLabel + "." + domain.Name,
+	}
+	request.Response(headers.ResponseSuccess, "", headers.MarshalPayload(response)).Write(conn)
+	if !verified {
+		fp.Logger.Info("Waiting for verification", "request", "DOMAIN", "domain", name)
+	}
+}
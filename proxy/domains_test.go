@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestIsDomainName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"preview.customer.com", true},
+		{"a-b.c0.io", true},
+		{"customer", false},
+		{"127.0.0.1", false},
+		{"10.0.0.1", false},
+		{"::1", false},
+		{"0x7f.1", false},
+		{"foo.123", false},
+		{"-foo.com", false},
+		{"foo..com", false},
+		{"Foo.com", false},
+	}
+	for _, test := range tests {
+		if valid := isDomainName(test.name); valid != test.valid {
+			t.Errorf("isDomainName(%q) = %v, want %v", test.name, valid, test.valid)
+		}
+	}
+}
+
+func TestCheckDomainNameBaseDomain(t *testing.T) {
+	fp := &ForwardProxy{BaseDomain: "tunnel.test"}
+	tests := []struct {
+		name string
+		err  error
+	}{
+		{"tunnel.test", ErrProxyDomainUnderBase},
+		{"victim.tunnel.test", ErrProxyDomainUnderBase},
+		{"a.victim.tunnel.test", ErrProxyDomainUnderBase},
+		{"127.0.0.1", ErrProxyInvalidDomain},
+	}
+	for _, test := range tests {
+		if err := fp.checkDomainName(test.name); !errors.Is(err, test.err) {
+			t.Errorf("checkDomainName(%q) = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestIsInternalIp(t *testing.T) {
+	tests := []struct {
+		ip       string
+		internal bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"93.184.216.34", false},
+		{"2606:2800:220:1::1", false},
+	}
+	for _, test := range tests {
+		if internal := isInternalIp(net.ParseIP(test.ip)); internal != test.internal {
+			t.Errorf("isInternalIp(%s) = %v, want %v", test.ip, internal, test.internal)
+		}
+	}
+}
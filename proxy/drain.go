@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// Names of the listeners a proxy can hand over to a new process
+const ListenerHttp string = "http"
+const ListenerHttps string = "https"
+
+// How often a drain checks whether the requests in flight are done
+const drainPollInterval time.Duration = 100 * time.Millisecond
+
+// Listen on the address, or take over the listener a previous process
+// handed over under the name
+func (fp *ForwardProxy) listen(name string, addr string) (net.Listener, error) {
+	ln, ok := fp.Inherited[name]
+	if ok {
+		delete(fp.Inherited, name)
+		fp.Logger.Info("Took over the listener", "listener", name, "addr", ln.Addr().String())
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Duplicates of the listening sockets by name, for a new process to take
+// over. The caller closes the files.
+func (fp *ForwardProxy) ListenerFiles() (map[string]*os.File, error) {
+	listeners := map[string]net.Listener{ListenerHttp: fp.Ln}
+	if fp.tlsTcpLn != nil {
+		listeners[ListenerHttps] = fp.tlsTcpLn
+	}
+	if fp.adminApiLn != nil {
+		listeners[ListenerAdminApi] = fp.adminApiLn
+	}
+	if fp.metricsLn != nil {
+		listeners[ListenerMetrics] = fp.metricsLn
+	}
+	files := make(map[string]*os.File, len(listeners))
+	for name, ln := range listeners {
+		tcpLn, ok := ln.(*net.TCPListener)
+		if !ok {
+			return files, ErrListenerNotTcp
+		}
+		file, err := tcpLn.File()
+		if err != nil {
+			return files, err
+		}
+		files[name] = file
+	}
+	return files, nil
+}
+
+// Count a visitor request or connection as in flight until done is called
+func (fp *ForwardProxy) track() (done func()) {
+	fp.inflight.Add(1)
+	return func() {
+		fp.inflight.Add(-1)
+	}
+}
+
+// Stop taking new visitors and tunnels and ask the clients to reconnect,
+// requests in flight get until the timeout to finish before every session
+// is closed
+func (fp *ForwardProxy) Drain(timeout time.Duration) {
+	fp.mut.Lock()
+	fp.running = false
+	fp.mut.Unlock()
+	fp.Ln.Close()
+	if fp.TlsLn != nil {
+		fp.TlsLn.Close()
+	}
+
+	for _, session := range fp.sessions.Sessions() {
+		session.GoAway()
+	}
+
+	deadline := time.Now().Add(timeout)
+	inflight := fp.inflight.Load()
+	if inflight > 0 {
+		fp.Logger.Info("Draining requests in flight", "inflight", inflight)
+	}
+	for inflight > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+		inflight = fp.inflight.Load()
+	}
+	if inflight > 0 {
+		fp.Logger.Warn("Drain timed out, requests cut off", "inflight", inflight)
+	}
+	fp.Stop()
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestDrainProxy(t *testing.T) *ForwardProxy {
+	fp := newTestForwardProxy()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Ln = ln
+	fp.running = true
+	fp.stopch = make(chan struct{})
+	return fp
+}
+
+// Draining stops taking visitors right away and waits for the requests in
+// flight, up to the timeout
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		finish   bool
+		duration time.Duration
+	}{
+		{"requests finish", 5 * time.Second, true, 200 * time.Millisecond},
+		{"timeout", 200 * time.Millisecond, false, 200 * time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fp := newTestDrainProxy(t)
+			session := NewSession("web", testLogger, 0, time.Second)
+			fp.sessions.Add(session)
+			done := fp.track()
+
+			start := time.Now()
+			drained := make(chan struct{})
+			go func() {
+				fp.Drain(test.timeout)
+				close(drained)
+			}()
+			time.Sleep(test.duration / 2)
+			if _, err := fp.Ln.Accept(); !errors.Is(err, net.ErrClosed) {
+				t.Errorf("listener accepted with error %v while draining", err)
+			}
+			select {
+			case <-drained:
+				t.Fatal("drain returned with a request in flight")
+			default:
+			}
+			if session.State() != SessionActive {
+				t.Errorf("session %s before the requests in flight finished", session.State())
+			}
+
+			if test.finish {
+				time.Sleep(test.duration / 2)
+				done()
+			}
+			select {
+			case <-drained:
+			case <-time.After(5 * time.Second):
+				t.Fatal("drain did not return")
+			}
+			if elapsed := time.Since(start); elapsed < test.duration {
+				t.Errorf("drain returned after %s, want at least %s", elapsed, test.duration)
+			}
+			if session.State() != SessionClosed || fp.sessions.Len() != 0 {
+				t.Errorf("session %s after the drain", session.State())
+			}
+		})
+	}
+}
@@ -3,5 +3,46 @@ package proxy
 import "errors"
 
 var ErrForwardFailedNoFreeConnection = errors.New("Forwarding connection failed, no free connection available")
+var ErrForwardFailedQueueFull = errors.New("Forwarding connection failed, request queue is full")
+var ErrForwardFailedQueueTimeout = errors.New("Forwarding connection failed, timed out waiting for a free connection")
+var ErrUnexpectedUpgrade = errors.New("Switching protocols response to a request which did not ask for an upgrade")
+var ErrUnexpectedHeartbeat = errors.New("Unexpected frame on an idle pooled connection")
+var ErrSessionNotMultiplexed = errors.New("Session does not have a multiplexed control connection")
+var ErrNoFreePort = errors.New("No free port available")
+var ErrUnknownAccessLogFormat = errors.New("Access log format should be common, combined or json")
+var ErrListenerNotTcp = errors.New("Only TCP listeners can be handed over")
+var ErrProxyUnknownProtocol = errors.New("Unknown tunnel protocol")
+var ErrProxyTcpDisabled = errors.New("TCP tunnels are not enabled on this proxy")
+var ErrProxyUdpDisabled = errors.New("UDP tunnels are not enabled on this proxy")
+var ErrNoCertificateSource = errors.New("TLS needs a certificate file or ACME")
+var ErrAcmeNeedsBaseDomain = errors.New("ACME needs the domain the tunnels are served under")
+var ErrInvalidCertificatePin = errors.New("Certificate pin should look like sha256/<base64>")
+var ErrCertificatePinMismatch = errors.New("Proxy certificate does not match the pin")
+var ErrProxyControlTlsRequired = errors.New("Control requests need to be sent over TLS")
+var ErrProxyAuthModeConflict = errors.New("Only one of UIMA, JWT and webhook authentication can be used")
+var ErrProxyForbidden = errors.New("Tunnel is not allowed by the proxy")
+var ErrProxyTokenScope = errors.New("Token is not allowed to open this tunnel")
+var ErrProxyMaxSessionsReached = errors.New("Token has reached its max number of sessions")
+var ErrProxySubdomainInUse = errors.New("Subdomain is in use by another token")
+var ErrProxySubdomainReserved = errors.New("Subdomain is reserved for another token")
+var ErrProxyInvalidSubdomain = errors.New("Subdomain has to be a DNS label; lowercase letters, digits and dashes")
+var ErrProxyInvalidDomain = errors.New("Not a valid domain name")
+var ErrProxyDomainTaken = errors.New("Domain is registered by another token")
+var ErrProxyDomainNotFound = errors.New("Domain is not registered")
+var ErrProxyDomainUnderBase = errors.New("Domain is under the base domain of the proxy")
+var ErrProxyDomainInternal = errors.New("Domain resolves to an internal address")
+var ErrProxyDomainNeedsSubdomain = errors.New("Domain needs a subdomain to point at")
+var ErrDatagramTooLarge = errors.New("Datagram too large")
+var ErrProxyProtocolNeedsMultiplex = errors.New("Tunnel protocol requires a multiplexed control connection")
+var ErrSessionClosed = errors.New("Session is closed")
+var ErrSessionNotFound = errors.New("No session found")
+var ErrAdminApiNeedsAuth = errors.New("Admin API needs a token or a client CA")
+var ErrAdminApiClientCaNeedsTls = errors.New("Admin API client certificates need a TLS certificate for the API")
+var ErrAdminApiUnauthorized = errors.New("Admin API needs a valid token or client certificate")
 var ErrProxyAuth = errors.New("Authentication error while connecting to the proxy")
 var ErrProxyInvalidSessionKey = errors.New("Invalid session key")
+var ErrProxyNotInUimaMode = errors.New("Proxy not running in the UIMA mode")
+var ErrProxyInvalidSigningKey = errors.New("Invalid signing key")
+var ErrProxyKeyLimitReached = errors.New("Max number of keys have been created, cannot create more")
+var ErrProxyKeyNotFound = errors.New("Key was not found")
+var ErrProxyMaxConnectionsLimitReached = errors.New("Max connections limit reached")
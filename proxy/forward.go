@@ -1,156 +1,367 @@
 package proxy
 
 import (
-	"encoding/binary"
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
-	"math"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/angrybayblade/tunnel/auth"
 	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/metrics"
+	"github.com/angrybayblade/tunnel/proxy/mux"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type Connection struct {
 	free bool
 	conn net.Conn
+	// The client answers pings while the connection is idle
+	heartbeat bool
 }
 
-func (c *Connection) Forward(requestHeader *headers.HttpRequestHeader, requestConn net.Conn) {
-	var pumpBytes []byte
-	requestHeader.Write(c.conn)
-	if requestHeader.Headers["Content-Length"] != "" {
-		contenLength, _ := strconv.Atoi(requestHeader.Headers["Content-Length"])
-		if contenLength <= HttpRequestPipeChunkSize {
-			pumpBytes = make([]byte, contenLength)
-			requestConn.Read(pumpBytes)
-			c.conn.Write(pumpBytes)
-		} else {
-			iter := int(math.Floor(float64(contenLength) / float64(HttpRequestPipeChunkSize)))
-			pumpBytes = make([]byte, HttpRequestPipeChunkSize)
-			for i := 0; i < iter; i++ {
-				requestConn.Read(pumpBytes)
-				c.conn.Write(pumpBytes)
-			}
-			pumpBytes = make([]byte, contenLength%HttpRequestPipeChunkSize)
-			requestConn.Read(pumpBytes)
-			c.conn.Write(pumpBytes)
-		}
+// Ping an idle pooled connection and wait for the pong
+func (c *Connection) Ping(timeout time.Duration) error {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	ping := &headers.ProxyFrame{
+		Version: headers.ProxyHeaderV2,
+		Code:    headers.RequestPing,
 	}
-
-	pumpBytes = make([]byte, HttpRequestPipeChunkSize)
-	for {
-		n, err := c.conn.Read(pumpBytes)
-		if err != nil {
-			break
-		}
-		requestConn.Write(pumpBytes[:n])
+	_, err := ping.Write(c.conn)
+	if err != nil {
+		return err
 	}
-	requestConn.Close()
-	c.conn.Close()
-}
-
-type Session struct {
-	key         string
-	connections map[string]*Connection
-	free        []string
-	inUse       []string
-	connected   int
-	logger      *log.Logger
-}
-
-func (s *Session) Join(id string, conn net.Conn) {
-	s.connections[id] = &Connection{
-		free: true,
-		conn: conn,
+	pong := &headers.ProxyFrame{}
+	err = pong.Read(c.conn)
+	if err != nil {
+		return err
 	}
-	s.free = append(s.free, id)
-	s.connected += 1
-}
-
-func (s *Session) Disconnect() {
-	for id, connection := range s.connections {
-		s.logger.Println("/DELETE", s.key, "-> Connection ID:", id)
-		connection.conn.Close()
+	if pong.Code != headers.ResponsePong {
+		return fmt.Errorf("%w; got %s", ErrUnexpectedHeartbeat, pong.Code)
 	}
+	return nil
 }
 
-func (s *Session) Forward(requestHeader *headers.HttpRequestHeader, rquestConn net.Conn) error {
-	if s.connected <= 0 {
-		defer rquestConn.Close()
-		_, err := headers.HttpResponseNoFreeConnection.Write(rquestConn)
-		if err != nil {
-			return fmt.Errorf("Request forward fail, no free connections available; Error writing response: %v", err)
-		}
-		return ErrForwardFailedNoFreeConnection
-	}
-	freeConnectionIndex := s.free[0]
-	s.free = s.free[1:]
-	s.inUse = append(s.inUse, freeConnectionIndex)
-	freeConnection := s.connections[freeConnectionIndex]
-	freeConnection.Forward(requestHeader, rquestConn)
-	delete(s.connections, freeConnectionIndex)
-	s.connected -= 1
-	return nil
+// Forward a single request, pooled connections and streams are not reused
+func (c *Connection) Forward(requestHeader *headers.HttpRequestHeader, visitor *bufio.Reader, visitorConn net.Conn) (*HttpExchange, error) {
+	defer c.conn.Close()
+	return forwardHttp(requestHeader, visitor, visitorConn, c.conn)
 }
 
 type ForwardProxy struct {
-	Addr            Addr
-	Logger          *log.Logger
-	Ln              net.Listener
-	Quitch          chan error
-	Uima            bool
-	sessions        map[string]*Session
-	requestHandlers map[string]interface{}
-	running         bool
-	auth            auth.AuthSession
-	mut             *sync.Mutex
-}
-
-func (fp *ForwardProxy) Setup() error {
-	Ln, err := net.Listen(
-		"tcp", fp.Addr.ToString(),
-	)
+	Addr           Addr
+	Logger         *slog.Logger
+	Ln             net.Listener
+	TlsLn          net.Listener
+	Tls            *TlsConfig
+	ControlTls     *ControlTlsConfig
+	Quitch         chan error
+	Uima           bool
+	QueueSize      int
+	QueueTimeout   time.Duration
+	TcpPortStart   int
+	TcpPortEnd     int
+	UdpPortStart   int
+	UdpPortEnd     int
+	UdpIdleTimeout time.Duration
+	AuthStore      string
+	AdminKeyFile   string
+	// Accept JWTs signed by the key in this file instead of issued tokens
+	JwtKeyFile string
+	// File with the IDs of revoked JWTs
+	JwtRevocationFile string
+	// File to keep custom domains in, they are kept in memory if not set
+	DomainStore string
+	// Domain the tunnel subdomains are served under, custom domains can't
+	// be registered under it
+	BaseDomain string
+	// How long a session waits for its client to reconnect, sessions are
+	// closed with their control connection if zero
+	ResumeGrace time.Duration
+	// Page visitors get while a tunnel is reconnecting
+	OfflinePage string
+	// Idle pooled connections and control connections are pinged every
+	// interval, no pings are sent if zero
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+	// Serve the JSON admin API if set
+	AdminApi *AdminApiConfig
+	// Log every visitor request if set
+	AccessLog *AccessLog
+	// Serve Prometheus metrics on /metrics at this address if set
+	Metrics *Addr
+	// Listeners handed over by a previous process by name, they are used
+	// instead of listening again
+	Inherited map[string]net.Listener
+	// Ask this URL whether a token may open a tunnel
+	AuthWebhook string
+	// How long webhook decisions are cached
+	AuthWebhookTTL       time.Duration
+	sessions             *SessionRegistry
+	requestHandlers      map[headers.ProxyCode]func(*headers.ProxyFrame, net.Conn)
+	running              bool
+	auth                 auth.AuthSession
+	keyPair              *auth.KeyPair
+	adminKeyFile         string
+	nonces               *auth.NonceCache
+	tcpPorts             *PortAllocator
+	udpPorts             *PortAllocator
+	certificates         *CertificateStore
+	controlCertificates  *CertificateStore
+	controlTlsConfig     *tls.Config
+	revocations          *auth.RevocationList
+	lastUse              map[string]time.Time
+	domains              *DomainRegistry
+	offlineResponse      headers.HttpResponseHeader
+	keysMut              sync.Mutex
+	acme                 *autocert.Manager
+	tlsTcpLn             net.Listener
+	adminApi             *http.Server
+	adminApiLn           net.Listener
+	adminApiCertificates *CertificateStore
+	metricsServer        *http.Server
+	metricsLn            net.Listener
+	failures             *metrics.CounterVec
+	authFailures         *metrics.CounterVec
+	inflight             atomic.Int64
+	stopch               chan struct{}
+	mut                  *sync.Mutex
+}
+
+func (fp *ForwardProxy) Setup() (err error) {
+	Ln, err := fp.listen(ListenerHttp, fp.Addr.ToString())
 	if err != nil {
 		return err
 	}
 
 	fp.Ln = Ln
 	fp.Quitch = make(chan error)
-	fp.sessions = make(map[string]*Session)
-	fp.requestHandlers = map[string]interface{}{
-		headers.ProxyRequestCreatePool:  fp.handleCreate,
-		headers.ProxyRequestJoinPool:    fp.handleJoin,
-		headers.ProxyRequestDeletePool:  fp.handleDelete,
-		headers.ProxyRequestGenerateKey: fp.handleGenerateKey,
-		headers.ProxyRequestRevokeKey:   fp.handleRevokeKey,
+	fp.stopch = make(chan struct{})
+	// Everything opened so far is closed again if the proxy can't start
+	defer func() {
+		if err != nil {
+			close(fp.stopch)
+			fp.Ln.Close()
+			if fp.TlsLn != nil {
+				fp.TlsLn.Close()
+			}
+			fp.stopAdminApi()
+			fp.stopMetrics()
+		}
+	}()
+	fp.sessions = NewSessionRegistry()
+	fp.requestHandlers = map[headers.ProxyCode]func(*headers.ProxyFrame, net.Conn){
+		headers.RequestCreatePool:  fp.handleCreate,
+		headers.RequestJoinPool:    fp.handleJoin,
+		headers.RequestDeletePool:  fp.handleDelete,
+		headers.RequestGenerateKey: fp.handleGenerateKey,
+		headers.RequestRevokeKey:   fp.handleRevokeKey,
+		headers.RequestListKeys:    fp.handleListKeys,
+		headers.RequestDomain:      fp.handleDomain,
 	}
 	fp.running = true
 	fp.mut = &sync.Mutex{}
-	if fp.Uima {
-		kp, err := auth.GenerateKeyPair()
+	fp.lastUse = make(map[string]time.Time)
+	fp.failures = metrics.NewCounterVec("reason")
+	fp.authFailures = metrics.NewCounterVec("kind")
+	if fp.QueueSize <= 0 {
+		fp.QueueSize = DefaultQueueSize
+	}
+	if fp.QueueTimeout <= 0 {
+		fp.QueueTimeout = DefaultQueueTimeout
+	}
+	if fp.HeartbeatTimeout <= 0 {
+		fp.HeartbeatTimeout = DefaultHeartbeatTimeout
+	}
+	if fp.HeartbeatInterval > 0 {
+		go fp.heartbeat()
+	}
+	fp.offlineResponse, err = makeOfflineResponse(fp.OfflinePage)
+	if err != nil {
+		return err
+	}
+	fp.domains, err = LoadDomainRegistry(fp.DomainStore)
+	if err != nil {
+		return err
+	}
+	go fp.watchDomains()
+	if fp.TcpPortStart > 0 {
+		fp.tcpPorts = NewPortAllocator(fp.TcpPortStart, fp.TcpPortEnd)
+		fp.Logger.Info("TCP tunnels enabled", "first_port", fp.TcpPortStart, "last_port", fp.TcpPortEnd)
+	}
+	if fp.UdpPortStart > 0 {
+		fp.udpPorts = NewPortAllocator(fp.UdpPortStart, fp.UdpPortEnd)
+		fp.Logger.Info("UDP tunnels enabled", "first_port", fp.UdpPortStart, "last_port", fp.UdpPortEnd)
+	}
+	if fp.UdpIdleTimeout <= 0 {
+		fp.UdpIdleTimeout = DefaultUdpIdleTimeout
+	}
+	if fp.Tls != nil {
+		err = fp.setupTls()
+		if err != nil {
+			return err
+		}
+		fp.Logger.Info("Serving HTTPS", "addr", fp.Tls.Addr.ToString())
+	}
+	if fp.ControlTls != nil {
+		err = fp.setupControlTls()
 		if err != nil {
 			return err
 		}
-		fp.auth = auth.NewInMemorySession(kp)
-		pk, _ := kp.DumpPublicKey()
-		file := os.Getenv("PROXY_PUBLIC_KEY_FILE")
-		if file == "" {
-			file = "key.pub"
+		if fp.ControlTls.Require {
+			fp.Logger.Info("Control requests need TLS")
+		}
+	}
+	authModes := 0
+	for _, enabled := range []bool{fp.Uima, fp.JwtKeyFile != "", fp.AuthWebhook != ""} {
+		if enabled {
+			authModes += 1
 		}
-		os.WriteFile(file, pk, 0644)
-		fp.Logger.Println("Using in-memory authentication server; RSA public key for authentication is stored in", file)
+	}
+	if authModes > 1 {
+		return ErrProxyAuthModeConflict
+	}
+	if fp.JwtKeyFile != "" {
+		err = fp.setupJwt()
+		if err != nil {
+			return err
+		}
+	}
+	if fp.JwtKeyFile != "" {
+		fp.Logger.Info("Using JWT authentication", "key_file", fp.JwtKeyFile)
+	} else if fp.AuthWebhook != "" {
+		webhook := auth.NewWebhookSession(fp.AuthWebhook, fp.AuthWebhookTTL)
+		webhook.Logger = fp.Logger
+		fp.auth = webhook
+		fp.Logger.Info("Using webhook authentication", "url", fp.AuthWebhook, "ttl", webhook.TTL)
+	} else if fp.Uima {
+		err = fp.setupUima()
+		if err != nil {
+			return err
+		}
+		fp.Logger.Info("Using in-memory authentication server", "admin_key_file", fp.adminKeyFile)
 	} else {
 		fp.auth = auth.NewDefaultSession(DUMMY_KEY)
-		fp.Logger.Println("Using default key authentication server")
+		fp.Logger.Info("Using default key authentication server")
+	}
+	if fp.Metrics != nil {
+		err = fp.setupMetrics()
+		if err != nil {
+			return err
+		}
+	}
+	if fp.AdminApi != nil {
+		err = fp.setupAdminApi()
+		if err != nil {
+			return err
+		}
+	}
+	if fp.certificates != nil || fp.controlCertificates != nil || fp.adminApiCertificates != nil || fp.revocations != nil {
+		go fp.watchFiles()
+	}
+	return nil
+}
+
+// Load or generate the admin key pair and open the token store, tokens are
+// persisted only if an auth store is configured
+func (fp *ForwardProxy) setupUima() error {
+	var err error
+	adminKeyFile := fp.AdminKeyFile
+	if adminKeyFile == "" && fp.AuthStore != "" {
+		// Persisted tokens are useless without the key to manage them
+		adminKeyFile = fp.AuthStore + ".key"
+	}
+	if adminKeyFile != "" {
+		var created bool
+		fp.keyPair, created, err = auth.LoadOrGenerateKeyPair(adminKeyFile)
+		if err != nil {
+			return err
+		}
+		if created {
+			fp.Logger.Info("Generated admin key pair", "file", adminKeyFile)
+		} else {
+			fp.Logger.Info("Loaded admin key pair", "file", adminKeyFile)
+		}
+	} else {
+		// Without a configured key file the key only lives until the next
+		// start, it is written out for the admin commands
+		adminKeyFile = os.Getenv("PROXY_ADMIN_KEY_FILE")
+		if adminKeyFile == "" {
+			adminKeyFile = "admin.key"
+		}
+		fp.keyPair, err = auth.GenerateKeyPair()
+		if err != nil {
+			return err
+		}
+		err = fp.keyPair.SavePrivateKey(adminKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	fp.adminKeyFile = adminKeyFile
+	fp.nonces = auth.NewNonceCache(auth.MaxRequestAge)
+
+	if fp.AuthStore == "" {
+		fp.auth = auth.NewInMemorySession(fp.keyPair)
+		return nil
 	}
+	store, err := auth.NewFileSession(fp.AuthStore, fp.keyPair)
+	if err != nil {
+		return err
+	}
+	fp.auth = store
+	fp.Logger.Info("Loaded tokens", "tokens", len(store.Store()), "file", fp.AuthStore)
+	return nil
+}
+
+// Accept tokens signed by the issuer key, revoked token IDs are read from
+// the revocation list if one is configured
+func (fp *ForwardProxy) setupJwt() error {
+	publicKey, err := auth.LoadIssuerPublicKey(fp.JwtKeyFile)
+	if err != nil {
+		return err
+	}
+	if fp.JwtRevocationFile != "" {
+		fp.revocations, err = auth.LoadRevocationList(fp.JwtRevocationFile)
+		if err != nil {
+			return err
+		}
+		fp.Logger.Info("Loaded revocation list", "revoked", fp.revocations.Len(), "file", fp.JwtRevocationFile)
+	}
+	fp.auth = auth.NewJwtSession(publicKey, fp.revocations)
 	return nil
 }
 
+// Pick up changed certificates and revocation lists
+func (fp *ForwardProxy) Reload() {
+	fp.ReloadCertificates()
+	if fp.revocations == nil {
+		return
+	}
+	reloaded, err := fp.revocations.Reload()
+	if err != nil {
+		fp.Logger.Error("Error reloading revocation list", "error", err)
+		return
+	}
+	if reloaded {
+		fp.Logger.Info("Reloaded revocation list", "revoked", fp.revocations.Len())
+	}
+}
+
 func (fp *ForwardProxy) Runing() bool {
 	fp.mut.Lock()
 	running := fp.running
@@ -159,213 +370,954 @@ func (fp *ForwardProxy) Runing() bool {
 }
 
 func (fp *ForwardProxy) Listen() {
+	if fp.TlsLn != nil {
+		go fp.serve(fp.TlsLn)
+	}
+	fp.serve(fp.Ln)
+}
+
+func (fp *ForwardProxy) serve(ln net.Listener) {
 	for fp.Runing() {
-		conn, err := fp.Ln.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
 			if !fp.Runing() {
 				return
 			}
-			fp.Logger.Println("Erorr accepting the connection:", err.Error())
+			fp.Logger.Error("Error accepting the connection", "error", err)
 			continue
 		}
 		go fp.Handle(conn)
 	}
 }
 
-func (fp *ForwardProxy) handleCreate(request *headers.ProxyHeader, conn net.Conn) {
-	if !fp.auth.IsValidAuthToken(request.Key) {
-		responseHeader := headers.ProxyHeader{
-			Code: headers.ProxyResponseAuthError,
-			Key:  "",
+func (fp *ForwardProxy) handleCreate(request *headers.ProxyFrame, conn net.Conn) {
+	// Only v2 clients can ask for a multiplexed control connection
+	create := headers.CreatePoolRequest{}
+	if request.Version != headers.ProxyHeaderV1 && len(request.Payload) > 0 {
+		err := request.Decode(&create)
+		if err != nil {
+			request.Response(headers.ResponseInvalidRequest, "", headers.MarshalError(err)).Write(conn)
+			conn.Close()
+			fp.Logger.Warn("Invalid request", "request", "CREATE", "error", err)
+			return
+		}
+	}
+
+	// A verified client certificate stands in for the auth token and is
+	// not limited like issued tokens are
+	token := request.Key
+	var owner string
+	var info auth.TokenInfo
+	identity := clientIdentity(conn)
+	if identity != "" {
+		token = "cert:" + identity
+		owner = token
+		info = auth.TokenInfo{AllowTcp: true}
+	} else {
+		var valid bool
+		info, valid = fp.authorize(request.Key, conn, &create)
+		if !valid {
+			fp.authFailures.Add(1, authFailureToken)
+			response := request.Response(headers.ResponseAuthError, "", headers.MarshalError(ErrProxyAuth))
+			response.Write(conn)
+			conn.Close()
+			fp.Logger.Warn("Invalid token", "request", "CREATE", "token", maskToken(request.Key), "remote", conn.RemoteAddr().String())
+			return
+		}
+		owner = tokenOwner(&info)
+	}
+
+	protocol := create.Protocol
+	if protocol == "" {
+		protocol = headers.TunnelProtocolHttp
+	}
+	err := fp.checkProtocol(protocol, create.Multiplex)
+	if err != nil {
+		request.Response(headers.ResponseInvalidRequest, "", headers.MarshalError(err)).Write(conn)
+		conn.Close()
+		fp.Logger.Warn("Invalid request", "request", "CREATE", "error", err)
+		return
+	}
+
+	sessionKey := sessionKeyFor(token, protocol, create.Resume)
+	// A token with a reserved subdomain, or limited to a single one, gets
+	// it without asking so its URL stays the same across reconnects. v1
+	// clients can't send the resume token with JOIN and DELETE, so they
+	// keep the secret key derived from the token.
+	if protocol == headers.TunnelProtocolHttp && create.Subdomain == "" && request.Version != headers.ProxyHeaderV1 {
+		if len(info.Reserved) > 0 {
+			create.Subdomain = info.Reserved[0]
+		} else if len(info.Subdomains) == 1 && isDnsLabel(info.Subdomains[0]) {
+			create.Subdomain = info.Subdomains[0]
+		}
+	}
+	if protocol == headers.TunnelProtocolHttp && create.Subdomain != "" {
+		sessionKey = create.Subdomain
+	}
+	if create.Multiplex && fp.resume(request, conn, &create, sessionKey, owner, protocol) {
+		fp.touch(owner)
+		return
+	}
+	resumeToken := uuid.New().String()
+	if protocol != headers.TunnelProtocolHttp {
+		sessionKey = sessionKeyFor(token, protocol, resumeToken)
+	}
+	err = fp.checkScope(&info, owner, protocol, create.Subdomain, sessionKey)
+	if err != nil {
+		request.Response(headers.ResponseForbidden, "", headers.MarshalError(err)).Write(conn)
+		conn.Close()
+		fp.Logger.Warn("Forbidden", "request", "CREATE", "owner", owner, "error", err)
+		return
+	}
+
+	fp.touch(owner)
+
+	session := NewSession(sessionKey, fp.Logger, fp.QueueSize, fp.QueueTimeout)
+	session.protocol = protocol
+	session.owner = owner
+	session.resumeToken = resumeToken
+	session.public = sessionKey == create.Subdomain
+	var port int
+	var tcpListener net.Listener
+	var udpConn net.PacketConn
+	switch protocol {
+	case headers.TunnelProtocolTcp:
+		tcpListener, port, err = fp.listenTcp()
+		session.listener = tcpListener
+	case headers.TunnelProtocolUdp:
+		udpConn, port, err = fp.listenUdp()
+		session.listener = udpConn
+	}
+	if err != nil {
+		request.Response(headers.ResponseTunnelUnavailable, "", headers.MarshalError(err)).Write(conn)
+		conn.Close()
+		fp.Logger.Error("Could not open the tunnel", "request", "CREATE", "session", sessionKey, "protocol", protocol, "error", err)
+		return
+	}
+	session.port = port
+
+	// Another owner may have taken the key since the scope was checked
+	err = fp.sessions.Claim(session)
+	if err != nil {
+		session.Disconnect()
+		fp.releasePort(protocol, port)
+		request.Response(headers.ResponseForbidden, "", headers.MarshalError(err)).Write(conn)
+		conn.Close()
+		fp.Logger.Warn("Forbidden", "request", "CREATE", "owner", owner, "error", err)
+		return
+	}
+
+	response := request.Response(
+		headers.ResponseSuccess,
+		sessionKey,
+		headers.MarshalPayload(headers.CreatePoolResponse{
+			Session:   sessionKey,
+			Multiplex: create.Multiplex,
+			Protocol:  protocol,
+			Port:      fp.publicPort(protocol, port),
+			Scheme:    fp.scheme(protocol),
+			Resume:    session.resumeToken,
+		}),
+	)
+	_, err = response.Write(conn)
+	if err != nil {
+		// The port is not served yet, nothing else gives it back
+		fp.sessions.Remove(session)
+		fp.releasePort(protocol, port)
+		conn.Close()
+		fp.Logger.Error("Error writing response", "request", "CREATE", "session", sessionKey, "error", err)
+		return
+	}
+
+	if !create.Multiplex {
+		conn.Close()
+		fp.Logger.Info("Created session", "request", "CREATE", "session", sessionKey, "protocol", protocol)
+		return
+	}
+
+	// The control connection stays open and carries every visitor request
+	// as a stream, the session goes away with it
+	control := session.Multiplex(conn)
+	fp.Logger.Info("Created multiplexed session", "request", "CREATE", "session", sessionKey, "protocol", protocol)
+	go fp.watchControl(session, control)
+	switch protocol {
+	case headers.TunnelProtocolTcp:
+		fp.Logger.Info("Listening for the tunnel", "request", "CREATE", "session", sessionKey, "port", port)
+		go fp.serveTcp(session, tcpListener, port)
+	case headers.TunnelProtocolUdp:
+		fp.Logger.Info("Listening for the tunnel", "request", "CREATE", "session", sessionKey, "port", port)
+		go fp.serveUdp(session, udpConn, port)
+	}
+}
+
+// Hand the session over to a reconnecting client which presents its resume
+// token, the tunnel keeps its subdomain or port. Returns false if there is
+// nothing to resume and a new session has to be created.
+func (fp *ForwardProxy) resume(request *headers.ProxyFrame, conn net.Conn, create *headers.CreatePoolRequest, sessionKey string, owner string, protocol string) bool {
+	session := fp.sessions.Get(sessionKey)
+	if session == nil || !session.Resumable(create.Resume, owner, protocol) {
+		return false
+	}
+	response := request.Response(
+		headers.ResponseSuccess,
+		sessionKey,
+		headers.MarshalPayload(headers.CreatePoolResponse{
+			Session:   sessionKey,
+			Multiplex: true,
+			Protocol:  protocol,
+			Port:      fp.publicPort(protocol, session.port),
+			Scheme:    fp.scheme(protocol),
+			Resume:    create.Resume,
+			Resumed:   true,
+		}),
+	)
+	_, err := response.Write(conn)
+	if err != nil {
+		conn.Close()
+		fp.Logger.Error("Error writing response", "request", "CREATE", "session", sessionKey, "error", err)
+		return true
+	}
+	control, err := session.Resume(conn)
+	if err != nil {
+		// Reaped in the meantime, the client creates a new session when it
+		// sees the connection close
+		conn.Close()
+		fp.Logger.Warn("Could not resume", "request", "CREATE", "session", sessionKey, "error", err)
+		return true
+	}
+	fp.Logger.Info("Resumed session", "request", "CREATE", "session", sessionKey, "protocol", protocol)
+	go fp.watchControl(session, control)
+	return true
+}
+
+// Keep the session around for the grace period once its control connection
+// goes away, so the client can resume it
+func (fp *ForwardProxy) watchControl(session *Session, control *mux.Session) {
+	if fp.HeartbeatInterval > 0 {
+		control.Keepalive(fp.HeartbeatInterval, fp.HeartbeatTimeout)
+	}
+	<-control.CloseChan()
+	if fp.ResumeGrace <= 0 {
+		if fp.sessions.Remove(session) {
+			fp.Logger.Info("Control connection closed", "request", "DELETE", "session", session.Key())
 		}
-		responseHeader.Write(conn)
-		fp.Logger.Println("/CREATE invalid request; ", request.Key)
 		return
 	}
-	sessionKey := auth.Sha256([]byte(request.Key))
-	responseHeader := headers.ProxyHeader{
-		Code: headers.ProxyResponseSucess,
-		Key:  sessionKey,
+	epoch, offline := session.Offline(control)
+	if !offline {
+		return
+	}
+	fp.Logger.Info("Control connection closed, waiting for the client to resume", "request", "DELETE", "session", session.Key(), "grace", fp.ResumeGrace)
+	time.AfterFunc(fp.ResumeGrace, func() {
+		if session.Reapable(epoch) && fp.sessions.Remove(session) {
+			fp.Logger.Info("Not resumed in time", "request", "DELETE", "session", session.Key())
+		}
+	})
+}
+
+// Ping the idle pooled connections of every session, multiplexed sessions
+// are kept alive by their control connection
+func (fp *ForwardProxy) heartbeat() {
+	ticker := time.NewTicker(fp.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, session := range fp.sessions.Sessions() {
+				go session.Heartbeat(fp.HeartbeatTimeout)
+			}
+		case <-fp.stopch:
+			return
+		}
+	}
+}
+
+// Scheme of the public URL of an HTTP tunnel
+func (fp *ForwardProxy) scheme(protocol string) string {
+	if protocol != headers.TunnelProtocolHttp {
+		return ""
 	}
-	responseHeader.Write(conn)
-	fp.sessions[sessionKey] = &Session{
-		key:         sessionKey,
-		connections: make(map[string]*Connection, 5),
-		free:        make([]string, 0),
-		inUse:       make([]string, 0),
-		logger:      fp.Logger,
+	if fp.Tls != nil {
+		return "https"
 	}
-	conn.Close()
-	fp.Logger.Println("/CREATE", sessionKey)
+	return "http"
 }
 
-func (fp *ForwardProxy) handleJoin(request *headers.ProxyHeader, conn net.Conn) {
-	if fp.sessions[request.Key].connected >= MaxConnectionPoolSize {
-		response := &headers.ProxyHeader{
-			Code: headers.ProxyResponseMaxConnectionsLimitReached,
-			Key:  request.Key,
+// Port visitors connect to, HTTP tunnels only report the HTTPS port
+func (fp *ForwardProxy) publicPort(protocol string, port int) int {
+	if protocol == headers.TunnelProtocolHttp && fp.Tls != nil {
+		return fp.Tls.Addr.Port
+	}
+	return port
+}
+
+// Give a public port back which no serve loop took over, they release their
+// port once the session closes the listener
+func (fp *ForwardProxy) releasePort(protocol string, port int) {
+	switch protocol {
+	case headers.TunnelProtocolTcp:
+		fp.tcpPorts.Release(port)
+	case headers.TunnelProtocolUdp:
+		fp.udpPorts.Release(port)
+	}
+}
+
+// HTTP tunnels keep using the token hash as session key so their URL does
+// not change. Every TCP and UDP tunnel gets a key of its own, derived from
+// its resume token so a reconnecting client finds it again.
+func sessionKeyFor(token string, protocol string, resumeToken string) string {
+	if protocol == headers.TunnelProtocolHttp {
+		return auth.Sha256([]byte(token))
+	}
+	return auth.Sha256([]byte(token + ":" + protocol + ":" + resumeToken))
+}
+
+func (fp *ForwardProxy) checkProtocol(protocol string, multiplex bool) error {
+	switch protocol {
+	case headers.TunnelProtocolHttp:
+		return nil
+	case headers.TunnelProtocolTcp:
+		if fp.tcpPorts == nil {
+			return ErrProxyTcpDisabled
 		}
-		_, err := response.Write(conn)
-		if err != nil {
-			fp.Logger.Println("/JOIN", request.Key, "-> Error writing response:", err.Error())
-		} else {
-			fp.Logger.Println("/JOIN", request.Key, "-> No free connection available")
+	case headers.TunnelProtocolUdp:
+		if fp.udpPorts == nil {
+			return ErrProxyUdpDisabled
 		}
-	} else {
-		// request.Message represents connection id
-		response := &headers.ProxyHeader{
-			Code: headers.ProxyResponseSucess,
-			Key:  request.Key,
+	default:
+		return fmt.Errorf("%w; %s", ErrProxyUnknownProtocol, protocol)
+	}
+	if !multiplex {
+		return ErrProxyProtocolNeedsMultiplex
+	}
+	return nil
+}
+
+// Identity tunnels and domains opened with the token belong to. Signed
+// tokens carry no ID the proxy assigned, their subject owns the tunnels.
+func tokenOwner(info *auth.TokenInfo) string {
+	if info.Subject != "" {
+		return "sub:" + info.Subject
+	}
+	return "token:" + strconv.Itoa(info.ID)
+}
+
+// Look up the token, backends which decide per tunnel also get to see who
+// connects and what for
+func (fp *ForwardProxy) authorize(token string, conn net.Conn, create *headers.CreatePoolRequest) (auth.TokenInfo, bool) {
+	authorizer, ok := fp.auth.(auth.Authorizer)
+	if !ok {
+		return fp.auth.Token(token)
+	}
+	clientIp := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(clientIp); err == nil {
+		clientIp = host
+	}
+	protocol := create.Protocol
+	if protocol == "" {
+		protocol = headers.TunnelProtocolHttp
+	}
+	return authorizer.Authorize(auth.AuthRequest{
+		Token:     token,
+		ClientIp:  clientIp,
+		Subdomain: create.Subdomain,
+		Protocol:  protocol,
+	})
+}
+
+// Check the tunnel against the limits of the token it is opened with
+func (fp *ForwardProxy) checkScope(info *auth.TokenInfo, owner string, protocol string, subdomain string, sessionKey string) error {
+	if protocol != headers.TunnelProtocolHttp {
+		if !info.AllowTcp {
+			return fmt.Errorf("%w; %s tunnels are not allowed", ErrProxyTokenScope, protocol)
+		}
+	} else if subdomain != "" {
+		if !isDnsLabel(subdomain) {
+			return ErrProxyInvalidSubdomain
+		}
+		if !info.AllowsSubdomain(subdomain) {
+			return fmt.Errorf("%w; subdomain %s is not allowed", ErrProxyTokenScope, subdomain)
+		}
+		if !info.Reserves(subdomain) {
+			reservedBy, reserved := fp.reservedBy(subdomain)
+			if reserved && reservedBy != info.ID {
+				return ErrProxySubdomainReserved
+			}
+		}
+	} else if info.Scoped() {
+		return fmt.Errorf("%w; a subdomain matching %s is required", ErrProxyTokenScope, strings.Join(info.Subdomains, ", "))
+	}
+
+	// Reconnecting replaces the session of the same owner, a session of
+	// someone else is never taken over. Claiming the key when the session is
+	// registered has the final word, this only fails before a port is opened
+	previous := fp.sessions.Get(sessionKey)
+	if previous != nil && previous.Owner() != owner {
+		return ErrProxySubdomainInUse
+	}
+	if info.MaxSessions > 0 && fp.sessions.CountOwner(owner, sessionKey) >= info.MaxSessions {
+		return ErrProxyMaxSessionsReached
+	}
+	return nil
+}
+
+// ID of the token the subdomain is reserved for
+func (fp *ForwardProxy) reservedBy(subdomain string) (int, bool) {
+	for _, info := range fp.auth.Store() {
+		if info.Reserves(subdomain) {
+			return info.ID, true
 		}
+	}
+	return 0, false
+}
+
+// Subdomains are single DNS labels so the first label of the host header
+// finds the session
+func isDnsLabel(name string) bool {
+	if len(name) == 0 || len(name) > 63 {
+		return false
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func (fp *ForwardProxy) handleJoin(request *headers.ProxyFrame, conn net.Conn) {
+	// Connection id is sent as raw message by v1 clients
+	id := string(request.Payload)
+	heartbeat := false
+	resumeToken := ""
+	if request.Version != headers.ProxyHeaderV1 {
+		join := headers.JoinPoolRequest{}
+		err := request.Decode(&join)
+		if err != nil {
+			request.Response(headers.ResponseInvalidRequest, request.Key, headers.MarshalError(err)).Write(conn)
+			conn.Close()
+			fp.Logger.Warn("Invalid request", "request", "JOIN", "session", request.Key, "error", err)
+			return
+		}
+		id = join.ID
+		heartbeat = join.Heartbeat && fp.HeartbeatInterval > 0
+		resumeToken = join.Resume
+	}
+
+	// A session somebody else owns looks like one which does not exist
+	session := fp.sessions.Lookup(request.Key)
+	if session == nil || !session.Authorized(resumeToken) {
+		defer conn.Close()
+		response := request.Response(headers.ResponseAuthError, request.Key, headers.MarshalError(ErrProxyInvalidSessionKey))
+		response.Write(conn)
+		fp.Logger.Warn("No session found", "request", "JOIN", "session", request.Key)
+		return
+	}
+
+	err := session.Reserve()
+	if err == ErrProxyMaxConnectionsLimitReached {
+		response := request.Response(
+			headers.ResponseMaxConnectionsLimitReached,
+			request.Key,
+			headers.MarshalError(ErrProxyMaxConnectionsLimitReached),
+		)
 		_, err := response.Write(conn)
 		if err != nil {
-			fp.Logger.Println("/JOIN", request.Key, "-> Error writing response:", err.Error())
+			fp.Logger.Error("Error writing response", "request", "JOIN", "session", request.Key, "error", err)
 		} else {
-			fp.sessions[request.Key].Join(request.Message, conn)
-			fp.Logger.Println("/JOIN", request.Key, "-> Connection ID:", request.Message)
+			fp.Logger.Warn("Max connections limit reached", "request", "JOIN", "session", request.Key)
 		}
+		return
 	}
+	if err != nil {
+		defer conn.Close()
+		response := request.Response(headers.ResponseAuthError, request.Key, headers.MarshalError(err))
+		response.Write(conn)
+		fp.Logger.Warn("Could not join", "request", "JOIN", "session", request.Key, "error", err)
+		return
+	}
+
+	var payload []byte
+	if heartbeat {
+		payload = headers.MarshalPayload(headers.JoinPoolResponse{
+			Heartbeat: fp.HeartbeatInterval.Milliseconds(),
+		})
+	}
+	response := request.Response(headers.ResponseSuccess, request.Key, payload)
+	_, err = response.Write(conn)
+	if err != nil {
+		session.Unreserve()
+		conn.Close()
+		fp.Logger.Error("Error writing response", "request", "JOIN", "session", request.Key, "error", err)
+		return
+	}
+	err = session.Join(id, conn, heartbeat)
+	if err != nil {
+		fp.Logger.Warn("Could not join", "request", "JOIN", "session", request.Key, "error", err)
+		return
+	}
+	fp.Logger.Debug("Joined the pool", "request", "JOIN", "session", request.Key, "connection", id)
 }
 
-func (fp *ForwardProxy) handleDelete(request *headers.ProxyHeader, conn net.Conn) {
-	fp.sessions[request.Key].Disconnect()
-	delete(fp.sessions, request.Key)
-	fp.Logger.Println("/DELETE", request.Key)
+func (fp *ForwardProxy) handleDelete(request *headers.ProxyFrame, conn net.Conn) {
+	defer conn.Close()
+	remove := headers.DeletePoolRequest{}
+	if request.Version != headers.ProxyHeaderV1 && len(request.Payload) > 0 {
+		err := request.Decode(&remove)
+		if err != nil {
+			fp.Logger.Warn("Invalid request", "request", "DELETE", "session", request.Key, "error", err)
+			return
+		}
+	}
+	session := fp.sessions.Get(request.Key)
+	if session == nil || !session.Authorized(remove.Resume) {
+		fp.Logger.Warn("No session found", "request", "DELETE", "session", request.Key)
+		return
+	}
+	fp.sessions.Remove(session)
+	fp.Logger.Info("Deleted session", "request", "DELETE", "session", request.Key)
 }
 
-func (fp *ForwardProxy) handleGenerateKey(request *headers.ProxyHeader, conn net.Conn) {
-	var response *headers.ProxyHeader
+// Check the signature, timestamp and nonce of an admin request and decode
+// its payload into v
+func (fp *ForwardProxy) verifyAdminRequest(request *headers.ProxyFrame, v any) error {
+	// v1 requests can't carry a signature
+	if request.Version == headers.ProxyHeaderV1 {
+		return ErrProxyInvalidSigningKey
+	}
+	signature, err := base64.StdEncoding.DecodeString(request.Key)
+	if err != nil {
+		return ErrProxyInvalidSigningKey
+	}
+	if !fp.auth.IsValidRequest(signature, headers.AdminMessage(request.Code, request.Payload)) {
+		return ErrProxyInvalidSigningKey
+	}
+	admin := headers.AdminRequest{}
+	err = request.Decode(&admin)
+	if err != nil {
+		return err
+	}
+	err = fp.nonces.Check(time.Unix(admin.Timestamp, 0), admin.Nonce)
+	if err != nil {
+		return err
+	}
+	return request.Decode(v)
+}
+
+func (fp *ForwardProxy) handleGenerateKey(request *headers.ProxyFrame, conn net.Conn) {
+	var response *headers.ProxyFrame
 	defer conn.Close()
 
 	if !fp.Uima {
-		fp.Logger.Printf("/GENERATE not in UIMA mode")
-		response = &headers.ProxyHeader{
-			Code: headers.ProxyResponseNotInUimaMode,
-		}
+		fp.Logger.Warn("Not in UIMA mode", "request", "GENERATE")
+		response = request.Response(headers.ResponseNotInUimaMode, "", headers.MarshalError(ErrProxyNotInUimaMode))
 		response.Write(conn)
 		return
 	}
 
-	if !fp.auth.IsValidRequest([]byte(request.Key), headers.ProxyRequestGenerateKey) {
-		fp.Logger.Printf("/GENERATE Invalid signing key")
-		response = &headers.ProxyHeader{
-			Code: headers.ProxyResponseAuthError,
-		}
+	generate := headers.GenerateKeyRequest{}
+	err := fp.verifyAdminRequest(request, &generate)
+	if err != nil {
+		fp.authFailures.Add(1, authFailureAdmin)
+		fp.Logger.Warn("Invalid request", "request", "GENERATE", "error", err)
+		response = request.Response(headers.ResponseAuthError, "", headers.MarshalError(err))
 		response.Write(conn)
 		return
 	}
 
-	// TOFIX: Increase header size to allow different communication type
-	if len(fp.auth.Store()) > 255 {
-		fp.Logger.Printf("/GENERATE Max token limite reached")
-		response = &headers.ProxyHeader{
-			Code: headers.ProxyResponseUIMAError,
-		}
+	generated, err := fp.generateKey(generate)
+	if err != nil {
+		fp.Logger.Warn("Invalid request", "request", "GENERATE", "error", err)
+		response = request.Response(headers.ResponseInvalidRequest, "", headers.MarshalError(err))
 		response.Write(conn)
 		return
 	}
+	response = request.Response(headers.ResponseSuccess, generated.Key, headers.MarshalPayload(generated))
+	response.Write(conn)
+	fp.Logger.Info("Generated key", "request", "GENERATE", "id", generated.ID)
+}
 
-	response = &headers.ProxyHeader{
-		Code:    headers.ProxyResponseSucess,
-		Key:     fp.auth.GenerateKey(),
-		Message: strconv.Itoa(fp.auth.Count()),
+// Store a new key with the limits of the request
+func (fp *ForwardProxy) generateKey(generate headers.GenerateKeyRequest) (headers.GenerateKeyResponse, error) {
+	info := auth.TokenInfo{
+		Label:       generate.Label,
+		Subdomains:  generate.Subdomains,
+		MaxSessions: generate.MaxSessions,
+		AllowTcp:    generate.AllowTcp,
 	}
-	response.Write(conn)
-	fp.Logger.Println("/GENERATE Generate key with index:", fp.auth.Count())
+	if generate.TTL > 0 {
+		info.Expires = time.Now().UTC().Add(time.Duration(generate.TTL) * time.Second).Truncate(time.Second)
+	}
+	for _, pattern := range info.Subdomains {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return headers.GenerateKeyResponse{}, fmt.Errorf("%w; %s", err, pattern)
+		}
+	}
+
+	// Checking and storing reservations has to happen in one go so two
+	// keys can't reserve the same subdomain
+	fp.keysMut.Lock()
+	defer fp.keysMut.Unlock()
+	for _, subdomain := range generate.Reserved {
+		if !isDnsLabel(subdomain) {
+			return headers.GenerateKeyResponse{}, fmt.Errorf("%w; %s", ErrProxyInvalidSubdomain, subdomain)
+		}
+		if id, reserved := fp.reservedBy(subdomain); reserved {
+			return headers.GenerateKeyResponse{}, fmt.Errorf("%w; %s is reserved for key %d", ErrProxySubdomainReserved, subdomain, id)
+		}
+		info.Reserved = append(info.Reserved, subdomain)
+	}
+
+	key, info, err := fp.auth.GenerateKey(info)
+	if err != nil {
+		return headers.GenerateKeyResponse{}, err
+	}
+	generated := headers.GenerateKeyResponse{ID: info.ID, Key: key}
+	if !info.Expires.IsZero() {
+		generated.Expires = info.Expires.Unix()
+	}
+	return generated, nil
 }
 
-func (fp *ForwardProxy) handleRevokeKey(request *headers.ProxyHeader, conn net.Conn) {
-	var response *headers.ProxyHeader
+func (fp *ForwardProxy) handleRevokeKey(request *headers.ProxyFrame, conn net.Conn) {
+	var response *headers.ProxyFrame
 	defer conn.Close()
 
 	if !fp.Uima {
-		fp.Logger.Printf("/REVOKE not in UIMA mode")
-		response = &headers.ProxyHeader{
-			Code: headers.ProxyResponseNotInUimaMode,
-		}
+		fp.Logger.Warn("Not in UIMA mode", "request", "REVOKE")
+		response = request.Response(headers.ResponseNotInUimaMode, "", headers.MarshalError(ErrProxyNotInUimaMode))
 		response.Write(conn)
 		return
 	}
 
-	keyIdbuf, err := fp.auth.(*auth.InMemory).KeyPair.Decrypt([]byte(request.Key))
+	revoke := headers.RevokeKeyRequest{}
+	err := fp.verifyAdminRequest(request, &revoke)
 	if err != nil {
-		fp.Logger.Printf("/REVOKE Invalid signing key")
-		response = &headers.ProxyHeader{
-			Code: headers.ProxyResponseAuthError,
-		}
+		fp.authFailures.Add(1, authFailureAdmin)
+		fp.Logger.Warn("Invalid request", "request", "REVOKE", "error", err)
+		response = request.Response(headers.ResponseAuthError, "", headers.MarshalError(err))
+		response.Write(conn)
+		return
+	}
+	key, err := fp.revokeKey(revoke.ID)
+	if errors.Is(err, ErrProxyKeyNotFound) {
+		fp.Logger.Warn("Key was not found", "request", "REVOKE", "id", revoke.ID)
+		response = request.Response(headers.ResponseKeyNotFound, "", headers.MarshalError(err))
+		response.Write(conn)
+		return
+	}
+	if err != nil {
+		fp.Logger.Error("Error revoking key", "request", "REVOKE", "id", revoke.ID, "error", err)
+		response = request.Response(headers.ResponseInvalidRequest, "", headers.MarshalError(err))
 		response.Write(conn)
 		return
 	}
+	fp.Logger.Info("Revoked key", "request", "REVOKE", "id", revoke.ID)
+	response = request.Response(
+		headers.ResponseSuccess,
+		key,
+		headers.MarshalPayload(headers.RevokeKeyResponse{ID: revoke.ID, Key: key}),
+	)
+	response.Write(conn)
+}
 
-	keyIdbuf = append(keyIdbuf, 0)
-	keyId := int(binary.LittleEndian.Uint16(keyIdbuf))
+// Delete the key with the ID, returns the deleted key
+func (fp *ForwardProxy) revokeKey(id int) (string, error) {
 	keyToDelete := ""
-	for key, id := range fp.auth.Store() {
-		if id == keyId {
+	for key, info := range fp.auth.Store() {
+		if info.ID == id {
 			keyToDelete = key
 			break
 		}
 	}
+	if keyToDelete == "" {
+		return "", ErrProxyKeyNotFound
+	}
+	err := fp.auth.DeleteKey(keyToDelete)
+	if err != nil {
+		return "", err
+	}
+	fp.mut.Lock()
+	delete(fp.lastUse, "token:"+strconv.Itoa(id))
+	fp.mut.Unlock()
+	return keyToDelete, nil
+}
 
-	if keyToDelete != "" {
-		fp.auth.DeleteKey(keyToDelete)
-		fp.Logger.Println("/REVOKE Revoked key with index:", keyId)
-	} else {
-		fp.Logger.Println("/REVOKE Key was not found:", keyId)
+func (fp *ForwardProxy) handleListKeys(request *headers.ProxyFrame, conn net.Conn) {
+	var response *headers.ProxyFrame
+	defer conn.Close()
+
+	if !fp.Uima {
+		fp.Logger.Warn("Not in UIMA mode", "request", "LIST")
+		response = request.Response(headers.ResponseNotInUimaMode, "", headers.MarshalError(ErrProxyNotInUimaMode))
+		response.Write(conn)
+		return
 	}
 
-	response = &headers.ProxyHeader{
-		Code: headers.ProxyResponseSucess,
-		Key:  keyToDelete,
+	list := headers.ListKeysRequest{}
+	err := fp.verifyAdminRequest(request, &list)
+	if err != nil {
+		fp.authFailures.Add(1, authFailureAdmin)
+		fp.Logger.Warn("Invalid request", "request", "LIST", "error", err)
+		response = request.Response(headers.ResponseAuthError, "", headers.MarshalError(err))
+		response.Write(conn)
+		return
 	}
+
+	keys := fp.listKeys()
+
+	response = request.Response(headers.ResponseSuccess, "", headers.MarshalPayload(headers.ListKeysResponse{Keys: keys}))
 	response.Write(conn)
+	fp.Logger.Info("Listed keys", "request", "LIST", "keys", len(keys))
+}
+
+// Keys of the store ordered by ID, with their masked token and usage
+func (fp *ForwardProxy) listKeys() []headers.KeyInfo {
+	keys := []headers.KeyInfo{}
+	for key, info := range fp.auth.Store() {
+		owner := "token:" + strconv.Itoa(info.ID)
+		keyInfo := headers.KeyInfo{
+			ID:          info.ID,
+			Label:       info.Label,
+			Key:         maskToken(key),
+			Created:     info.Created.Unix(),
+			Sessions:    fp.sessions.CountOwner(owner, ""),
+			Subdomains:  info.Subdomains,
+			Reserved:    info.Reserved,
+			MaxSessions: info.MaxSessions,
+			AllowTcp:    info.AllowTcp,
+		}
+		if !info.Expires.IsZero() {
+			keyInfo.Expires = info.Expires.Unix()
+		}
+		if lastUse := fp.lastUsed(owner); !lastUse.IsZero() {
+			keyInfo.LastUsed = lastUse.Unix()
+		}
+		keys = append(keys, keyInfo)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+	return keys
+}
+
+// Record that the owner opened a tunnel, only kept in memory
+func (fp *ForwardProxy) touch(owner string) {
+	fp.mut.Lock()
+	fp.lastUse[owner] = time.Now()
+	fp.mut.Unlock()
+}
+
+func (fp *ForwardProxy) lastUsed(owner string) time.Time {
+	fp.mut.Lock()
+	defer fp.mut.Unlock()
+	return fp.lastUse[owner]
+}
+
+// Enough of the token to tell it apart, not enough to use it
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:4] + strings.Repeat("*", len(token)-8) + token[len(token)-4:]
 }
 
-func (fp *ForwardProxy) handleForward(request *headers.HttpRequestHeader, conn net.Conn) {
+// Whether the HTTP tunnel behind the key waits for its client to reconnect
+func (fp *ForwardProxy) offline(sessionKey string, domain Domain, custom bool) bool {
+	session := fp.sessions.Get(sessionKey)
+	if session == nil || session.State() != SessionOffline || session.Protocol() != headers.TunnelProtocolHttp {
+		return false
+	}
+	return !custom || session.Owner() == domain.Owner
+}
+
+const defaultOfflinePage string = "Tunnel is offline, reconnecting. Try again in a few seconds.\n"
+
+// Response for visitors of reconnecting tunnels, with the configured page
+// or a plain text note
+func makeOfflineResponse(page string) (headers.HttpResponseHeader, error) {
+	if page == "" {
+		return headers.MakeOfflineResponse([]byte(defaultOfflinePage), "text/plain; charset=utf-8", OfflineRetryAfter), nil
+	}
+	data, err := os.ReadFile(page)
+	if err != nil {
+		return headers.HttpResponseHeader{}, err
+	}
+	return headers.MakeOfflineResponse(data, "text/html; charset=utf-8", OfflineRetryAfter), nil
+}
+
+// Host the visitor asked for without the port
+func visitorHost(request *headers.HttpRequestHeader) string {
+	host := strings.TrimSpace(request.Get("Host"))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// Forward a visitor request to the session its host belongs to, returns
+// whether the visitor connection can be used for the next request
+func (fp *ForwardProxy) handleForward(request *headers.HttpRequestHeader, reader *bufio.Reader, conn net.Conn) bool {
 	var err error
-	sessionKey := strings.Split(request.Headers["Host"], ".")[0]
-	session := fp.sessions[sessionKey]
-	if session == nil {
-		defer conn.Close()
-		_, err = headers.HttpResponseNoSessionFound.Write(conn)
+	var written int
+	host := visitorHost(request)
+	sessionKey := strings.Split(host, ".")[0]
+	domain, custom := fp.domains.Route(host)
+	if custom {
+		sessionKey = domain.Subdomain
+	}
+	access := newAccessEntry(request, conn, host, sessionKey)
+	session := fp.sessions.Lookup(sessionKey)
+	// Someone else could hold the subdomain while the owner of the domain
+	// is offline, they don't get its visitors
+	if session != nil && custom && session.Owner() != domain.Owner {
+		session = nil
+	}
+	if session == nil && fp.offline(sessionKey, domain, custom) {
+		fp.failures.Add(1, failureOffline)
+		written, err = fp.offlineResponse.Write(conn)
+		fp.logAccess(access, fp.offlineResponse.StatusCode, int64(written))
 		if err != nil {
-			fp.Logger.Println("/FORWARD", sessionKey, "-> No session found; Error writing response: ", err.Error())
+			fp.Logger.Error("Tunnel offline, error writing response", "request", "FORWARD", "session", sessionKey, "error", err)
 		} else {
-			fp.Logger.Println("/FORWARD", sessionKey, "-> No session found")
+			fp.Logger.Debug("Tunnel offline", "request", "FORWARD", "session", sessionKey)
 		}
-	} else {
-		err = session.Forward(request, conn)
+		return false
+	}
+	if session == nil || session.Protocol() != headers.TunnelProtocolHttp {
+		fp.failures.Add(1, failureNoSession)
+		written, err = headers.HttpResponseNoSessionFound.Write(conn)
+		fp.logAccess(access, headers.HttpResponseNoSessionFound.StatusCode, int64(written))
 		if err != nil {
-			fp.Logger.Println("/FORWARD", sessionKey, err.Error())
+			fp.Logger.Error("No session found, error writing response", "request", "FORWARD", "session", sessionKey, "error", err)
 		} else {
-			fp.Logger.Println("/FORWARD", sessionKey, request.Method, request.Path, request.Protocol)
+			fp.Logger.Debug("No session found", "request", "FORWARD", "session", sessionKey)
+		}
+		return false
+	}
+
+	done := fp.track()
+	start := time.Now()
+	exchange, err := session.Forward(request, reader, conn)
+	done()
+	session.stats.observe(exchange, err, time.Since(start))
+	var bytesOut int64
+	if exchange != nil {
+		bytesOut = exchange.BytesOut
+	}
+	fp.logAccess(access, forwardStatus(exchange, err), bytesOut)
+	if err != nil {
+		fp.Logger.Warn("Error forwarding request", "request", "FORWARD", "session", sessionKey, "method", request.Method, "path", request.Path, "error", err)
+		return false
+	}
+	fp.Logger.Debug("Forwarded request", "request", "FORWARD", "session", sessionKey, "method", request.Method, "path", request.Path, "status", exchange.Response.StatusCode)
+	return exchange.KeepAlive
+}
+
+// Serve requests from a visitor connection until it is closed or stops
+// being persistent, pipelined requests are forwarded one after the other
+func (fp *ForwardProxy) serveHttp(conn net.Conn, initialBuffer []byte) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	buffer := initialBuffer
+	for {
+		requestHeader := &headers.HttpRequestHeader{
+			Buffer: buffer,
 		}
+		if buffer == nil {
+			conn.SetReadDeadline(time.Now().Add(HttpIdleTimeout))
+		}
+		err := requestHeader.Read(reader)
+		if err != nil {
+			if buffer != nil {
+				fp.Logger.Warn("Error reading request", "error", err)
+			}
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		buffer = nil
+
+		if fp.Tls != nil && fp.Tls.Redirect && !isTls(conn) {
+			fp.redirectToHttps(requestHeader, conn)
+			return
+		}
+
+		// Keep-alive visitors are let go once the proxy drains
+		if !fp.handleForward(requestHeader, reader, conn) || !fp.Runing() {
+			return
+		}
+	}
+}
+
+func (fp *ForwardProxy) handleProxyRequest(request *headers.ProxyFrame, conn net.Conn) {
+	if fp.ControlTls != nil && fp.ControlTls.Require && !isTls(conn) {
+		defer conn.Close()
+		request.Response(headers.ResponseInvalidRequest, "", headers.MarshalError(ErrProxyControlTlsRequired)).Write(conn)
+		fp.Logger.Warn("Plain text control request rejected", "request", request.Code.String())
+		return
 	}
+	requestHandler := fp.requestHandlers[request.Code]
+	if requestHandler == nil {
+		defer conn.Close()
+		response := request.Response(
+			headers.ResponseInvalidRequest,
+			"",
+			headers.MarshalError(fmt.Errorf("%w; %s", headers.ErrUnknownRequestCode, request.Code)),
+		)
+		response.Write(conn)
+		fp.Logger.Warn("Unknown request code", "request", request.Code.String())
+		return
+	}
+	requestHandler(request, conn)
 }
 
 func (fp *ForwardProxy) Handle(conn net.Conn) {
 	headerBytes := make([]byte, 1)
 	_, err := conn.Read(headerBytes)
 	if err != nil {
-		fp.Logger.Println("Error reading first request byte")
+		fp.Logger.Debug("Error reading first request byte", "error", err)
 		return
 	}
-	requestHandler := fp.requestHandlers[string(headerBytes)]
-	if requestHandler != nil {
+
+	if headerBytes[0] == tlsRecordTypeHandshake && fp.controlTlsConfig != nil && !isTls(conn) {
+		tlsConn, err := fp.upgradeControlTls(conn, headerBytes)
+		if err != nil {
+			fp.Logger.Warn("Error upgrading the connection to TLS", "error", err)
+			conn.Close()
+			return
+		}
+		fp.Handle(tlsConn)
+		return
+	}
+
+	if headerBytes[0] == headers.ProxyHeaderV2 {
+		request := &headers.ProxyFrame{}
+		err = request.ReadPartial(conn, headerBytes)
+		if err != nil {
+			fp.Logger.Warn("Error reading proxy frame", "error", err)
+			conn.Close()
+			return
+		}
+		fp.handleProxyRequest(request, conn)
+		return
+	}
+
+	if headers.IsProxyRequestV1(string(headerBytes)) {
 		requestHeader := &headers.ProxyHeader{}
 		requestHeader.ReadPartial(conn, headerBytes)
-		requestHandler.(func(*headers.ProxyHeader, net.Conn))(requestHeader, conn)
-	} else {
-		requestHeader := &headers.HttpRequestHeader{
-			Buffer: headerBytes,
-		}
-		err = requestHeader.Read(conn)
+		request, err := headers.FrameFromProxyHeader(requestHeader)
 		if err != nil {
-			fp.Logger.Println(err)
+			fp.Logger.Warn("Error reading proxy header", "error", err)
+			conn.Close()
 			return
 		}
-		fp.handleForward(requestHeader, conn)
+		fp.handleProxyRequest(request, conn)
+		return
 	}
+
+	fp.serveHttp(conn, headerBytes)
 }
 
 func (fp *ForwardProxy) Stop() {
@@ -373,10 +1325,15 @@ func (fp *ForwardProxy) Stop() {
 	fp.running = false
 	fp.mut.Unlock()
 
-	for key, session := range fp.sessions {
-		session.Disconnect()
-		fp.Logger.Println("/DELETE", key)
+	for _, session := range fp.sessions.Close() {
+		fp.Logger.Info("Closed session", "request", "DELETE", "session", session.Key())
 	}
-	fp.Logger.Println("Stopping the listener...")
+	fp.Logger.Info("Stopping the listener")
+	close(fp.stopch)
 	fp.Ln.Close()
+	if fp.TlsLn != nil {
+		fp.TlsLn.Close()
+	}
+	fp.stopAdminApi()
+	fp.stopMetrics()
 }
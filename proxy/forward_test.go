@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/auth"
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/metrics"
+	"github.com/angrybayblade/tunnel/proxy/mux"
+)
+
+func newTestForwardProxy() *ForwardProxy {
+	return &ForwardProxy{
+		Logger:       testLogger,
+		sessions:     NewSessionRegistry(),
+		auth:         auth.NewDefaultSession(DUMMY_KEY),
+		failures:     metrics.NewCounterVec("reason"),
+		authFailures: metrics.NewCounterVec("kind"),
+		mut:          &sync.Mutex{},
+		lastUse:      make(map[string]time.Time),
+	}
+}
+
+// Send the request to the handler and read its response, if any
+func testProxyRequest(t *testing.T, handler func(*headers.ProxyFrame, net.Conn), request *headers.ProxyFrame) *headers.ProxyFrame {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go handler(request, conn)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := &headers.ProxyFrame{}
+	if response.Read(peer) != nil {
+		return nil
+	}
+	return response
+}
+
+// Sessions keyed by a subdomain can only be joined and deleted with their
+// resume token, keys derived from the token are secret on their own
+func TestSessionOwnership(t *testing.T) {
+	tests := []struct {
+		name   string
+		public bool
+		resume string
+		ok     bool
+	}{
+		{"subdomain with resume token", true, "resume-token", true},
+		{"subdomain without resume token", true, "", false},
+		{"subdomain with wrong resume token", true, "other", false},
+		{"secret key", false, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fp := newTestForwardProxy()
+			session := NewSession("myapp", testLogger, 0, time.Second)
+			session.resumeToken = "resume-token"
+			session.public = test.public
+			fp.sessions.Add(session)
+
+			response := testProxyRequest(t, fp.handleJoin, &headers.ProxyFrame{
+				Version: headers.ProxyHeaderV2,
+				Code:    headers.RequestJoinPool,
+				Key:     "myapp",
+				Payload: headers.MarshalPayload(headers.JoinPoolRequest{ID: "1", Resume: test.resume}),
+			})
+			if response == nil || (response.Code == headers.ResponseSuccess) != test.ok {
+				t.Errorf("join answered %v, want success %v", response, test.ok)
+			}
+			if joined := session.Connected() == 1; joined != test.ok {
+				t.Errorf("connection joined %v, want %v", joined, test.ok)
+			}
+
+			testProxyRequest(t, fp.handleDelete, &headers.ProxyFrame{
+				Version: headers.ProxyHeaderV2,
+				Code:    headers.RequestDeletePool,
+				Key:     "myapp",
+				Payload: headers.MarshalPayload(headers.DeletePoolRequest{Resume: test.resume}),
+			})
+			if deleted := session.State() == SessionClosed; deleted != test.ok {
+				t.Errorf("session deleted %v, want %v", deleted, test.ok)
+			}
+			if (fp.sessions.Lookup("myapp") == nil) != test.ok {
+				t.Errorf("session still registered after delete %v", test.ok)
+			}
+		})
+	}
+}
+
+// A client with an invalid token gets the auth error and a closed connection
+func TestCreateInvalidToken(t *testing.T) {
+	fp := newTestForwardProxy()
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go fp.handleCreate(&headers.ProxyFrame{
+		Version: headers.ProxyHeaderV2,
+		Code:    headers.RequestCreatePool,
+		Key:     "invalid-token",
+	}, conn)
+
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := &headers.ProxyFrame{}
+	if err := response.Read(peer); err != nil || response.Code != headers.ResponseAuthError {
+		t.Fatalf("create answered %v with error %v, want an auth error", response, err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read error %v, want the connection closed", err)
+	}
+	if fp.sessions.Lookup(sessionKeyFor("invalid-token", headers.TunnelProtocolHttp, "")) != nil {
+		t.Error("session created with an invalid token")
+	}
+}
+
+// Listeners opened before a later step of the setup fails are closed again
+func TestSetupFailureClosesListeners(t *testing.T) {
+	certFile, keyFile := newTestCertificate(t, "web.tunnel.test", nil).writeKeyPair(t)
+
+	listeners := map[string]net.Listener{}
+	for _, name := range []string{ListenerHttp, ListenerHttps} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		listeners[name] = ln
+	}
+	fp := &ForwardProxy{
+		Logger:    testLogger,
+		Inherited: map[string]net.Listener{ListenerHttp: listeners[ListenerHttp], ListenerHttps: listeners[ListenerHttps]},
+		Tls:       &TlsConfig{CertFile: certFile, KeyFile: keyFile},
+		Uima:      true,
+		// A directory can't be read as the admin key
+		AdminKeyFile: t.TempDir(),
+	}
+	if err := fp.Setup(); err == nil {
+		t.Fatal("setup succeeded with an unreadable admin key")
+	}
+	for name, ln := range listeners {
+		// An open listener times out right away instead of blocking
+		ln.(*net.TCPListener).SetDeadline(time.Now())
+		if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("%s listener accepted with error %v, want it closed", name, err)
+		}
+	}
+}
+
+// Open a multiplexed tunnel, the client end of the control connection stays
+// open until the test closes it
+func createTestTunnel(t *testing.T, fp *ForwardProxy, token string, create headers.CreatePoolRequest) (*headers.ProxyFrame, headers.CreatePoolResponse, *mux.Session) {
+	create.Multiplex = true
+	conn, peer := net.Pipe()
+	go fp.handleCreate(&headers.ProxyFrame{
+		Version: headers.ProxyHeaderV2,
+		Code:    headers.RequestCreatePool,
+		Key:     token,
+		Payload: headers.MarshalPayload(create),
+	}, conn)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := &headers.ProxyFrame{}
+	if err := response.Read(peer); err != nil {
+		t.Fatal(err)
+	}
+	peer.SetReadDeadline(time.Time{})
+	created := headers.CreatePoolResponse{}
+	if response.Code != headers.ResponseSuccess {
+		peer.Close()
+		return response, created, nil
+	}
+	if err := response.Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	client := mux.Client(peer)
+	t.Cleanup(func() { client.Close() })
+	return response, created, client
+}
+
+func waitSessionState(session *Session, state SessionState) bool {
+	deadline := time.Now().Add(2 * time.Second)
+	for session.State() != state && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return session.State() == state
+}
+
+// A tunnel whose control connection went away can be taken over with its
+// resume token by the same owner until the grace period is over
+func TestSessionResume(t *testing.T) {
+	tests := []struct {
+		name    string
+		wait    time.Duration
+		other   bool
+		code    headers.ProxyCode
+		resumed bool
+	}{
+		{"within the grace period", 0, false, headers.ResponseSuccess, true},
+		{"after the grace period", 400 * time.Millisecond, false, headers.ResponseSuccess, false},
+		{"by another owner", 0, true, headers.ResponseForbidden, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fp := newTestForwardProxy()
+			fp.ResumeGrace = 200 * time.Millisecond
+			fp.auth = auth.NewInMemorySession(nil)
+			owner, _, _ := fp.auth.GenerateKey(auth.TokenInfo{})
+			other, _, _ := fp.auth.GenerateKey(auth.TokenInfo{})
+
+			_, created, client := createTestTunnel(t, fp, owner, headers.CreatePoolRequest{Subdomain: "myapp"})
+			if client == nil {
+				t.Fatal("tunnel was not created")
+			}
+			session := fp.sessions.Get("myapp")
+			client.Close()
+			if !waitSessionState(session, SessionOffline) {
+				t.Fatalf("session %s after the control connection closed", session.State())
+			}
+			time.Sleep(test.wait)
+
+			token := owner
+			if test.other {
+				token = other
+			}
+			response, resumed, _ := createTestTunnel(t, fp, token, headers.CreatePoolRequest{Subdomain: "myapp", Resume: created.Resume})
+			if response.Code != test.code || resumed.Resumed != test.resumed {
+				t.Fatalf("create answered %d resumed %v, want %d and %v", response.Code, resumed.Resumed, test.code, test.resumed)
+			}
+			current := fp.sessions.Get("myapp")
+			// The session is handed over right after the response
+			if test.resumed && (current != session || !waitSessionState(session, SessionActive)) {
+				t.Errorf("session %s was not taken over", session.State())
+			}
+			if !test.resumed && test.code == headers.ResponseSuccess && (current == session || resumed.Resume == created.Resume) {
+				t.Error("expired session was resumed")
+			}
+			if test.other && (current != session || session.State() != SessionOffline) {
+				t.Errorf("session of the owner is %s after another owner tried to resume it", session.State())
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package headers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// How the length of a message body is determined, see RFC 9112 section 6.3
+type BodyFraming int
+
+const BodyNone BodyFraming = 0
+const BodyContentLength BodyFraming = 1
+const BodyChunked BodyFraming = 2
+const BodyUntilClose BodyFraming = 3
+
+func isChunked(transferEncoding string) (bool, error) {
+	if transferEncoding == "" {
+		return false, nil
+	}
+	codings := strings.Split(transferEncoding, ",")
+	if !strings.EqualFold(strings.TrimSpace(codings[len(codings)-1]), "chunked") {
+		return false, ErrUnsupportedTransferEncoding
+	}
+	return true, nil
+}
+
+func contentLength(value string) (int64, error) {
+	length, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || length < 0 {
+		return 0, fmt.Errorf("Invalid content length: %q", value)
+	}
+	return length, nil
+}
+
+// Framing of a request body, requests without a length have no body
+func (hreq *HttpRequestHeader) BodyFraming() (BodyFraming, int64, error) {
+	chunked, err := isChunked(hreq.Get("Transfer-Encoding"))
+	if err != nil {
+		return BodyNone, 0, err
+	}
+	if chunked {
+		return BodyChunked, 0, nil
+	}
+	if value := hreq.Get("Content-Length"); value != "" {
+		length, err := contentLength(value)
+		if err != nil {
+			return BodyNone, 0, err
+		}
+		return BodyContentLength, length, nil
+	}
+	return BodyNone, 0, nil
+}
+
+// Framing of a response body, which also depends on the request it answers
+func (hres *HttpResponseHeader) BodyFraming(request *HttpRequestHeader) (BodyFraming, int64, error) {
+	if request.Method == http.MethodHead ||
+		(hres.StatusCode >= 100 && hres.StatusCode < 200) ||
+		hres.StatusCode == http.StatusNoContent ||
+		hres.StatusCode == http.StatusNotModified {
+		return BodyNone, 0, nil
+	}
+	if request.Method == http.MethodConnect && hres.StatusCode >= 200 && hres.StatusCode < 300 {
+		return BodyNone, 0, nil
+	}
+	if hres.Get("Transfer-Encoding") != "" {
+		chunked, _ := isChunked(hres.Get("Transfer-Encoding"))
+		if chunked {
+			return BodyChunked, 0, nil
+		}
+		return BodyUntilClose, 0, nil
+	}
+	if value := hres.Get("Content-Length"); value != "" {
+		length, err := contentLength(value)
+		if err != nil {
+			return BodyNone, 0, err
+		}
+		return BodyContentLength, length, nil
+	}
+	return BodyUntilClose, 0, nil
+}
+
+// Copy a message body as is, chunked bodies keep their chunk headers,
+// extensions and trailers
+func CopyBody(dst io.Writer, src *bufio.Reader, framing BodyFraming, length int64) (int64, error) {
+	switch framing {
+	case BodyContentLength:
+		return io.CopyN(dst, src, length)
+	case BodyChunked:
+		return copyChunked(dst, src)
+	case BodyUntilClose:
+		return io.Copy(dst, src)
+	}
+	return 0, nil
+}
+
+func readChunkLine(src *bufio.Reader) ([]byte, error) {
+	line, err := src.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrHeaderLineTooLong
+	}
+	if err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+func copyChunked(dst io.Writer, src *bufio.Reader) (int64, error) {
+	var written int64
+	for {
+		line, err := readChunkLine(src)
+		if err != nil {
+			return written, err
+		}
+		sizeField := bytes.TrimSpace(line)
+		if idx := bytes.IndexByte(sizeField, ';'); idx >= 0 {
+			sizeField = bytes.TrimSpace(sizeField[:idx])
+		}
+		size, err := strconv.ParseInt(string(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			return written, ErrInvalidChunkSize
+		}
+		n, err := dst.Write(line)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+
+		if size == 0 {
+			// Trailer fields end with an empty line
+			for {
+				line, err = readChunkLine(src)
+				if err != nil {
+					return written, err
+				}
+				n, err = dst.Write(line)
+				written += int64(n)
+				if err != nil {
+					return written, err
+				}
+				if len(bytes.TrimSpace(line)) == 0 {
+					return written, nil
+				}
+			}
+		}
+
+		// Chunk data is followed by CRLF
+		copied, err := io.CopyN(dst, src, size+int64(HttpHeaderLineSeparatorLen))
+		written += copied
+		if err != nil {
+			return written, err
+		}
+	}
+}
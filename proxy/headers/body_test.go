@@ -0,0 +1,203 @@
+package headers
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRequestBodyFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		framing BodyFraming
+		length  int64
+		valid   bool
+	}{
+		{"no body", nil, BodyNone, 0, true},
+		{"content length", map[string]string{"Content-Length": "12"}, BodyContentLength, 12, true},
+		{"lower case content length", map[string]string{"content-length": " 3 "}, BodyContentLength, 3, true},
+		{"chunked", map[string]string{"Transfer-Encoding": "chunked"}, BodyChunked, 0, true},
+		{"chunked wins over length", map[string]string{"Transfer-Encoding": "gzip, chunked", "Content-Length": "5"}, BodyChunked, 0, true},
+		{"chunked not last", map[string]string{"Transfer-Encoding": "chunked, gzip"}, BodyNone, 0, false},
+		{"negative length", map[string]string{"Content-Length": "-1"}, BodyNone, 0, false},
+		{"invalid length", map[string]string{"Content-Length": "ten"}, BodyNone, 0, false},
+	}
+	for _, test := range tests {
+		request := &HttpRequestHeader{Method: "POST", Path: "/", Protocol: "HTTP/1.1", Headers: test.headers}
+		framing, length, err := request.BodyFraming()
+		if (err == nil) != test.valid || framing != test.framing || length != test.length {
+			t.Errorf("%s: framing %d length %d error %v", test.name, framing, length, err)
+		}
+	}
+}
+
+func TestResponseBodyFraming(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		status  int
+		headers map[string]string
+		framing BodyFraming
+		length  int64
+	}{
+		{"content length", "GET", 200, map[string]string{"Content-Length": "5"}, BodyContentLength, 5},
+		{"chunked", "GET", 200, map[string]string{"Transfer-Encoding": "chunked"}, BodyChunked, 0},
+		{"other encoding", "GET", 200, map[string]string{"Transfer-Encoding": "gzip"}, BodyUntilClose, 0},
+		{"no length", "GET", 200, nil, BodyUntilClose, 0},
+		{"head", "HEAD", 200, map[string]string{"Content-Length": "5"}, BodyNone, 0},
+		{"continue", "POST", 100, nil, BodyNone, 0},
+		{"no content", "DELETE", 204, nil, BodyNone, 0},
+		{"not modified", "GET", 304, map[string]string{"Content-Length": "5"}, BodyNone, 0},
+		{"connect", "CONNECT", 200, nil, BodyNone, 0},
+		{"failed connect", "CONNECT", 403, map[string]string{"Content-Length": "5"}, BodyContentLength, 5},
+	}
+	for _, test := range tests {
+		request := &HttpRequestHeader{Method: test.method, Path: "/", Protocol: "HTTP/1.1"}
+		response := &HttpResponseHeader{Protocol: "HTTP/1.1", StatusCode: test.status, Headers: test.headers}
+		framing, length, err := response.BodyFraming(request)
+		if err != nil || framing != test.framing || length != test.length {
+			t.Errorf("%s: framing %d length %d error %v", test.name, framing, length, err)
+		}
+	}
+}
+
+func TestCopyBody(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		framing BodyFraming
+		length  int64
+		body    string
+		err     error
+	}{
+		{"content length", "hello world", BodyContentLength, 5, "hello", nil},
+		{"empty", "next", BodyNone, 0, "", nil},
+		{"until close", "hello world", BodyUntilClose, 0, "hello world", nil},
+		{"short content", "hel", BodyContentLength, 5, "hel", io.EOF},
+		{
+			name:    "chunked",
+			data:    "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\nnext",
+			framing: BodyChunked,
+			body:    "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n",
+		},
+		{
+			name:    "chunk extensions and trailers",
+			data:    "A;name=value\r\n0123456789\r\n0\r\nChecksum: abc\r\nExpires: never\r\n\r\nnext",
+			framing: BodyChunked,
+			body:    "A;name=value\r\n0123456789\r\n0\r\nChecksum: abc\r\nExpires: never\r\n\r\n",
+		},
+		{
+			name:    "invalid chunk size",
+			data:    "zz\r\nhello\r\n0\r\n\r\n",
+			framing: BodyChunked,
+			err:     ErrInvalidChunkSize,
+		},
+		{
+			name:    "truncated chunk",
+			data:    "5\r\nhel",
+			framing: BodyChunked,
+			body:    "5\r\nhel",
+			err:     io.EOF,
+		},
+		{
+			name:    "missing last chunk",
+			data:    "5\r\nhello\r\n",
+			framing: BodyChunked,
+			body:    "5\r\nhello\r\n",
+			err:     io.EOF,
+		},
+	}
+	for _, test := range tests {
+		src := bufio.NewReader(strings.NewReader(test.data))
+		dst := &bytes.Buffer{}
+		written, err := CopyBody(dst, src, test.framing, test.length)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if dst.String() != test.body || written != int64(len(test.body)) {
+			t.Errorf("%s: copied %d bytes %q, want %q", test.name, written, dst.String(), test.body)
+		}
+		if test.err == nil && test.framing != BodyUntilClose {
+			rest, _ := io.ReadAll(src)
+			if want := test.data[len(test.body):]; string(rest) != want {
+				t.Errorf("%s: left %q on the connection, want %q", test.name, rest, want)
+			}
+		}
+	}
+}
+
+// Pipelined requests are read one after the other from the same connection,
+// each body ends exactly where the next request starts
+func TestPipelinedRequests(t *testing.T) {
+	data := "POST /upload HTTP/1.1\r\nHost: web\r\nTransfer-Encoding: chunked\r\nExpect: 100-continue\r\n\r\n" +
+		"3\r\nabc\r\n0\r\nTrailer: yes\r\n\r\n" +
+		"PUT /item HTTP/1.1\r\nHost: web\r\nContent-Length: 4\r\n\r\n" +
+		"data" +
+		"GET /last HTTP/1.0\r\nConnection: keep-alive\r\n\r\n" +
+		"GET /close HTTP/1.1\r\nConnection: close\r\n\r\n"
+	tests := []struct {
+		method    string
+		path      string
+		body      string
+		expect    bool
+		keepAlive bool
+	}{
+		{"POST", "/upload", "3\r\nabc\r\n0\r\nTrailer: yes\r\n\r\n", true, true},
+		{"PUT", "/item", "data", false, true},
+		{"GET", "/last", "", false, true},
+		{"GET", "/close", "", false, false},
+	}
+
+	conn := bufio.NewReader(strings.NewReader(data))
+	for _, test := range tests {
+		request := &HttpRequestHeader{}
+		if err := request.Read(conn); err != nil {
+			t.Fatalf("%s %s: %v", test.method, test.path, err)
+		}
+		if request.Method != test.method || request.Path != test.path {
+			t.Fatalf("read %s %s, want %s %s", request.Method, request.Path, test.method, test.path)
+		}
+		if request.ExpectContinue() != test.expect || request.KeepAlive() != test.keepAlive {
+			t.Errorf("%s: expect continue %v keep alive %v", test.path, request.ExpectContinue(), request.KeepAlive())
+		}
+		framing, length, err := request.BodyFraming()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := &bytes.Buffer{}
+		if _, err := CopyBody(body, conn, framing, length); err != nil {
+			t.Fatal(err)
+		}
+		if body.String() != test.body {
+			t.Errorf("%s: body %q, want %q", test.path, body.String(), test.body)
+		}
+	}
+	if _, err := conn.ReadByte(); err != io.EOF {
+		t.Errorf("data left after the last request")
+	}
+}
+
+func TestResponseKeepAlive(t *testing.T) {
+	tests := []struct {
+		protocol   string
+		connection string
+		keepAlive  bool
+	}{
+		{"HTTP/1.1", "", true},
+		{"HTTP/1.1", "close", false},
+		{"HTTP/1.1", "Keep-Alive, Close", false},
+		{"HTTP/1.0", "", false},
+		{"HTTP/1.0", "keep-alive", true},
+	}
+	for _, test := range tests {
+		response := &HttpResponseHeader{Protocol: test.protocol, StatusCode: 200, Headers: map[string]string{"Connection": test.connection}}
+		if response.KeepAlive() != test.keepAlive {
+			t.Errorf("%s with Connection %q: keep alive %v", test.protocol, test.connection, response.KeepAlive())
+		}
+	}
+}
@@ -6,3 +6,11 @@ import (
 
 var ErrIncompleteHeaderLine = errors.New("Could not read the header line")
 var ErrInvalidHeaderStart = errors.New("Invalid header start")
+var ErrHeaderLineTooLong = errors.New("Header line is too long")
+var ErrInvalidChunkSize = errors.New("Invalid chunk size")
+var ErrUnsupportedTransferEncoding = errors.New("Unsupported transfer encoding")
+var ErrUnsupportedFrameVersion = errors.New("Unsupported proxy frame version")
+var ErrUnknownRequestCode = errors.New("Unknown proxy request code")
+var ErrFrameKeyTooLarge = errors.New("Proxy frame key is too large")
+var ErrFramePayloadTooLarge = errors.New("Proxy frame payload is too large")
+var ErrEmptyFramePayload = errors.New("Proxy frame payload is empty")
@@ -0,0 +1,403 @@
+package headers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Proxy header v2
+// ________________________________________________________________
+// | VERSION | CODE | KEY_LENGTH | KEY | PAYLOAD_LENGTH | PAYLOAD |
+// ----------------------------------------------------------------
+//
+// VERSION : 1 byte
+// CODE : 1 byte
+// KEY_LENGTH : 2 bytes, big endian
+// KEY : KEY_LENGTH bytes
+// PAYLOAD_LENGTH : 4 bytes, big endian
+// PAYLOAD : PAYLOAD_LENGTH bytes
+//
+// The version byte is never a printable character, which lets the forward
+// proxy tell a v2 frame apart from a v1 header or an HTTP request by looking
+// at the first byte of a connection.
+
+const ProxyHeaderV1 uint8 = 1
+const ProxyHeaderV2 uint8 = 2
+
+const FrameKeyLengthLen int = 2
+const FramePayloadLengthLen int = 4
+const MaxFrameKeyLen int = 1<<16 - 1
+const MaxFramePayloadLen int = 16 << 20
+
+type ProxyCode uint8
+
+// Proxy frame request codes
+const RequestCreatePool ProxyCode = 0x01
+const RequestJoinPool ProxyCode = 0x02
+const RequestDeletePool ProxyCode = 0x03
+const RequestGenerateKey ProxyCode = 0x04
+const RequestRevokeKey ProxyCode = 0x05
+const RequestListKeys ProxyCode = 0x06
+const RequestDomain ProxyCode = 0x07
+
+// Sent by the forward proxy on idle pooled connections, answered with a pong
+const RequestPing ProxyCode = 0x08
+
+// Proxy frame response codes
+const ResponseSuccess ProxyCode = 0x80
+const ResponseAuthError ProxyCode = 0x81
+const ResponseNotInUimaMode ProxyCode = 0x82
+const ResponseMaxConnectionsLimitReached ProxyCode = 0x83
+const ResponseKeyLimitReached ProxyCode = 0x84
+const ResponseInvalidRequest ProxyCode = 0x85
+const ResponseKeyNotFound ProxyCode = 0x86
+const ResponseTunnelUnavailable ProxyCode = 0x87
+const ResponseForbidden ProxyCode = 0x88
+const ResponsePong ProxyCode = 0x89
+
+// Tunnel protocols
+const TunnelProtocolHttp string = "http"
+const TunnelProtocolTcp string = "tcp"
+const TunnelProtocolUdp string = "udp"
+
+var proxyCodeNames = map[ProxyCode]string{
+	RequestCreatePool:                  "CREATE",
+	RequestJoinPool:                    "JOIN",
+	RequestDeletePool:                  "DELETE",
+	RequestGenerateKey:                 "GENERATE",
+	RequestRevokeKey:                   "REVOKE",
+	RequestListKeys:                    "LIST",
+	RequestDomain:                      "DOMAIN",
+	RequestPing:                        "PING",
+	ResponseSuccess:                    "SUCCESS",
+	ResponseAuthError:                  "AUTH_ERROR",
+	ResponseNotInUimaMode:              "NOT_IN_UIMA_MODE",
+	ResponseMaxConnectionsLimitReached: "MAX_CONNECTIONS_LIMIT_REACHED",
+	ResponseKeyLimitReached:            "KEY_LIMIT_REACHED",
+	ResponseInvalidRequest:             "INVALID_REQUEST",
+	ResponseKeyNotFound:                "KEY_NOT_FOUND",
+	ResponseTunnelUnavailable:          "TUNNEL_UNAVAILABLE",
+	ResponseForbidden:                  "FORBIDDEN",
+	ResponsePong:                       "PONG",
+}
+
+func (c ProxyCode) IsRequest() bool {
+	return c < ResponseSuccess
+}
+
+func (c ProxyCode) String() string {
+	name, ok := proxyCodeNames[c]
+	if !ok {
+		return fmt.Sprintf("UNKNOWN(0x%02x)", uint8(c))
+	}
+	return name
+}
+
+// Payload of a v2 frame, encoded as JSON
+type ErrorPayload struct {
+	Error string `json:"error"`
+}
+
+type CreatePoolRequest struct {
+	Multiplex bool   `json:"multiplex"`
+	Protocol  string `json:"protocol,omitempty"`
+	Subdomain string `json:"subdomain,omitempty"`
+	// Resume token of the session to take over after a reconnect
+	Resume string `json:"resume,omitempty"`
+}
+
+type CreatePoolResponse struct {
+	Session   string `json:"session"`
+	Multiplex bool   `json:"multiplex"`
+	Protocol  string `json:"protocol,omitempty"`
+	Port      int    `json:"port,omitempty"`
+	Scheme    string `json:"scheme,omitempty"`
+	// Token to resume the session with after a reconnect
+	Resume  string `json:"resume,omitempty"`
+	Resumed bool   `json:"resumed,omitempty"`
+}
+
+type JoinPoolRequest struct {
+	ID string `json:"id"`
+	// The client answers pings while the connection is idle
+	Heartbeat bool `json:"heartbeat,omitempty"`
+	// Resume token of the session, required for sessions keyed by a
+	// subdomain
+	Resume string `json:"resume,omitempty"`
+}
+
+type DeletePoolRequest struct {
+	Resume string `json:"resume,omitempty"`
+}
+
+type JoinPoolResponse struct {
+	// Interval of the pings in milliseconds, the proxy does not ping if zero
+	Heartbeat int64 `json:"heartbeat,omitempty"`
+}
+
+type GenerateKeyResponse struct {
+	ID  int    `json:"id"`
+	Key string `json:"key"`
+	// Unix time the key expires at, zero if it never expires
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Admin requests are signed by the admin key, the signature covers the
+// request code and the payload with its timestamp and nonce. It is sent
+// base64 encoded as the frame key.
+type AdminRequest struct {
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+}
+
+func NewAdminRequest() AdminRequest {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return AdminRequest{
+		Timestamp: time.Now().Unix(),
+		Nonce:     base64.RawURLEncoding.EncodeToString(nonce),
+	}
+}
+
+// Message the signature of an admin request is computed over
+func AdminMessage(code ProxyCode, payload []byte) []byte {
+	message := make([]byte, 0, len(adminMessagePrefix)+1+len(payload))
+	message = append(message, adminMessagePrefix...)
+	message = append(message, byte(code))
+	return append(message, payload...)
+}
+
+const adminMessagePrefix string = "tunnel-admin\n"
+
+type GenerateKeyRequest struct {
+	AdminRequest
+	// Lifetime of the key in seconds, the key never expires if zero
+	TTL         int64    `json:"ttl,omitempty"`
+	Label       string   `json:"label,omitempty"`
+	Subdomains  []string `json:"subdomains,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+	AllowTcp    bool     `json:"allow_tcp,omitempty"`
+	Reserved    []string `json:"reserved,omitempty"`
+}
+
+type RevokeKeyRequest struct {
+	AdminRequest
+	ID int `json:"id"`
+}
+
+type RevokeKeyResponse struct {
+	ID  int    `json:"id"`
+	Key string `json:"key"`
+}
+
+type ListKeysRequest struct {
+	AdminRequest
+}
+
+// Issued token as listed to admins, the token itself is masked and times
+// are unix seconds, zero if not set
+type KeyInfo struct {
+	ID          int      `json:"id"`
+	Label       string   `json:"label,omitempty"`
+	Key         string   `json:"key"`
+	Created     int64    `json:"created"`
+	Expires     int64    `json:"expires,omitempty"`
+	LastUsed    int64    `json:"last_used,omitempty"`
+	Sessions    int      `json:"sessions"`
+	Subdomains  []string `json:"subdomains,omitempty"`
+	Reserved    []string `json:"reserved,omitempty"`
+	MaxSessions int      `json:"max_sessions,omitempty"`
+	AllowTcp    bool     `json:"allow_tcp,omitempty"`
+}
+
+type ListKeysResponse struct {
+	Keys []KeyInfo `json:"keys"`
+}
+
+// Point a custom domain at a subdomain of the token, or remove it
+type DomainRequest struct {
+	Domain    string `json:"domain"`
+	Subdomain string `json:"subdomain,omitempty"`
+	Remove    bool   `json:"remove,omitempty"`
+}
+
+// The challenge has to be published in the TXT record before the domain is
+// routed
+type DomainResponse struct {
+	Domain    string `json:"domain"`
+	Subdomain string `json:"subdomain,omitempty"`
+	Verified  bool   `json:"verified"`
+	Challenge string `json:"challenge,omitempty"`
+	TxtRecord string `json:"txt_record,omitempty"`
+}
+
+func MarshalPayload(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func MarshalError(err error) []byte {
+	return MarshalPayload(ErrorPayload{Error: err.Error()})
+}
+
+type ProxyFrame struct {
+	Version uint8
+	Code    ProxyCode
+	Key     string
+	Payload []byte
+}
+
+// Build a response frame which will be written using the same protocol
+// version as the request
+func (pf *ProxyFrame) Response(code ProxyCode, key string, payload []byte) *ProxyFrame {
+	return &ProxyFrame{
+		Version: pf.Version,
+		Code:    code,
+		Key:     key,
+		Payload: payload,
+	}
+}
+
+func (pf *ProxyFrame) Decode(v any) error {
+	if len(pf.Payload) == 0 {
+		return ErrEmptyFramePayload
+	}
+	return json.Unmarshal(pf.Payload, v)
+}
+
+// Error message carried by an error response, if any
+func (pf *ProxyFrame) Err() error {
+	if pf.Code == ResponseSuccess || pf.Code.IsRequest() {
+		return nil
+	}
+	payload := ErrorPayload{}
+	if pf.Decode(&payload) != nil || payload.Error == "" {
+		return errors.New(pf.Code.String())
+	}
+	return errors.New(payload.Error)
+}
+
+func (pf *ProxyFrame) Build() ([]byte, error) {
+	if len(pf.Key) > MaxFrameKeyLen {
+		return nil, ErrFrameKeyTooLarge
+	}
+	if len(pf.Payload) > MaxFramePayloadLen {
+		return nil, ErrFramePayloadTooLarge
+	}
+	buffer := make([]byte, 2+FrameKeyLengthLen, 2+FrameKeyLengthLen+len(pf.Key)+FramePayloadLengthLen+len(pf.Payload))
+	buffer[0] = ProxyHeaderV2
+	buffer[1] = byte(pf.Code)
+	binary.BigEndian.PutUint16(buffer[2:], uint16(len(pf.Key)))
+	buffer = append(buffer, pf.Key...)
+	buffer = binary.BigEndian.AppendUint32(buffer, uint32(len(pf.Payload)))
+	buffer = append(buffer, pf.Payload...)
+	return buffer, nil
+}
+
+func (pf *ProxyFrame) Read(conn io.Reader) error {
+	version := make([]byte, 1)
+	_, err := io.ReadFull(conn, version)
+	if err != nil {
+		return err
+	}
+	return pf.ReadPartial(conn, version)
+}
+
+// Read the rest of the frame when the version byte has already been
+// consumed from the connection
+func (pf *ProxyFrame) ReadPartial(conn io.Reader, initialBuffer []byte) error {
+	if len(initialBuffer) != 1 || initialBuffer[0] != ProxyHeaderV2 {
+		return ErrUnsupportedFrameVersion
+	}
+
+	header := make([]byte, 1+FrameKeyLengthLen)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	key := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	_, err = io.ReadFull(conn, key)
+	if err != nil {
+		return err
+	}
+
+	payloadLen := make([]byte, FramePayloadLengthLen)
+	_, err = io.ReadFull(conn, payloadLen)
+	if err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(payloadLen)
+	if size > uint32(MaxFramePayloadLen) {
+		return ErrFramePayloadTooLarge
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		return err
+	}
+
+	pf.Version = ProxyHeaderV2
+	pf.Code = ProxyCode(header[0])
+	pf.Key = string(key)
+	pf.Payload = payload
+	return nil
+}
+
+// Write the frame using the protocol version it carries, v1 frames are
+// written as a fixed size ProxyHeader
+func (pf *ProxyFrame) Write(conn io.Writer) (int, error) {
+	if pf.Version == ProxyHeaderV1 {
+		return conn.Write(pf.ProxyHeader().Build())
+	}
+	buffer, err := pf.Build()
+	if err != nil {
+		return 0, err
+	}
+	return conn.Write(buffer)
+}
+
+// Convert the frame to a v1 header; the payload is only kept if it fits in
+// the v1 message field
+func (pf *ProxyFrame) ProxyHeader() *ProxyHeader {
+	code, ok := proxyCodesV1[pf.Code]
+	if !ok {
+		code = ProxyResponseAuthError
+	}
+	header := &ProxyHeader{
+		Code: code,
+		Key:  pf.Key,
+	}
+	if len(pf.Payload) <= MessageLen {
+		header.Message = string(pf.Payload)
+	}
+	return header
+}
+
+func FrameFromProxyHeader(ph *ProxyHeader) (*ProxyFrame, error) {
+	code, ok := proxyRequestCodesV1[ph.Code]
+	if !ok {
+		return nil, fmt.Errorf("%w; %q", ErrUnknownRequestCode, ph.Code)
+	}
+	return &ProxyFrame{
+		Version: ProxyHeaderV1,
+		Code:    code,
+		Key:     strings.TrimRight(ph.Key, "\x00"),
+		Payload: bytes.TrimRight([]byte(ph.Message), "\x00"),
+	}, nil
+}
+
+func IsProxyRequestV1(code string) bool {
+	_, ok := proxyRequestCodesV1[code]
+	return ok
+}
@@ -0,0 +1,141 @@
+package headers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestProxyHeaderShortKey(t *testing.T) {
+	for _, key := range []string{"", "myapp", "a-subdomain-which-fills-the-whole-key-field"[:SessionKeyLen]} {
+		response := &ProxyFrame{Version: ProxyHeaderV1, Code: ResponseSuccess, Key: key, Payload: []byte("id")}
+		data := response.ProxyHeader().Build()
+		if len(data) != StatusHeaderLen {
+			t.Fatalf("v1 header of %d bytes, want %d", len(data), StatusHeaderLen)
+		}
+		header := &ProxyHeader{}
+		header.Parse([StatusHeaderLen]byte(data))
+		if header.Message[:2] != "id" {
+			t.Errorf("message moved with key %q; %q", key, header.Message)
+		}
+
+		// v1 clients send the key back as they got it, padding included
+		header.Code = ProxyRequestJoinPool
+		frame, err := FrameFromProxyHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Key != key || !bytes.Equal(frame.Payload, []byte("id")) {
+			t.Errorf("frame key %q payload %q, want %q and %q", frame.Key, frame.Payload, key, "id")
+		}
+	}
+}
+
+func TestProxyFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame ProxyFrame
+	}{
+		{"empty", ProxyFrame{Code: RequestDeletePool}},
+		{"key", ProxyFrame{Code: RequestJoinPool, Key: "session-key"}},
+		{"json payload", ProxyFrame{Code: RequestJoinPool, Key: "key", Payload: MarshalPayload(JoinPoolRequest{ID: "conn-1"})}},
+		{"binary payload", ProxyFrame{Code: ResponseSuccess, Payload: []byte{0, 1, 0, 0xff}}},
+		{"largest key", ProxyFrame{Code: ResponseAuthError, Key: strings.Repeat("k", MaxFrameKeyLen)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buffer := &bytes.Buffer{}
+			if _, err := test.frame.Write(buffer); err != nil {
+				t.Fatal(err)
+			}
+			if buffer.Bytes()[0] != ProxyHeaderV2 {
+				t.Fatalf("frame starts with version %d", buffer.Bytes()[0])
+			}
+			frame := &ProxyFrame{}
+			if err := frame.Read(buffer); err != nil {
+				t.Fatal(err)
+			}
+			if frame.Version != ProxyHeaderV2 || frame.Code != test.frame.Code || frame.Key != test.frame.Key || !bytes.Equal(frame.Payload, test.frame.Payload) {
+				t.Errorf("read %+v, want %+v", frame, test.frame)
+			}
+			if buffer.Len() != 0 {
+				t.Errorf("%d bytes left after the frame", buffer.Len())
+			}
+		})
+	}
+}
+
+func TestProxyFrameInvalid(t *testing.T) {
+	large := []byte{ProxyHeaderV2, byte(ResponseSuccess), 0, 0}
+	large = binary.BigEndian.AppendUint32(large, uint32(MaxFramePayloadLen+1))
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"v1 header", []byte("0" + strings.Repeat("\x00", StatusHeaderLen-1)), ErrUnsupportedFrameVersion},
+		{"payload too large", large, ErrFramePayloadTooLarge},
+		{"truncated key", []byte{ProxyHeaderV2, byte(RequestJoinPool), 0, 4, 'k'}, io.ErrUnexpectedEOF},
+		{"truncated payload", []byte{ProxyHeaderV2, byte(ResponseSuccess), 0, 0, 0, 0, 0, 2, '{'}, io.ErrUnexpectedEOF},
+		{"empty", nil, io.EOF},
+	}
+	for _, test := range tests {
+		frame := &ProxyFrame{}
+		if err := frame.Read(bytes.NewReader(test.data)); err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	frame := &ProxyFrame{Key: strings.Repeat("k", MaxFrameKeyLen+1)}
+	if _, err := frame.Build(); err != ErrFrameKeyTooLarge {
+		t.Errorf("build error %v, want %v", err, ErrFrameKeyTooLarge)
+	}
+}
+
+// Requests a v1 client can send survive the trip through the fixed size
+// header
+func TestProxyFrameV1RoundTrip(t *testing.T) {
+	key := strings.Repeat("k", SessionKeyLen)
+	tests := []struct {
+		code    ProxyCode
+		key     string
+		payload string
+	}{
+		{RequestCreatePool, "", ""},
+		{RequestJoinPool, key, "conn-1"},
+		{RequestDeletePool, key, ""},
+		{RequestGenerateKey, "", "uima"},
+		{RequestRevokeKey, "revoked", ""},
+	}
+	for _, test := range tests {
+		request := &ProxyFrame{Version: ProxyHeaderV1, Code: test.code, Key: test.key, Payload: []byte(test.payload)}
+		data := request.ProxyHeader().Build()
+		header := &ProxyHeader{}
+		header.Parse([StatusHeaderLen]byte(data))
+		frame, err := FrameFromProxyHeader(header)
+		if err != nil {
+			t.Fatalf("%s: %v", test.code, err)
+		}
+		if frame.Version != ProxyHeaderV1 || frame.Code != test.code || frame.Key != test.key || string(frame.Payload) != test.payload {
+			t.Errorf("%s: read %+v", test.code, frame)
+		}
+	}
+
+	// v1 responses only carry what fits in the message field
+	response := &ProxyFrame{Version: ProxyHeaderV1, Code: ResponseKeyLimitReached, Payload: []byte("too long for v1")}
+	header := response.ProxyHeader()
+	if header.Code != ProxyResponseUIMAError || header.Message != "" {
+		t.Errorf("v1 response %+v", header)
+	}
+	if header := (&ProxyFrame{Code: ResponseInvalidRequest}).ProxyHeader(); header.Code != ProxyResponseAuthError {
+		t.Errorf("v2 only response sent to v1 as %q", header.Code)
+	}
+
+	_, err := FrameFromProxyHeader(&ProxyHeader{Code: "9"})
+	if !errors.Is(err, ErrUnknownRequestCode) {
+		t.Errorf("error %v, want %v", err, ErrUnknownRequestCode)
+	}
+}
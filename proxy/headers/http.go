@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"net"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Header separators
@@ -27,7 +30,9 @@ var HeaderSplit string = ": "
 
 var DefaultHttpProtocolVersion string = "HTTP/1.1"
 
-func ReadHeaderLine(conn net.Conn) ([]byte, error) {
+const MaxHeaderLineLen int = 64 * 1024
+
+func ReadHeaderLine(conn io.Reader) ([]byte, error) {
 	var readSize int = 0
 	rBuffer := make([]byte, 1)
 	lineBytes := make([]byte, 0)
@@ -36,8 +41,14 @@ func ReadHeaderLine(conn net.Conn) ([]byte, error) {
 		if err != nil {
 			return lineBytes, ErrIncompleteHeaderLine
 		}
+		if n == 0 {
+			continue
+		}
 		lineBytes = append(lineBytes, rBuffer...)
 		readSize += n
+		if readSize > MaxHeaderLineLen {
+			return lineBytes, ErrHeaderLineTooLong
+		}
 		idx := readSize - HttpHeaderLineSeparatorLen
 		if idx < 0 {
 			continue
@@ -48,6 +59,56 @@ func ReadHeaderLine(conn net.Conn) ([]byte, error) {
 	}
 }
 
+// Read header fields until the empty line which ends the header block, the
+// raw lines are appended to the buffer
+func readHeaderFields(conn io.Reader, fields map[string]string, buffer []byte) ([]byte, error) {
+	for {
+		lineBytes, err := ReadHeaderLine(conn)
+		if err != nil {
+			return buffer, err
+		}
+		buffer = append(buffer, lineBytes...)
+		buffer = append(buffer, HttpHeaderLineSeparatorBytes...)
+		if len(lineBytes) == 0 {
+			return buffer, nil
+		}
+		headerSplit := bytes.SplitN(lineBytes, HeaderSplitBytes[:1], 2)
+		if len(headerSplit) <= 1 {
+			continue
+		}
+		name := string(headerSplit[0])
+		value := string(bytes.TrimSpace(headerSplit[1]))
+		if previous, ok := fields[name]; ok {
+			// Repeated fields are combined as a comma separated list
+			value = previous + ", " + value
+		}
+		fields[name] = value
+	}
+}
+
+// Case insensitive header field lookup
+func getHeader(fields map[string]string, name string) string {
+	if value, ok := fields[name]; ok {
+		return value
+	}
+	for k, v := range fields {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Check if a comma separated header field contains the token
+func hasToken(value string, token string) bool {
+	for _, part := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(part), token) {
+			return true
+		}
+	}
+	return false
+}
+
 type HttpRequestHeader struct {
 	Method   string
 	Path     string
@@ -66,7 +127,7 @@ func (hreq *HttpRequestHeader) Build() []byte {
 	return []byte(header)
 }
 
-func (hreq *HttpRequestHeader) Read(conn net.Conn) error {
+func (hreq *HttpRequestHeader) Read(conn io.Reader) error {
 	var err error
 	var lineBytes []byte
 
@@ -94,32 +155,38 @@ func (hreq *HttpRequestHeader) Read(conn net.Conn) error {
 	hreq.Path = string(headerSplit[1])
 	hreq.Protocol = string(headerSplit[2])
 
-	for {
-		lineBytes, err = ReadHeaderLine(conn)
-		if err != nil {
-			return err
-		}
-		headerSplit = bytes.SplitN(lineBytes, HeaderSplitBytes, 2)
-		hreq.Buffer = append(hreq.Buffer, lineBytes...)
-		hreq.Buffer = append(hreq.Buffer, HttpHeaderLineSeparatorBytes...)
-		if len(headerSplit) <= 1 {
-			break
-		}
-		hreq.Headers[string(headerSplit[0])] = string(headerSplit[1])
-	}
+	hreq.Buffer, err = readHeaderFields(conn, hreq.Headers, hreq.Buffer)
 	return err
 }
 
-func (hreq *HttpRequestHeader) Write(conn net.Conn) {
+func (hreq *HttpRequestHeader) Write(conn io.Writer) (int, error) {
 	if hreq.Buffer != nil {
-		conn.Write(hreq.Buffer)
-	} else {
-		conn.Write([]byte(hreq.Method + Whitespace + hreq.Path + Whitespace + hreq.Protocol + HttpHeaderLineSeparator))
-		for k, v := range hreq.Headers {
-			conn.Write([]byte(k + HeaderSplit + v + HttpHeaderLineSeparator))
-		}
-		conn.Write([]byte(HttpHeaderLineSeparator))
+		return conn.Write(hreq.Buffer)
+	}
+	return conn.Write(hreq.Build())
+}
+
+func (hreq *HttpRequestHeader) Get(name string) string {
+	return getHeader(hreq.Headers, name)
+}
+
+// HTTP/1.1 connections are persistent unless either side asks to close,
+// HTTP/1.0 connections have to ask to be kept alive
+func (hreq *HttpRequestHeader) KeepAlive() bool {
+	connection := hreq.Get("Connection")
+	if hreq.Protocol == "HTTP/1.0" {
+		return hasToken(connection, "keep-alive")
 	}
+	return !hasToken(connection, "close")
+}
+
+// Requests asking to switch to another protocol, like WebSocket or h2c
+func (hreq *HttpRequestHeader) IsUpgrade() bool {
+	return hreq.Get("Upgrade") != "" && hasToken(hreq.Get("Connection"), "upgrade")
+}
+
+func (hreq *HttpRequestHeader) ExpectContinue() bool {
+	return strings.EqualFold(hreq.Get("Expect"), "100-continue")
 }
 
 type HttpResponseHeader struct {
@@ -157,13 +224,57 @@ func (hres *HttpResponseHeader) Build() {
 	}
 }
 
-func (hres *HttpResponseHeader) Write(conn net.Conn) (int, error) {
+func (hres *HttpResponseHeader) Write(conn io.Writer) (int, error) {
 	if hres.Buffer == nil {
 		hres.Build()
 	}
 	return conn.Write(hres.Buffer)
 }
 
+func (hres *HttpResponseHeader) Read(conn io.Reader) error {
+	if hres.Headers == nil {
+		hres.Headers = make(map[string]string)
+	}
+
+	lineBytes, err := ReadHeaderLine(conn)
+	if err != nil {
+		return err
+	}
+	headerSplit := bytes.SplitN(lineBytes, WhitespaceBytes, 3)
+	if len(headerSplit) < 2 {
+		return fmt.Errorf("%v; "+string(lineBytes), ErrInvalidHeaderStart)
+	}
+	hres.Protocol = string(headerSplit[0])
+	hres.StatusCode, err = strconv.Atoi(string(headerSplit[1]))
+	if err != nil {
+		return fmt.Errorf("%v; "+string(lineBytes), ErrInvalidHeaderStart)
+	}
+	if len(headerSplit) == 3 {
+		hres.StatusMessage = string(headerSplit[2])
+	}
+
+	hres.Buffer = append(lineBytes, HttpHeaderLineSeparatorBytes...)
+	hres.Buffer, err = readHeaderFields(conn, hres.Headers, hres.Buffer)
+	return err
+}
+
+func (hres *HttpResponseHeader) Get(name string) string {
+	return getHeader(hres.Headers, name)
+}
+
+// Informational responses which are followed by the final response
+func (hres *HttpResponseHeader) IsInterim() bool {
+	return hres.StatusCode >= 100 && hres.StatusCode < 200 && hres.StatusCode != http.StatusSwitchingProtocols
+}
+
+func (hres *HttpResponseHeader) KeepAlive() bool {
+	connection := hres.Get("Connection")
+	if hres.Protocol == "HTTP/1.0" {
+		return hasToken(connection, "keep-alive")
+	}
+	return !hasToken(connection, "close")
+}
+
 func MakeHttpResponse(protocol string, code int, headers map[string]string, data []byte, json map[string]string, compileBuffer bool) HttpResponseHeader {
 	response := HttpResponseHeader{
 		Protocol:      protocol,
@@ -183,6 +294,68 @@ func MakeHttpResponse(protocol string, code int, headers map[string]string, data
 	return response
 }
 
+// Tell the visitor to retry after the given delay, rounded up to seconds
+func MakeRetryAfterResponse(retryAfter time.Duration) HttpResponseHeader {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return MakeHttpResponse(
+		DefaultHttpProtocolVersion,
+		http.StatusServiceUnavailable,
+		map[string]string{
+			"Server":      " Go-Tunnel/0.1.0",
+			"Connection":  " Closed",
+			"Retry-After": " " + strconv.Itoa(seconds),
+		},
+		nil,
+		map[string]string{"error": "No free connection available in the pool, try again later"},
+		true,
+	)
+}
+
+func MakeTextResponse(code int, text string) HttpResponseHeader {
+	response := MakeHttpResponse(
+		DefaultHttpProtocolVersion,
+		code,
+		map[string]string{
+			"Server":     " Go-Tunnel/0.1.0",
+			"Connection": " Closed",
+		},
+		[]byte(text),
+		nil,
+		false,
+	)
+	response.Headers["Content-Type"] = "text/plain; charset=utf-8"
+	response.Build()
+	return response
+}
+
+// Page for visitors of a tunnel which is reconnecting
+func MakeOfflineResponse(page []byte, contentType string, retryAfter time.Duration) HttpResponseHeader {
+	response := MakeRetryAfterResponse(retryAfter)
+	response.SetData(page)
+	response.Headers["Content-Type"] = contentType
+	response.Build()
+	return response
+}
+
+// Permanent redirect which keeps the request method
+func MakeRedirectResponse(location string) HttpResponseHeader {
+	return MakeHttpResponse(
+		DefaultHttpProtocolVersion,
+		http.StatusPermanentRedirect,
+		map[string]string{
+			"Server":     " Go-Tunnel/0.1.0",
+			"Connection": " Closed",
+			"Location":   " " + location,
+		},
+		nil,
+		nil,
+		true,
+	)
+}
+
 var HttpResponseNoFreeConnection HttpResponseHeader = MakeHttpResponse(
 	DefaultHttpProtocolVersion,
 	http.StatusNotFound,
@@ -218,3 +391,27 @@ var HttpResponseCannotConnectToLocalserver HttpResponseHeader = MakeHttpResponse
 	map[string]string{"error": "Cannot connect to the local adress"},
 	true,
 )
+
+var HttpResponseBadRequest HttpResponseHeader = MakeHttpResponse(
+	DefaultHttpProtocolVersion,
+	http.StatusBadRequest,
+	map[string]string{
+		"Server":     " Go-Tunnel/0.1.0",
+		"Connection": " Closed",
+	},
+	nil,
+	map[string]string{"error": "Malformed request"},
+	true,
+)
+
+var HttpResponseBadGateway HttpResponseHeader = MakeHttpResponse(
+	DefaultHttpProtocolVersion,
+	http.StatusBadGateway,
+	map[string]string{
+		"Server":     " Go-Tunnel/0.1.0",
+		"Connection": " Closed",
+	},
+	nil,
+	map[string]string{"error": "Invalid response from the tunnel"},
+	true,
+)
@@ -34,6 +34,30 @@ const ProxyResponseNotInUimaMode string = "2"
 const ProxyResponseMaxConnectionsLimitReached string = "3"
 const ProxyResponseUIMAError string = "3"
 
+var proxyRequestCodesV1 = map[string]ProxyCode{
+	ProxyRequestCreatePool:  RequestCreatePool,
+	ProxyRequestJoinPool:    RequestJoinPool,
+	ProxyRequestDeletePool:  RequestDeletePool,
+	ProxyRequestGenerateKey: RequestGenerateKey,
+	ProxyRequestRevokeKey:   RequestRevokeKey,
+}
+
+// v1 has no dedicated code for every v2 response, codes missing here are
+// reported to v1 clients as ProxyResponseAuthError
+var proxyCodesV1 = map[ProxyCode]string{
+	RequestCreatePool:                  ProxyRequestCreatePool,
+	RequestJoinPool:                    ProxyRequestJoinPool,
+	RequestDeletePool:                  ProxyRequestDeletePool,
+	RequestGenerateKey:                 ProxyRequestGenerateKey,
+	RequestRevokeKey:                   ProxyRequestRevokeKey,
+	ResponseSuccess:                    ProxyResponseSucess,
+	ResponseAuthError:                  ProxyResponseAuthError,
+	ResponseNotInUimaMode:              ProxyResponseNotInUimaMode,
+	ResponseMaxConnectionsLimitReached: ProxyResponseMaxConnectionsLimitReached,
+	ResponseKeyLimitReached:            ProxyResponseUIMAError,
+	ResponseKeyNotFound:                ProxyResponseSucess,
+}
+
 type ProxyHeader struct {
 	Code    string
 	Key     string
@@ -44,6 +68,11 @@ func (ph *ProxyHeader) Build() []byte {
 	var header string
 	header += ph.Code
 	header += ph.Key
+	// Keys shorter than the field, like subdomains, are padded so the
+	// message stays in place
+	if len(header) < StatusCodeLen+SessionKeyLen {
+		header += string(make([]byte, StatusCodeLen+SessionKeyLen-len(header)))
+	}
 	header += ph.Message
 	if len(header) < StatusHeaderLen {
 		header += string(make([]byte, StatusHeaderLen-len(header)))
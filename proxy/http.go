@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+)
+
+// Max time a visitor connection is kept open between two requests
+const HttpIdleTimeout time.Duration = 90 * time.Second
+
+// Max time a spliced connection stays half closed
+const SpliceCloseTimeout time.Duration = 30 * time.Second
+
+// Outcome of forwarding a single request
+type HttpExchange struct {
+	Request   *headers.HttpRequestHeader
+	Response  *headers.HttpResponseHeader
+	BytesIn   int64
+	BytesOut  int64
+	KeepAlive bool
+	Upgraded  bool
+}
+
+type bodyResult struct {
+	written int64
+	err     error
+}
+
+// Forward one request read from the client to the upstream connection and
+// relay the response back. The request body is streamed while the response
+// is read so interim responses like 100 Continue reach the client before it
+// sends the body. The client connection can be reused for the next request
+// only if KeepAlive is set on the exchange.
+func forwardHttp(request *headers.HttpRequestHeader, client *bufio.Reader, clientConn net.Conn, upstream net.Conn) (*HttpExchange, error) {
+	exchange := &HttpExchange{Request: request}
+	framing, length, err := request.BodyFraming()
+	if err != nil {
+		headers.HttpResponseBadRequest.Write(clientConn)
+		return exchange, err
+	}
+
+	n, err := request.Write(upstream)
+	exchange.BytesIn += int64(n)
+	if err != nil {
+		headers.HttpResponseBadGateway.Write(clientConn)
+		return exchange, err
+	}
+
+	bodyDone := make(chan bodyResult, 1)
+	go func() {
+		written, err := headers.CopyBody(upstream, client, framing, length)
+		bodyDone <- bodyResult{written, err}
+	}()
+
+	upstreamReader := bufio.NewReader(upstream)
+	continued := false
+	var response *headers.HttpResponseHeader
+	for {
+		response = &headers.HttpResponseHeader{}
+		err = response.Read(upstreamReader)
+		if err != nil {
+			if exchange.Response == nil {
+				headers.HttpResponseBadGateway.Write(clientConn)
+			}
+			return exchange, err
+		}
+		exchange.Response = response
+		n, err = response.Write(clientConn)
+		exchange.BytesOut += int64(n)
+		if err != nil {
+			return exchange, err
+		}
+		if !response.IsInterim() {
+			break
+		}
+		continued = true
+	}
+
+	if response.StatusCode == http.StatusSwitchingProtocols {
+		if !request.IsUpgrade() {
+			return exchange, ErrUnexpectedUpgrade
+		}
+		// The request is complete before the server switches protocols
+		result := <-bodyDone
+		exchange.BytesIn += result.written
+		if result.err != nil {
+			return exchange, result.err
+		}
+		exchange.Upgraded = true
+		in, out := splice(clientConn, client, upstream, upstreamReader)
+		exchange.BytesIn += in
+		exchange.BytesOut += out
+		return exchange, nil
+	}
+
+	responseFraming, responseLength, err := response.BodyFraming(request)
+	if err != nil {
+		return exchange, err
+	}
+	written, err := headers.CopyBody(clientConn, upstreamReader, responseFraming, responseLength)
+	exchange.BytesOut += written
+	if err != nil {
+		return exchange, err
+	}
+
+	exchange.KeepAlive = request.KeepAlive() &&
+		response.KeepAlive() &&
+		responseFraming != headers.BodyUntilClose &&
+		(continued || !request.ExpectContinue())
+	if exchange.KeepAlive {
+		// The next request can only be read once this body is consumed
+		result := <-bodyDone
+		exchange.BytesIn += result.written
+		exchange.KeepAlive = result.err == nil
+	}
+	return exchange, nil
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// Copy raw bytes in both directions until both sides are done, the readers
+// hold anything which was buffered while the handshake was parsed. Returns
+// the bytes copied from a to b and from b to a.
+func splice(a net.Conn, aReader io.Reader, b net.Conn, bReader io.Reader) (int64, int64) {
+	done := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(b, aReader)
+		closeWrite(b)
+		done <- n
+	}()
+	out, _ := io.Copy(a, bReader)
+	closeWrite(a)
+	// Don't wait forever for a peer which never closes its side
+	a.SetReadDeadline(time.Now().Add(SpliceCloseTimeout))
+	in := <-done
+	return in, out
+}
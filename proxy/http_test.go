@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+)
+
+// Visitor connection which records what the proxy answers
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (rc *recordConn) Write(b []byte) (int, error) {
+	return rc.written.Write(b)
+}
+
+// Pipelined requests on one visitor connection are forwarded one at a time,
+// every response is relayed and the connection stays usable until the
+// visitor asks to close it
+func TestForwardHttpPipelined(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+		// Flushing before the body makes the response chunked
+		w.(http.Flusher).Flush()
+		w.Write(body)
+	}))
+	defer upstream.Close()
+
+	data := "POST /chunked HTTP/1.1\r\nHost: web\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"3\r\nabc\r\n2\r\nde\r\n0\r\n\r\n" +
+		"POST /continue HTTP/1.1\r\nHost: web\r\nContent-Length: 4\r\nExpect: 100-continue\r\n\r\n" +
+		"data" +
+		"GET /close HTTP/1.1\r\nHost: web\r\nConnection: close\r\n\r\n"
+	tests := []struct {
+		path      string
+		body      string
+		keepAlive bool
+	}{
+		{"/chunked", "abcde", true},
+		{"/continue", "data", true},
+		{"/close", "", false},
+	}
+
+	visitor := bufio.NewReader(strings.NewReader(data))
+	visitorConn := &recordConn{}
+	for _, test := range tests {
+		request := &headers.HttpRequestHeader{}
+		if err := request.Read(visitor); err != nil {
+			t.Fatal(err)
+		}
+		upstreamConn, err := net.Dial("tcp", upstream.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchange, err := forwardHttp(request, visitor, visitorConn, upstreamConn)
+		upstreamConn.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		if exchange.Response.StatusCode != http.StatusOK || exchange.KeepAlive != test.keepAlive {
+			t.Errorf("%s: status %d keep alive %v", test.path, exchange.Response.StatusCode, exchange.KeepAlive)
+		}
+	}
+
+	responses := bufio.NewReader(&visitorConn.written)
+	for _, test := range tests {
+		response, err := http.ReadResponse(responses, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode == http.StatusContinue {
+			response, err = http.ReadResponse(responses, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		body, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Header.Get("X-Path") != test.path || string(body) != test.body {
+			t.Errorf("response for %s with body %q, want %s with %q", response.Header.Get("X-Path"), body, test.path, test.body)
+		}
+	}
+	if responses.Buffered() != 0 || visitorConn.written.Len() != 0 {
+		t.Error("data left after the last response")
+	}
+}
+
+// Connected pair of TCP connections, they can be half closed unlike pipes
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+// After 101 Switching Protocols both connections are spliced, bytes sent
+// along with the handshake on either side get through
+func TestForwardHttpUpgrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		err     error
+	}{
+		{"upgrade", "GET /ws HTTP/1.1\r\nHost: web\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nping", nil},
+		{"unexpected upgrade", "GET /ws HTTP/1.1\r\nHost: web\r\n\r\n", ErrUnexpectedUpgrade},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			upstreamConn, upstream := tcpPair(t)
+			go func() {
+				reader := bufio.NewReader(upstream)
+				if _, err := http.ReadRequest(reader); err != nil {
+					return
+				}
+				io.WriteString(upstream, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\nhello ")
+				io.Copy(upstream, reader)
+				upstream.(*net.TCPConn).CloseWrite()
+			}()
+
+			visitor, visitorConn := tcpPair(t)
+			io.WriteString(visitor, test.request)
+			visitorReader := bufio.NewReader(visitorConn)
+			request := &headers.HttpRequestHeader{}
+			if err := request.Read(visitorReader); err != nil {
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			var exchange *HttpExchange
+			go func() {
+				var err error
+				exchange, err = forwardHttp(request, visitorReader, visitorConn, upstreamConn)
+				done <- err
+			}()
+
+			reader := bufio.NewReader(visitor)
+			response, err := http.ReadResponse(reader, nil)
+			if err != nil || response.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("response %v with error %v", response, err)
+			}
+			if test.err != nil {
+				if err := <-done; err != test.err {
+					t.Errorf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			visitor.(*net.TCPConn).CloseWrite()
+			visitor.SetReadDeadline(time.Now().Add(2 * time.Second))
+			received, err := io.ReadAll(reader)
+			if err != nil || string(received) != "hello ping" {
+				t.Errorf("visitor got %q with error %v", received, err)
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			if !exchange.Upgraded || exchange.KeepAlive {
+				t.Errorf("upgraded %v keep alive %v", exchange.Upgraded, exchange.KeepAlive)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/metrics"
+)
+
+// Name of the metrics listener when it is handed over to a new process
+const ListenerMetrics string = "metrics"
+
+const metricsReadTimeout time.Duration = 10 * time.Second
+
+// Reasons a request did not get a response from the tunnel
+const failureNoSession string = "no_session_found"
+const failureOffline string = "tunnel_offline"
+const failureNoFreeConnection string = "no_free_connection"
+const failureUpstream string = "upstream"
+const failureLocalDial string = "local_dial"
+
+// Kinds of requests which failed authentication
+const authFailureToken string = "token"
+const authFailureAdmin string = "admin_signature"
+const authFailureAdminApi string = "admin_api"
+
+// Requests, bytes and latencies of a session on the forward proxy or of
+// the local side of a reverse proxy
+type requestStats struct {
+	requests atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	codes    *metrics.CounterVec
+	failures *metrics.CounterVec
+	latency  *metrics.Histogram
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		codes:    metrics.NewCounterVec("code"),
+		failures: metrics.NewCounterVec("reason"),
+		latency:  metrics.NewHistogram(metrics.LatencyBuckets),
+	}
+}
+
+func (rs *requestStats) addTraffic(requests int64, in int64, out int64) {
+	rs.requests.Add(requests)
+	rs.bytesIn.Add(in)
+	rs.bytesOut.Add(out)
+}
+
+func (rs *requestStats) traffic() SessionTraffic {
+	return SessionTraffic{
+		Requests: rs.requests.Load(),
+		BytesIn:  rs.bytesIn.Load(),
+		BytesOut: rs.bytesOut.Load(),
+	}
+}
+
+func (rs *requestStats) fail(reason string) {
+	rs.failures.Add(1, reason)
+}
+
+// Count a forwarded HTTP request, upgraded connections are left out of the
+// latencies since they last as long as the visitor stays
+func (rs *requestStats) observe(exchange *HttpExchange, err error, elapsed time.Duration) {
+	if exchange != nil {
+		rs.addTraffic(1, exchange.BytesIn, exchange.BytesOut)
+		if exchange.Response != nil {
+			rs.codes.Add(1, strconv.Itoa(exchange.Response.StatusCode))
+			if !exchange.Upgraded {
+				rs.latency.Observe(elapsed.Seconds())
+			}
+		}
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrSessionClosed):
+		rs.fail(failureNoSession)
+	case errors.Is(err, ErrForwardFailedNoFreeConnection),
+		errors.Is(err, ErrForwardFailedQueueFull),
+		errors.Is(err, ErrForwardFailedQueueTimeout):
+		rs.fail(failureNoFreeConnection)
+	case exchange == nil || exchange.Response == nil:
+		rs.fail(failureUpstream)
+	}
+}
+
+// What the metrics show of a single session
+type sessionMetrics struct {
+	info  SessionInfo
+	stats *requestStats
+}
+
+var metricProtocols = []string{headers.TunnelProtocolHttp, headers.TunnelProtocolTcp, headers.TunnelProtocolUdp}
+var metricStates = []SessionState{SessionActive, SessionOffline}
+
+// Write the session metrics shared by the forward and the reverse proxy,
+// failures which don't belong to a session are written with an empty
+// session label
+func writeSessionMetrics(w *metrics.Writer, sessions []sessionMetrics, failures *metrics.CounterVec) {
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].info.Key < sessions[j].info.Key })
+
+	w.Describe("tunnel_sessions", metrics.TypeGauge, "Sessions by protocol and state.")
+	counts := make(map[[2]string]int)
+	for _, session := range sessions {
+		counts[[2]string{session.info.Protocol, session.info.State}] += 1
+	}
+	for _, protocol := range metricProtocols {
+		for _, state := range metricStates {
+			w.Sample("tunnel_sessions", float64(counts[[2]string{protocol, state.String()}]),
+				metrics.Label{Name: "protocol", Value: protocol},
+				metrics.Label{Name: "state", Value: state.String()},
+			)
+		}
+	}
+
+	w.Describe("tunnel_pool_connections", metrics.TypeGauge, "Pooled connections of a session by state.")
+	for _, session := range sessions {
+		pool := session.info.Pool
+		if pool == nil {
+			continue
+		}
+		for _, state := range []struct {
+			name  string
+			value int
+		}{{"connected", pool.Connected}, {"free", pool.Free}, {"in_use", pool.InUse}} {
+			w.Sample("tunnel_pool_connections", float64(state.value),
+				metrics.Label{Name: "session", Value: session.info.Key},
+				metrics.Label{Name: "state", Value: state.name},
+			)
+		}
+	}
+
+	w.Describe("tunnel_queued_requests", metrics.TypeGauge, "Requests waiting for a free pooled connection.")
+	for _, session := range sessions {
+		if session.info.Pool != nil {
+			w.Sample("tunnel_queued_requests", float64(session.info.Pool.Waiting), metrics.Label{Name: "session", Value: session.info.Key})
+		}
+	}
+
+	w.Describe("tunnel_streams", metrics.TypeGauge, "Open streams on the multiplexed control connection of a session.")
+	for _, session := range sessions {
+		if session.info.Multiplex {
+			w.Sample("tunnel_streams", float64(session.info.Streams), metrics.Label{Name: "session", Value: session.info.Key})
+		}
+	}
+
+	w.Describe("tunnel_requests_total", metrics.TypeCounter, "HTTP requests forwarded through a session by status code.")
+	for _, session := range sessions {
+		session.stats.codes.Write(w, "tunnel_requests_total", metrics.Label{Name: "session", Value: session.info.Key})
+	}
+
+	w.Describe("tunnel_connections_total", metrics.TypeCounter, "Requests, TCP connections and UDP flows a session carried.")
+	for _, session := range sessions {
+		w.Sample("tunnel_connections_total", float64(session.info.Traffic.Requests), metrics.Label{Name: "session", Value: session.info.Key})
+	}
+
+	w.Describe("tunnel_forward_errors_total", metrics.TypeCounter, "Requests which did not get a response from the tunnel by reason.")
+	if failures != nil {
+		failures.Write(w, "tunnel_forward_errors_total", metrics.Label{Name: "session", Value: ""})
+	}
+	for _, session := range sessions {
+		session.stats.failures.Write(w, "tunnel_forward_errors_total", metrics.Label{Name: "session", Value: session.info.Key})
+	}
+
+	w.Describe("tunnel_bytes_total", metrics.TypeCounter, "Bytes a session carried, in is from visitors to the local server.")
+	for _, session := range sessions {
+		w.Sample("tunnel_bytes_total", float64(session.info.Traffic.BytesIn),
+			metrics.Label{Name: "session", Value: session.info.Key},
+			metrics.Label{Name: "direction", Value: "in"},
+		)
+		w.Sample("tunnel_bytes_total", float64(session.info.Traffic.BytesOut),
+			metrics.Label{Name: "session", Value: session.info.Key},
+			metrics.Label{Name: "direction", Value: "out"},
+		)
+	}
+
+	w.Describe("tunnel_request_duration_seconds", metrics.TypeHistogram, "Time until an HTTP request forwarded through a session is complete.")
+	for _, session := range sessions {
+		session.stats.latency.Write(w, "tunnel_request_duration_seconds", metrics.Label{Name: "session", Value: session.info.Key})
+	}
+}
+
+func (fp *ForwardProxy) WriteMetrics(w *metrics.Writer) {
+	sessions := []sessionMetrics{}
+	for _, session := range fp.sessions.Sessions() {
+		sessions = append(sessions, sessionMetrics{info: session.Info(), stats: session.stats})
+	}
+	writeSessionMetrics(w, sessions, fp.failures)
+
+	w.Describe("tunnel_auth_failures_total", metrics.TypeCounter, "Requests rejected for a bad token, admin signature or admin API credentials.")
+	fp.authFailures.Write(w, "tunnel_auth_failures_total")
+
+	w.Describe("tunnel_requests_in_flight", metrics.TypeGauge, "Visitor requests and connections being forwarded.")
+	w.Sample("tunnel_requests_in_flight", float64(fp.inflight.Load()))
+}
+
+func (fp *ForwardProxy) setupMetrics() error {
+	ln, err := fp.listen(ListenerMetrics, fp.Metrics.ToString())
+	if err != nil {
+		return err
+	}
+	fp.metricsLn = ln
+	fp.metricsServer = newMetricsServer(fp.Logger, fp.WriteMetrics)
+	go fp.metricsServer.Serve(ln)
+	fp.Logger.Info("Serving metrics", "addr", fp.Metrics.ToString())
+	return nil
+}
+
+func newMetricsServer(logger *slog.Logger, collect func(w *metrics.Writer)) *http.Server {
+	router := http.NewServeMux()
+	router.Handle("/metrics", metrics.Handler(collect))
+	return &http.Server{
+		Handler:           router,
+		ReadHeaderTimeout: metricsReadTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+}
+
+// Serve the metrics the collector writes on /metrics until the server is
+// closed
+func ServeMetrics(addr Addr, logger *slog.Logger, collect func(w *metrics.Writer)) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr.ToString())
+	if err != nil {
+		return nil, err
+	}
+	server := newMetricsServer(logger, collect)
+	go server.Serve(ln)
+	logger.Info("Serving metrics", "addr", addr.ToString())
+	return server, nil
+}
+
+func (rp *ReverseProxy) sessionMetrics() sessionMetrics {
+	session := rp.current()
+	info := SessionInfo{
+		Key:      session.key,
+		Protocol: rp.Protocol,
+		State:    SessionActive.String(),
+		Traffic:  rp.stats.traffic(),
+	}
+	if !rp.online.Load() {
+		info.State = SessionOffline.String()
+	}
+	if session.mux != nil {
+		info.Multiplex = true
+		info.Streams = session.mux.NumStreams()
+	} else {
+		idle := int(rp.idle.Load())
+		busy := int(rp.busy.Load())
+		info.Pool = &PoolInfo{Connected: idle + busy, Free: idle, InUse: busy}
+	}
+	return sessionMetrics{info: info, stats: rp.stats}
+}
+
+// Write the metrics of the local side of connected reverse proxies
+func WriteReverseProxyMetrics(w *metrics.Writer, proxies []*ReverseProxy) {
+	sessions := make([]sessionMetrics, 0, len(proxies))
+	for _, rp := range proxies {
+		sessions = append(sessions, rp.sessionMetrics())
+	}
+	writeSessionMetrics(w, sessions, nil)
+
+	w.Describe("tunnel_reconnects_total", metrics.TypeCounter, "Times the session was created again after losing the proxy.")
+	for _, rp := range proxies {
+		w.Sample("tunnel_reconnects_total", float64(rp.reconnects.Load()), metrics.Label{Name: "session", Value: rp.current().key})
+	}
+}
+
+func (fp *ForwardProxy) stopMetrics() {
+	if fp.metricsServer != nil {
+		fp.metricsServer.Close()
+	}
+}
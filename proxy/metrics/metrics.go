@@ -0,0 +1,214 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Prometheus text exposition format
+// _____________________________________
+// | # HELP name help                  |
+// | # TYPE name counter|gauge|histogram |
+// | name{label="value",...} value     |
+// -------------------------------------
+//
+// Every sample of a metric has to follow its HELP and TYPE lines, so
+// collectors write one metric at a time.
+
+const ContentType string = "text/plain; version=0.0.4; charset=utf-8"
+
+const TypeCounter string = "counter"
+const TypeGauge string = "gauge"
+const TypeHistogram string = "histogram"
+
+// Bucket bounds for request latencies, in seconds
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Writer writes metrics in the text exposition format, the first write
+// error is kept and later writes are skipped
+type Writer struct {
+	w   *bufio.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+func (w *Writer) write(s string) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = w.w.WriteString(s)
+}
+
+// Start a metric, its samples have to be written next
+func (w *Writer) Describe(name string, kind string, help string) {
+	w.write("# HELP " + name + " " + helpEscaper.Replace(help) + "\n")
+	w.write("# TYPE " + name + " " + kind + "\n")
+}
+
+func (w *Writer) Sample(name string, value float64, labels ...Label) {
+	w.write(name)
+	if len(labels) > 0 {
+		w.write("{")
+		for idx, label := range labels {
+			if idx > 0 {
+				w.write(",")
+			}
+			w.write(label.Name + `="` + labelEscaper.Replace(label.Value) + `"`)
+		}
+		w.write("}")
+	}
+	w.write(" " + formatValue(value) + "\n")
+}
+
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// Serve the metrics the collector writes
+func Handler(collect func(w *Writer)) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", ContentType)
+		writer := NewWriter(rw)
+		collect(writer)
+		writer.Flush()
+	})
+}
+
+// CounterVec keeps one counter per combination of label values
+type CounterVec struct {
+	names  []string
+	values map[string]*counterValue
+	mut    sync.RWMutex
+}
+
+type counterValue struct {
+	labels []string
+	value  atomic.Int64
+}
+
+func NewCounterVec(labelNames ...string) *CounterVec {
+	return &CounterVec{
+		names:  labelNames,
+		values: make(map[string]*counterValue),
+	}
+}
+
+func (cv *CounterVec) Add(delta int64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	cv.mut.RLock()
+	counter, ok := cv.values[key]
+	cv.mut.RUnlock()
+	if !ok {
+		cv.mut.Lock()
+		counter, ok = cv.values[key]
+		if !ok {
+			counter = &counterValue{labels: labelValues}
+			cv.values[key] = counter
+		}
+		cv.mut.Unlock()
+	}
+	counter.value.Add(delta)
+}
+
+// Write the samples of every counter, the labels are added in front of the
+// labels of the counter
+func (cv *CounterVec) Write(w *Writer, name string, labels ...Label) {
+	cv.mut.RLock()
+	keys := make([]string, 0, len(cv.values))
+	for key := range cv.values {
+		keys = append(keys, key)
+	}
+	cv.mut.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		cv.mut.RLock()
+		counter := cv.values[key]
+		cv.mut.RUnlock()
+		sampleLabels := append([]Label{}, labels...)
+		for idx, name := range cv.names {
+			sampleLabels = append(sampleLabels, Label{Name: name, Value: counter.labels[idx]})
+		}
+		w.Sample(name, float64(counter.value.Load()), sampleLabels...)
+	}
+}
+
+// Histogram counts observations in buckets with upper bounds
+type Histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+	mut    sync.Mutex
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	for idx, bound := range h.bounds {
+		if value <= bound {
+			h.counts[idx] += 1
+			break
+		}
+	}
+	h.count += 1
+	h.sum += value
+}
+
+// Write the cumulative buckets, the sum and the count of the histogram
+func (h *Histogram) Write(w *Writer, name string, labels ...Label) {
+	h.mut.Lock()
+	counts := append([]uint64{}, h.counts...)
+	count := h.count
+	sum := h.sum
+	h.mut.Unlock()
+
+	var cumulative uint64
+	for idx, bound := range h.bounds {
+		cumulative += counts[idx]
+		w.Sample(name+"_bucket", float64(cumulative), append(labels, Label{Name: "le", Value: formatValue(bound)})...)
+	}
+	w.Sample(name+"_bucket", float64(count), append(labels, Label{Name: "le", Value: "+Inf"})...)
+	w.Sample(name+"_sum", sum, labels...)
+	w.Sample(name+"_count", float64(count), labels...)
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriterSample(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  float64
+		labels []Label
+		line   string
+	}{
+		{"no labels", 3, nil, "tunnel_test 3\n"},
+		{"labels", 1.5, []Label{{"session", "web"}, {"code", "200"}}, `tunnel_test{session="web",code="200"} 1.5` + "\n"},
+		{"escaped label", 1, []Label{{"session", "a\"b\\c\nd"}}, `tunnel_test{session="a\"b\\c\nd"} 1` + "\n"},
+		{"large value", 1e21, nil, "tunnel_test 1e+21\n"},
+		{"infinity", math.Inf(1), nil, "tunnel_test +Inf\n"},
+		{"not a number", math.NaN(), nil, "tunnel_test NaN\n"},
+	}
+	for _, test := range tests {
+		out := &bytes.Buffer{}
+		w := NewWriter(out)
+		w.Sample("tunnel_test", test.value, test.labels...)
+		w.Flush()
+		if out.String() != test.line {
+			t.Errorf("%s: wrote %q, want %q", test.name, out.String(), test.line)
+		}
+	}
+}
+
+// Counters are written sorted by their labels after the labels of the caller
+func TestCounterVecWrite(t *testing.T) {
+	counter := NewCounterVec("reason")
+	counter.Add(1, "upstream")
+	counter.Add(2, "no_session_found")
+	counter.Add(3, "upstream")
+
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	w.Describe("tunnel_errors_total", TypeCounter, "Errors by\nreason.")
+	counter.Write(w, "tunnel_errors_total", Label{"session", "web"})
+	w.Flush()
+	want := "# HELP tunnel_errors_total Errors by\\nreason.\n" +
+		"# TYPE tunnel_errors_total counter\n" +
+		`tunnel_errors_total{session="web",reason="no_session_found"} 2` + "\n" +
+		`tunnel_errors_total{session="web",reason="upstream"} 4` + "\n"
+	if out.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// Buckets are cumulative, values above the last bound only show in +Inf
+func TestHistogramWrite(t *testing.T) {
+	histogram := NewHistogram([]float64{0.1, 1})
+	for _, value := range []float64{0.05, 0.1, 0.5, 2} {
+		histogram.Observe(value)
+	}
+
+	out := &bytes.Buffer{}
+	w := NewWriter(out)
+	histogram.Write(w, "tunnel_duration_seconds", Label{"session", "web"})
+	w.Flush()
+	want := `tunnel_duration_seconds_bucket{session="web",le="0.1"} 2` + "\n" +
+		`tunnel_duration_seconds_bucket{session="web",le="1"} 3` + "\n" +
+		`tunnel_duration_seconds_bucket{session="web",le="+Inf"} 4` + "\n" +
+		`tunnel_duration_seconds_sum{session="web"} 2.65` + "\n" +
+		`tunnel_duration_seconds_count{session="web"} 4` + "\n"
+	if out.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	Handler(func(w *Writer) {
+		w.Describe("tunnel_up", TypeGauge, "Whether the proxy is up.")
+		w.Sample("tunnel_up", 1)
+	}).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	want := "# HELP tunnel_up Whether the proxy is up.\n# TYPE tunnel_up gauge\ntunnel_up 1\n"
+	if recorder.Header().Get("Content-Type") != ContentType || recorder.Body.String() != want {
+		t.Errorf("served %q as %s", recorder.Body.String(), recorder.Header().Get("Content-Type"))
+	}
+}
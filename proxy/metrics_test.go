@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/metrics"
+)
+
+// Sessions, requests and failures of the forward proxy show up as samples
+func TestForwardProxyMetrics(t *testing.T) {
+	fp := newTestForwardProxy()
+	session := NewSession("web", testLogger, 0, time.Second)
+	session.protocol = headers.TunnelProtocolHttp
+	fp.sessions.Add(session)
+	exchange := &HttpExchange{
+		Response: &headers.HttpResponseHeader{StatusCode: 200},
+		BytesIn:  10,
+		BytesOut: 20,
+	}
+	session.stats.observe(exchange, nil, 30*time.Millisecond)
+	session.stats.observe(nil, ErrForwardFailedQueueTimeout, 0)
+	fp.failures.Add(1, failureNoSession)
+	fp.authFailures.Add(2, authFailureToken)
+	done := fp.track()
+	defer done()
+
+	out := &bytes.Buffer{}
+	w := metrics.NewWriter(out)
+	fp.WriteMetrics(w)
+	w.Flush()
+	for _, line := range []string{
+		"# TYPE tunnel_sessions gauge",
+		`tunnel_sessions{protocol="http",state="active"} 1`,
+		`tunnel_sessions{protocol="tcp",state="active"} 0`,
+		`tunnel_requests_total{session="web",code="200"} 1`,
+		`tunnel_connections_total{session="web"} 1`,
+		`tunnel_forward_errors_total{session="",reason="no_session_found"} 1`,
+		`tunnel_forward_errors_total{session="web",reason="no_free_connection"} 1`,
+		`tunnel_bytes_total{session="web",direction="in"} 10`,
+		`tunnel_bytes_total{session="web",direction="out"} 20`,
+		`tunnel_request_duration_seconds_bucket{session="web",le="0.05"} 1`,
+		`tunnel_request_duration_seconds_count{session="web"} 1`,
+		`tunnel_auth_failures_total{kind="token"} 2`,
+		"tunnel_requests_in_flight 1",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("missing %s in\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package mux
+
+import "errors"
+
+var ErrSessionShutdown = errors.New("Multiplexer session shutdown")
+var ErrStreamClosed = errors.New("Stream is closed")
+var ErrStreamReset = errors.New("Stream reset by peer")
+var ErrStreamsExhausted = errors.New("Stream IDs exhausted")
+var ErrGoAway = errors.New("Peer is not accepting new streams")
+var ErrInvalidVersion = errors.New("Invalid multiplexer protocol version")
+var ErrInvalidFrameType = errors.New("Invalid multiplexer frame type")
+var ErrRecvWindowExceeded = errors.New("Receive window exceeded")
+var ErrKeepaliveTimeout = errors.New("Peer did not answer the keepalive ping")
+var ErrTimeout = &timeoutError{}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "I/O deadline exceeded" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,80 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Multiplexer frame
+// _______________________________________________
+// | VERSION | TYPE | FLAGS | STREAM_ID | LENGTH |
+// -----------------------------------------------
+//
+// VERSION : 1 byte
+// TYPE : 1 byte
+// FLAGS : 2 bytes, big endian
+// STREAM_ID : 4 bytes, big endian
+// LENGTH : 4 bytes, big endian
+// HEADER_LENGTH : 12 bytes
+//
+// LENGTH is the size of the data which follows a data frame, for window
+// updates it is the window delta, for pings the opaque ping value and for
+// go away frames the reason code.
+
+const protocolVersion uint8 = 0
+const headerLen int = 12
+
+type frameType uint8
+
+const typeData frameType = 0
+const typeWindowUpdate frameType = 1
+const typePing frameType = 2
+const typeGoAway frameType = 3
+
+type frameFlag uint16
+
+const flagSYN frameFlag = 1
+const flagACK frameFlag = 2
+const flagFIN frameFlag = 4
+const flagRST frameFlag = 8
+
+// Go away reason codes
+const GoAwayNormal uint32 = 0
+const GoAwayProtocolError uint32 = 1
+const GoAwayInternalError uint32 = 2
+
+type header [headerLen]byte
+
+func (h header) Version() uint8 {
+	return h[0]
+}
+
+func (h header) Type() frameType {
+	return frameType(h[1])
+}
+
+func (h header) Flags() frameFlag {
+	return frameFlag(binary.BigEndian.Uint16(h[2:4]))
+}
+
+func (h header) StreamID() uint32 {
+	return binary.BigEndian.Uint32(h[4:8])
+}
+
+func (h header) Length() uint32 {
+	return binary.BigEndian.Uint32(h[8:12])
+}
+
+func (h *header) encode(t frameType, flags frameFlag, streamID uint32, length uint32) {
+	h[0] = protocolVersion
+	h[1] = byte(t)
+	binary.BigEndian.PutUint16(h[2:4], uint16(flags))
+	binary.BigEndian.PutUint32(h[4:8], streamID)
+	binary.BigEndian.PutUint32(h[8:12], length)
+}
+
+func readHeader(r io.Reader) (header, error) {
+	var h header
+	_, err := io.ReadFull(r, h[:])
+	return h, err
+}
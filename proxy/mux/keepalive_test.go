@@ -0,0 +1,77 @@
+package mux
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPing(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := Client(clientConn)
+	server := Server(serverConn)
+	defer client.Close()
+	defer server.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Ping(time.Second); err != nil {
+			t.Fatalf("client ping: %v", err)
+		}
+		if _, err := server.Ping(time.Second); err != nil {
+			t.Fatalf("server ping: %v", err)
+		}
+	}
+}
+
+// A peer which stops reading blocks the ping write, the timeout still has
+// to fire
+func TestPingPeerNotReading(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session := Client(conn)
+	defer session.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := session.Ping(50 * time.Millisecond)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrTimeout {
+			t.Fatalf("ping error %v, want %v", err, ErrTimeout)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ping blocked on the write")
+	}
+}
+
+func TestKeepalivePeerNotReading(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	session := Client(conn)
+	session.Keepalive(20*time.Millisecond, 50*time.Millisecond)
+
+	select {
+	case <-session.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("keepalive did not shut the session down")
+	}
+	if session.Err() != ErrKeepaliveTimeout {
+		t.Errorf("session error %v, want %v", session.Err(), ErrKeepaliveTimeout)
+	}
+}
+
+func TestKeepaliveAnswered(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	client := Client(clientConn)
+	server := Server(serverConn)
+	defer client.Close()
+	defer server.Close()
+	client.Keepalive(10*time.Millisecond, time.Second)
+
+	time.Sleep(100 * time.Millisecond)
+	if client.IsClosed() {
+		t.Fatalf("answered keepalive shut the session down; %v", client.Err())
+	}
+}
@@ -0,0 +1,369 @@
+package mux
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const initialStreamWindow uint32 = 256 * 1024
+const maxDataFrameSize uint32 = 32 * 1024
+const acceptBacklog int = 256
+
+// Session multiplexes many logical streams over a single connection. Both
+// ends of the connection can open streams, streams opened by the client use
+// odd IDs and streams opened by the server use even IDs.
+type Session struct {
+	conn         net.Conn
+	nextStreamID uint32
+
+	streams    map[uint32]*Stream
+	streamLock sync.Mutex
+
+	acceptCh  chan *Stream
+	writeLock sync.Mutex
+
+	pings    map[uint32]chan struct{}
+	pingID   uint32
+	pingLock sync.Mutex
+
+	localGoAway    int32
+	remoteGoAway   int32
+	remoteGoAwayCh chan struct{}
+
+	shutdown     bool
+	shutdownErr  error
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
+}
+
+func newSession(conn net.Conn, client bool) *Session {
+	s := &Session{
+		conn:           conn,
+		streams:        make(map[uint32]*Stream),
+		acceptCh:       make(chan *Stream, acceptBacklog),
+		pings:          make(map[uint32]chan struct{}),
+		remoteGoAwayCh: make(chan struct{}),
+		shutdownCh:     make(chan struct{}),
+	}
+	if client {
+		s.nextStreamID = 1
+	} else {
+		s.nextStreamID = 2
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Create the session for the side of the connection which dialed
+func Client(conn net.Conn) *Session {
+	return newSession(conn, true)
+}
+
+// Create the session for the side of the connection which accepted
+func Server(conn net.Conn) *Session {
+	return newSession(conn, false)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Closed when the session shuts down
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.shutdownCh
+}
+
+// Closed when the peer sends a go away frame
+func (s *Session) GoAwayChan() <-chan struct{} {
+	return s.remoteGoAwayCh
+}
+
+// Error which caused the session to shut down
+func (s *Session) Err() error {
+	s.shutdownLock.Lock()
+	defer s.shutdownLock.Unlock()
+	return s.shutdownErr
+}
+
+func (s *Session) NumStreams() int {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) Open() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionShutdown
+	}
+	if atomic.LoadInt32(&s.remoteGoAway) == 1 {
+		return nil, ErrGoAway
+	}
+
+	s.streamLock.Lock()
+	id := s.nextStreamID
+	if id >= 1<<32-2 {
+		s.streamLock.Unlock()
+		return nil, ErrStreamsExhausted
+	}
+	s.nextStreamID += 2
+	stream := newStream(s, id)
+	s.streams[id] = stream
+	s.streamLock.Unlock()
+
+	err := s.writeFrame(typeWindowUpdate, flagSYN, id, 0, nil)
+	if err != nil {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.shutdownCh:
+		return nil, ErrSessionShutdown
+	}
+}
+
+// Measure the round trip time to the peer
+func (s *Session) Ping(timeout time.Duration) (time.Duration, error) {
+	ch := make(chan struct{})
+	s.pingLock.Lock()
+	s.pingID++
+	id := s.pingID
+	s.pings[id] = ch
+	s.pingLock.Unlock()
+	defer func() {
+		s.pingLock.Lock()
+		delete(s.pings, id)
+		s.pingLock.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	start := time.Now()
+	// The write blocks once the peer stops reading and the send buffer is
+	// full, it counts against the timeout like the answer does. Shutting
+	// the session down closes the connection and lets the write return.
+	written := make(chan error, 1)
+	go func() {
+		written <- s.writeFrame(typePing, flagSYN, 0, id, nil)
+	}()
+	for {
+		select {
+		case err := <-written:
+			if err != nil {
+				return 0, err
+			}
+			written = nil
+		case <-ch:
+			return time.Since(start), nil
+		case <-timer.C:
+			return 0, ErrTimeout
+		case <-s.shutdownCh:
+			return 0, ErrSessionShutdown
+		}
+	}
+}
+
+// Ping the peer every interval and shut the session down when a ping is not
+// answered within the timeout, catches connections which died silently
+func (s *Session) Keepalive(interval time.Duration, timeout time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.shutdownCh:
+				return
+			}
+			_, err := s.Ping(timeout)
+			if err == ErrTimeout {
+				s.exitErr(ErrKeepaliveTimeout)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Tell the peer to stop opening new streams, streams which are already open
+// keep working
+func (s *Session) GoAway(reason uint32) error {
+	atomic.StoreInt32(&s.localGoAway, 1)
+	return s.writeFrame(typeGoAway, 0, 0, reason, nil)
+}
+
+func (s *Session) Close() error {
+	s.exitErr(ErrSessionShutdown)
+	return nil
+}
+
+func (s *Session) exitErr(err error) {
+	s.shutdownLock.Lock()
+	if s.shutdown {
+		s.shutdownLock.Unlock()
+		return
+	}
+	s.shutdown = true
+	s.shutdownErr = err
+	close(s.shutdownCh)
+	s.shutdownLock.Unlock()
+
+	s.conn.Close()
+	s.streamLock.Lock()
+	for id, stream := range s.streams {
+		stream.forceClose()
+		delete(s.streams, id)
+	}
+	s.streamLock.Unlock()
+}
+
+func (s *Session) writeFrame(t frameType, flags frameFlag, streamID uint32, length uint32, body []byte) error {
+	var h header
+	h.encode(t, flags, streamID, length)
+	buffer := make([]byte, 0, headerLen+len(body))
+	buffer = append(buffer, h[:]...)
+	buffer = append(buffer, body...)
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	if s.IsClosed() {
+		return ErrSessionShutdown
+	}
+	_, err := s.conn.Write(buffer)
+	if err != nil {
+		s.exitErr(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.streamLock.Lock()
+	delete(s.streams, id)
+	s.streamLock.Unlock()
+}
+
+func (s *Session) recvLoop() {
+	for {
+		h, err := readHeader(s.conn)
+		if err != nil {
+			s.exitErr(err)
+			return
+		}
+		if h.Version() != protocolVersion {
+			s.GoAway(GoAwayProtocolError)
+			s.exitErr(ErrInvalidVersion)
+			return
+		}
+
+		switch h.Type() {
+		case typeData, typeWindowUpdate:
+			err = s.handleStreamFrame(h)
+		case typePing:
+			s.handlePing(h)
+		case typeGoAway:
+			s.handleGoAway()
+		default:
+			err = ErrInvalidFrameType
+		}
+		if err != nil {
+			s.GoAway(GoAwayProtocolError)
+			s.exitErr(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleStreamFrame(h header) error {
+	id := h.StreamID()
+	if h.Flags()&flagSYN != 0 {
+		s.incomingStream(id)
+	}
+
+	s.streamLock.Lock()
+	stream := s.streams[id]
+	s.streamLock.Unlock()
+
+	if stream == nil {
+		// Drain the data of streams we no longer know about
+		if h.Type() == typeData && h.Length() > 0 {
+			_, err := io.CopyN(io.Discard, s.conn, int64(h.Length()))
+			return err
+		}
+		return nil
+	}
+
+	if h.Type() == typeWindowUpdate {
+		stream.updateSendWindow(h.Flags(), h.Length())
+		return nil
+	}
+	return stream.readData(h.Flags(), h.Length(), s.conn)
+}
+
+func (s *Session) incomingStream(id uint32) {
+	if atomic.LoadInt32(&s.localGoAway) == 1 {
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+		return
+	}
+
+	stream := newStream(s, id)
+	s.streamLock.Lock()
+	if s.streams[id] != nil {
+		s.streamLock.Unlock()
+		return
+	}
+	s.streams[id] = stream
+	s.streamLock.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+	default:
+		// Backlog is full, refuse the stream
+		s.removeStream(id)
+		go s.writeFrame(typeWindowUpdate, flagRST, id, 0, nil)
+	}
+}
+
+func (s *Session) handlePing(h header) {
+	if h.Flags()&flagSYN != 0 {
+		go s.writeFrame(typePing, flagACK, 0, h.Length(), nil)
+		return
+	}
+
+	s.pingLock.Lock()
+	ch := s.pings[h.Length()]
+	delete(s.pings, h.Length())
+	s.pingLock.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+}
+
+func (s *Session) handleGoAway() {
+	if atomic.CompareAndSwapInt32(&s.remoteGoAway, 0, 1) {
+		close(s.remoteGoAwayCh)
+	}
+}
@@ -0,0 +1,289 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testSessions(t *testing.T) (*Session, *Session) {
+	clientConn, serverConn := net.Pipe()
+	client := Client(clientConn)
+	server := Server(serverConn)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// Echo every accepted stream back to its opener
+func echo(session *Session) {
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(stream, stream)
+			stream.CloseWrite()
+		}()
+	}
+}
+
+func TestStreamTransfer(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"more than a frame", int(maxDataFrameSize) + 1},
+		{"exactly the window", int(initialStreamWindow)},
+		{"several windows", 3*int(initialStreamWindow) + 7},
+	}
+	client, server := testSessions(t)
+	go echo(server)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.size)
+			rand.Read(data)
+			stream, err := client.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			written := make(chan error, 1)
+			go func() {
+				_, err := stream.Write(data)
+				stream.CloseWrite()
+				written <- err
+			}()
+			received, err := io.ReadAll(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, data) {
+				t.Errorf("echoed %d bytes, want the %d written", len(received), len(data))
+			}
+		})
+	}
+}
+
+// A writer stops once it used up the window of a peer which does not read
+// and carries on once the peer reads
+func TestStreamSendWindow(t *testing.T) {
+	client, server := testSessions(t)
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream reaches the peer with the first frame
+	stream.Write([]byte{0})
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, initialStreamWindow)
+	stream.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := stream.Write(data)
+	if err != ErrTimeout || n != int(initialStreamWindow)-1 {
+		t.Fatalf("wrote %d bytes with error %v, want %d and %v", n, err, initialStreamWindow-1, ErrTimeout)
+	}
+
+	stream.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Write(data[n:])
+		done <- err
+	}()
+	if _, err := io.ReadFull(accepted, make([]byte, initialStreamWindow)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("window update did not wake the writer")
+	}
+}
+
+// A peer which sends more than the window it was given breaks the protocol
+func TestRecvWindowExceeded(t *testing.T) {
+	conn, peer := net.Pipe()
+	session := Server(conn)
+	defer session.Close()
+	defer peer.Close()
+
+	var h header
+	h.encode(typeWindowUpdate, flagSYN, 1, 0)
+	peer.Write(h[:])
+	h.encode(typeData, 0, 1, initialStreamWindow+1)
+	go io.Copy(io.Discard, peer)
+	peer.Write(h[:])
+
+	select {
+	case <-session.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("session kept going past the receive window")
+	}
+	if session.Err() != ErrRecvWindowExceeded {
+		t.Errorf("session error %v, want %v", session.Err(), ErrRecvWindowExceeded)
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	client, server := testSessions(t)
+	go echo(server)
+	open, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer open.Close()
+	// The server has to know the stream before it goes away
+	roundTrip := func() {
+		if _, err := open.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		received := make([]byte, 4)
+		if _, err := io.ReadFull(open, received); err != nil || string(received) != "ping" {
+			t.Fatalf("read %q with error %v", received, err)
+		}
+	}
+	roundTrip()
+
+	if err := server.GoAway(GoAwayNormal); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.GoAwayChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("go away did not reach the client")
+	}
+	if _, err := client.Open(); err != ErrGoAway {
+		t.Errorf("open error %v, want %v", err, ErrGoAway)
+	}
+
+	// Streams opened before keep working
+	roundTrip()
+
+	// The side which went away can still open streams
+	go echo(client)
+	stream, err := server.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Close()
+}
+
+// A stream opened while the go away is in flight is reset
+func TestGoAwayRefusesStreams(t *testing.T) {
+	client, server := testSessions(t)
+	// Gone away without telling the client yet
+	atomic.StoreInt32(&server.localGoAway, 1)
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("read error %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestStreamReset(t *testing.T) {
+	client, server := testSessions(t)
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte{0})
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Reset()
+
+	stream.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err != ErrStreamReset {
+		t.Errorf("read error %v, want %v", err, ErrStreamReset)
+	}
+	if _, err := stream.Write([]byte{0}); err != ErrStreamReset {
+		t.Errorf("write error %v, want %v", err, ErrStreamReset)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := testSessions(t)
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	select {
+	case <-client.CloseChan():
+	case <-time.After(2 * time.Second):
+		t.Fatal("client did not notice the server going away")
+	}
+	if _, err := stream.Read(make([]byte, 1)); err != ErrSessionShutdown {
+		t.Errorf("read error %v, want %v", err, ErrSessionShutdown)
+	}
+	if _, err := client.Open(); err != ErrSessionShutdown {
+		t.Errorf("open error %v, want %v", err, ErrSessionShutdown)
+	}
+	if client.NumStreams() != 0 {
+		t.Errorf("%d streams left after shutdown", client.NumStreams())
+	}
+}
+
+func TestParallelStreams(t *testing.T) {
+	client, server := testSessions(t)
+	go echo(server)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for idx := 0; idx < 32; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte{byte(idx)}, 64*1024)
+			stream, err := client.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer stream.Close()
+			go func() {
+				stream.Write(data)
+				stream.CloseWrite()
+			}()
+			received, err := io.ReadAll(stream)
+			if err == nil && !bytes.Equal(received, data) {
+				err = io.ErrShortWrite
+			}
+			errs <- err
+		}(idx)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
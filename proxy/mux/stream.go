@@ -0,0 +1,314 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection inside a session, it implements net.Conn.
+// Every stream has its own flow control window so a slow reader on one
+// stream does not stall the others.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	lock         sync.Mutex
+	recvBuf      bytes.Buffer
+	recvWindow   uint32
+	consumed     uint32
+	sendWindow   uint32
+	localClosed  bool
+	readClosed   bool
+	remoteClosed bool
+	err          error
+
+	recvNotify chan struct{}
+	sendNotify chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(session *Session, id uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		recvWindow: initialStreamWindow,
+		sendWindow: initialStreamWindow,
+		recvNotify: make(chan struct{}, 1),
+		sendNotify: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Wait for a notification, the deadline or the session shutdown
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		delay := time.Until(deadline)
+		if delay <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	case <-st.session.shutdownCh:
+		// Buffered data stays readable after the session is gone
+		st.forceClose()
+		return nil
+	}
+}
+
+func (st *Stream) StreamID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Session() *Session {
+	return st.session
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.lock.Lock()
+		if st.readClosed {
+			st.lock.Unlock()
+			return 0, ErrStreamClosed
+		}
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(b)
+			var delta uint32
+			st.consumed += uint32(n)
+			if st.consumed >= initialStreamWindow/2 {
+				delta = st.consumed
+				st.recvWindow += delta
+				st.consumed = 0
+			}
+			st.lock.Unlock()
+			if delta > 0 {
+				st.session.writeFrame(typeWindowUpdate, 0, st.id, delta, nil)
+			}
+			return n, nil
+		}
+		if st.err != nil {
+			err := st.err
+			st.lock.Unlock()
+			return 0, err
+		}
+		if st.remoteClosed {
+			st.lock.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.lock.Unlock()
+
+		err := st.wait(st.recvNotify, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	var total int
+	for total < len(b) {
+		st.lock.Lock()
+		if st.err != nil {
+			err := st.err
+			st.lock.Unlock()
+			return total, err
+		}
+		if st.localClosed {
+			st.lock.Unlock()
+			return total, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.lock.Unlock()
+			err := st.wait(st.sendNotify, deadline)
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+
+		size := uint32(len(b) - total)
+		if size > st.sendWindow {
+			size = st.sendWindow
+		}
+		if size > maxDataFrameSize {
+			size = maxDataFrameSize
+		}
+		st.sendWindow -= size
+		st.lock.Unlock()
+
+		err := st.session.writeFrame(typeData, 0, st.id, size, b[total:total+int(size)])
+		if err != nil {
+			return total, err
+		}
+		total += int(size)
+	}
+	return total, nil
+}
+
+// Half close the stream, the peer reads io.EOF once it has consumed the data
+// written so far but can keep writing to us
+func (st *Stream) CloseWrite() error {
+	st.lock.Lock()
+	if st.localClosed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed || st.err != nil
+	st.lock.Unlock()
+
+	err := st.session.writeFrame(typeData, flagFIN, st.id, 0, nil)
+	if done {
+		st.session.removeStream(st.id)
+	}
+	return err
+}
+
+// Close both directions of the stream, data the peer sends afterwards is
+// discarded
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	st.readClosed = true
+	st.recvBuf.Reset()
+	st.lock.Unlock()
+	notify(st.recvNotify)
+	return st.CloseWrite()
+}
+
+// Abort the stream in both directions
+func (st *Stream) Reset() error {
+	st.lock.Lock()
+	if st.err != nil {
+		st.lock.Unlock()
+		return nil
+	}
+	st.err = ErrStreamReset
+	st.localClosed = true
+	st.lock.Unlock()
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+	st.session.removeStream(st.id)
+	return st.session.writeFrame(typeWindowUpdate, flagRST, st.id, 0, nil)
+}
+
+func (st *Stream) readData(flags frameFlag, length uint32, conn io.Reader) error {
+	st.lock.Lock()
+	if length > st.recvWindow {
+		st.lock.Unlock()
+		return ErrRecvWindowExceeded
+	}
+	st.recvWindow -= length
+	st.lock.Unlock()
+
+	data := make([]byte, length)
+	_, err := io.ReadFull(conn, data)
+	if err != nil {
+		return err
+	}
+
+	var delta uint32
+	st.lock.Lock()
+	if st.readClosed || st.err != nil {
+		// Data which is discarded still has to be credited back to the peer
+		delta = length
+		st.recvWindow += length
+	} else {
+		st.recvBuf.Write(data)
+	}
+	st.lock.Unlock()
+
+	if delta > 0 {
+		go st.session.writeFrame(typeWindowUpdate, 0, st.id, delta, nil)
+	}
+	st.handleFlags(flags)
+	notify(st.recvNotify)
+	return nil
+}
+
+func (st *Stream) updateSendWindow(flags frameFlag, delta uint32) {
+	st.lock.Lock()
+	st.sendWindow += delta
+	st.lock.Unlock()
+	st.handleFlags(flags)
+	notify(st.sendNotify)
+}
+
+func (st *Stream) handleFlags(flags frameFlag) {
+	if flags&(flagFIN|flagRST) == 0 {
+		return
+	}
+	st.lock.Lock()
+	if flags&flagFIN != 0 {
+		st.remoteClosed = true
+	}
+	if flags&flagRST != 0 && st.err == nil {
+		st.err = ErrStreamReset
+	}
+	done := st.localClosed || st.err != nil
+	st.lock.Unlock()
+	if done {
+		st.session.removeStream(st.id)
+	}
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+}
+
+func (st *Stream) forceClose() {
+	st.lock.Lock()
+	if st.err == nil {
+		st.err = ErrSessionShutdown
+	}
+	st.lock.Unlock()
+	notify(st.recvNotify)
+	notify(st.sendNotify)
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.readDeadline = t
+	st.lock.Unlock()
+	notify(st.recvNotify)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.lock.Lock()
+	st.writeDeadline = t
+	st.lock.Unlock()
+	notify(st.sendNotify)
+	return nil
+}
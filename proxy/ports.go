@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// PortAllocator hands out public ports from a fixed range
+type PortAllocator struct {
+	start int
+	end   int
+	used  map[int]bool
+	mut   sync.Mutex
+}
+
+func NewPortAllocator(start int, end int) *PortAllocator {
+	return &PortAllocator{
+		start: start,
+		end:   end,
+		used:  make(map[int]bool),
+	}
+}
+
+// Parse a port range like 20000-20100, a single port is a range of one
+func ParsePortRange(portRange string) (int, int, error) {
+	bounds := strings.SplitN(portRange, "-", 2)
+	start, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid port range %q", portRange)
+	}
+	end := start
+	if len(bounds) == 2 {
+		end, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid port range %q", portRange)
+		}
+	}
+	if start <= 0 || end > 65535 || start > end {
+		return 0, 0, fmt.Errorf("Invalid port range %q", portRange)
+	}
+	return start, end, nil
+}
+
+// Find a free port in the range which the listen function can bind to
+func (pa *PortAllocator) Acquire(listen func(port int) error) (int, error) {
+	pa.mut.Lock()
+	defer pa.mut.Unlock()
+	for port := pa.start; port <= pa.end; port++ {
+		if pa.used[port] {
+			continue
+		}
+		if listen(port) != nil {
+			continue
+		}
+		pa.used[port] = true
+		return port, nil
+	}
+	return 0, ErrNoFreePort
+}
+
+func (pa *PortAllocator) Release(port int) {
+	pa.mut.Lock()
+	delete(pa.used, port)
+	pa.mut.Unlock()
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		portRange string
+		start     int
+		end       int
+		valid     bool
+	}{
+		{"20000-20100", 20000, 20100, true},
+		{" 20000 - 20100 ", 20000, 20100, true},
+		{"20000", 20000, 20000, true},
+		{"20100-20000", 0, 0, false},
+		{"0-10", 0, 0, false},
+		{"60000-70000", 0, 0, false},
+		{"a-b", 0, 0, false},
+		{"", 0, 0, false},
+	}
+	for _, test := range tests {
+		start, end, err := ParsePortRange(test.portRange)
+		if (err == nil) != test.valid || start != test.start || end != test.end {
+			t.Errorf("ParsePortRange(%q) = %d, %d, %v", test.portRange, start, end, err)
+		}
+	}
+}
+
+// Ports are handed out once until they are released, ports which can't be
+// bound are skipped
+func TestPortAllocator(t *testing.T) {
+	allocator := NewPortAllocator(100, 102)
+	bound := func(port int) error { return nil }
+	busy := func(port int) error {
+		if port == 101 {
+			return errors.New("address already in use")
+		}
+		return nil
+	}
+
+	steps := []struct {
+		listen func(port int) error
+		port   int
+		err    error
+	}{
+		{bound, 100, nil},
+		{busy, 102, nil},
+		{busy, 0, ErrNoFreePort},
+		{bound, 101, nil},
+		{bound, 0, ErrNoFreePort},
+	}
+	for idx, step := range steps {
+		port, err := allocator.Acquire(step.listen)
+		if port != step.port || err != step.err {
+			t.Fatalf("step %d: acquired %d with error %v, want %d and %v", idx, port, err, step.port, step.err)
+		}
+	}
+
+	allocator.Release(101)
+	if port, err := allocator.Acquire(bound); port != 101 || err != nil {
+		t.Errorf("acquired %d with error %v after release, want 101", port, err)
+	}
+}
+
+// The port of a TCP tunnel goes back to the allocator once the session
+// closes its listener
+func TestTcpPortRelease(t *testing.T) {
+	fp := &ForwardProxy{
+		Logger:   testLogger,
+		Addr:     Addr{Host: "127.0.0.1"},
+		tcpPorts: NewPortAllocator(42000, 42100),
+	}
+	ln, port, err := fp.listenTcp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := NewSession("tcp", testLogger, 0, time.Second)
+	session.listener = ln
+	done := make(chan struct{})
+	go func() {
+		fp.serveTcp(session, ln, port)
+		close(done)
+	}()
+
+	if conn, err := net.Dial("tcp", ln.Addr().String()); err != nil {
+		t.Fatal(err)
+	} else {
+		conn.Close()
+	}
+	session.Disconnect()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("listener kept accepting after the session closed")
+	}
+	next, nextPort, err := fp.listenTcp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Close()
+	if nextPort != port {
+		t.Errorf("next tunnel got port %d, want the released %d", nextPort, port)
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"sync"
+)
+
+// SessionRegistry maps session keys to live sessions. Sessions are closed
+// when they are removed from the registry, lookups never return a session
+// which is closing.
+type SessionRegistry struct {
+	sessions map[string]*Session
+	mut      sync.RWMutex
+}
+
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (sr *SessionRegistry) Lookup(key string) *Session {
+	sr.mut.RLock()
+	session := sr.sessions[key]
+	sr.mut.RUnlock()
+	if session == nil || session.State() != SessionActive {
+		return nil
+	}
+	return session
+}
+
+// Session registered with the key, sessions waiting to be resumed included
+func (sr *SessionRegistry) Get(key string) *Session {
+	sr.mut.RLock()
+	session := sr.sessions[key]
+	sr.mut.RUnlock()
+	if session == nil {
+		return nil
+	}
+	state := session.State()
+	if state != SessionActive && state != SessionOffline {
+		return nil
+	}
+	return session
+}
+
+// Register a session, a previous session with the same key is closed
+func (sr *SessionRegistry) Add(session *Session) {
+	sr.mut.Lock()
+	previous := sr.sessions[session.key]
+	sr.sessions[session.key] = session
+	sr.mut.Unlock()
+	if previous != nil && previous != session {
+		previous.Disconnect()
+	}
+}
+
+// Register a session unless the key is held by a live session of another
+// owner, a previous session of the same owner is closed
+func (sr *SessionRegistry) Claim(session *Session) error {
+	sr.mut.Lock()
+	previous := sr.sessions[session.key]
+	if previous != nil && previous != session && previous.owner != session.owner {
+		if state := previous.State(); state == SessionActive || state == SessionOffline {
+			sr.mut.Unlock()
+			return ErrProxySubdomainInUse
+		}
+	}
+	sr.sessions[session.key] = session
+	sr.mut.Unlock()
+	if previous != nil && previous != session {
+		previous.Disconnect()
+	}
+	return nil
+}
+
+// Remove and close the session registered with the key
+func (sr *SessionRegistry) Delete(key string) *Session {
+	sr.mut.Lock()
+	session := sr.sessions[key]
+	delete(sr.sessions, key)
+	sr.mut.Unlock()
+	if session != nil {
+		session.Disconnect()
+	}
+	return session
+}
+
+// Remove and close the session only if it is still the one registered with
+// its key, a newer session for the same key is left alone
+func (sr *SessionRegistry) Remove(session *Session) bool {
+	sr.mut.Lock()
+	current := sr.sessions[session.key] == session
+	if current {
+		delete(sr.sessions, session.key)
+	}
+	sr.mut.Unlock()
+	session.Disconnect()
+	return current
+}
+
+func (sr *SessionRegistry) Sessions() []*Session {
+	sr.mut.RLock()
+	defer sr.mut.RUnlock()
+	sessions := make([]*Session, 0, len(sr.sessions))
+	for _, session := range sr.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Number of sessions opened by the owner, not counting the session with the
+// given key which is about to be replaced
+func (sr *SessionRegistry) CountOwner(owner string, except string) int {
+	sr.mut.RLock()
+	defer sr.mut.RUnlock()
+	count := 0
+	for key, session := range sr.sessions {
+		if session.owner != owner || key == except {
+			continue
+		}
+		if state := session.State(); state == SessionActive || state == SessionOffline {
+			count += 1
+		}
+	}
+	return count
+}
+
+func (sr *SessionRegistry) Len() int {
+	sr.mut.RLock()
+	defer sr.mut.RUnlock()
+	return len(sr.sessions)
+}
+
+// Remove and close every session
+func (sr *SessionRegistry) Close() []*Session {
+	sr.mut.Lock()
+	sessions := make([]*Session, 0, len(sr.sessions))
+	for key, session := range sr.sessions {
+		sessions = append(sessions, session)
+		delete(sr.sessions, key)
+	}
+	sr.mut.Unlock()
+	for _, session := range sessions {
+		session.Disconnect()
+	}
+	return sessions
+}
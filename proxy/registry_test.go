@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+)
+
+var testLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestSessionRegistry(t *testing.T) {
+	tests := []struct {
+		name   string
+		run    func(registry *SessionRegistry, first *Session, second *Session)
+		closed []bool
+	}{
+		{
+			name:   "add",
+			run:    func(registry *SessionRegistry, first *Session, second *Session) { registry.Add(first) },
+			closed: []bool{false, false},
+		},
+		{
+			name: "add replaces",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Add(first)
+				registry.Add(second)
+			},
+			closed: []bool{true, false},
+		},
+		{
+			name: "delete",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Add(first)
+				registry.Delete(first.Key())
+			},
+			closed: []bool{true, false},
+		},
+		{
+			name: "delete unknown key",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Add(first)
+				registry.Delete("other")
+			},
+			closed: []bool{false, false},
+		},
+		{
+			name: "remove replaced session",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Add(first)
+				registry.Add(second)
+				registry.Remove(first)
+			},
+			closed: []bool{true, false},
+		},
+		{
+			name: "claim replaces the same owner",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Claim(first)
+				if err := registry.Claim(second); err != nil {
+					t.Error(err)
+				}
+			},
+			closed: []bool{true, false},
+		},
+		{
+			name: "claim keeps another owner",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Claim(first)
+				second.owner = "other"
+				if err := registry.Claim(second); err != ErrProxySubdomainInUse {
+					t.Errorf("claim error %v, want %v", err, ErrProxySubdomainInUse)
+				}
+			},
+			closed: []bool{false, false},
+		},
+		{
+			name: "claim after a closed session",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Claim(first)
+				first.Disconnect()
+				second.owner = "other"
+				if err := registry.Claim(second); err != nil {
+					t.Error(err)
+				}
+			},
+			closed: []bool{true, false},
+		},
+		{
+			name: "close",
+			run: func(registry *SessionRegistry, first *Session, second *Session) {
+				registry.Add(first)
+				registry.Close()
+			},
+			closed: []bool{true, false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := NewSessionRegistry()
+			sessions := []*Session{
+				NewSession("web", testLogger, 0, time.Second),
+				NewSession("web", testLogger, 0, time.Second),
+			}
+			test.run(registry, sessions[0], sessions[1])
+
+			var want *Session
+			for idx, session := range sessions {
+				closed := session.State() == SessionClosed
+				if closed != test.closed[idx] {
+					t.Errorf("session %d closed %v, want %v", idx, closed, test.closed[idx])
+				}
+				if !closed && want == nil {
+					want = session
+				}
+			}
+			if registry.Len() == 0 {
+				want = nil
+			}
+			if got := registry.Lookup("web"); got != want {
+				t.Errorf("lookup returned %p, want %p", got, want)
+			}
+			if registry.Lookup("missing") != nil || registry.Get("missing") != nil {
+				t.Error("lookup of a missing key returned a session")
+			}
+		})
+	}
+}
+
+// Owners racing for the same key, only one of them gets it
+func TestSessionRegistryClaimParallel(t *testing.T) {
+	registry := NewSessionRegistry()
+	var wg sync.WaitGroup
+	claimed := make(chan *Session, 16)
+	for owner := 0; owner < 16; owner++ {
+		wg.Add(1)
+		go func(owner int) {
+			defer wg.Done()
+			session := NewSession("web", testLogger, 0, time.Second)
+			session.owner = fmt.Sprintf("owner-%d", owner)
+			err := registry.Claim(session)
+			if err == nil {
+				claimed <- session
+			} else if err != ErrProxySubdomainInUse {
+				t.Error(err)
+			}
+		}(owner)
+	}
+	wg.Wait()
+	close(claimed)
+	if len(claimed) != 1 {
+		t.Fatalf("%d owners claimed the key, want 1", len(claimed))
+	}
+	if session := <-claimed; registry.Lookup("web") != session {
+		t.Error("the key is registered with another session")
+	}
+}
+
+// Answer one request on the client end of a pooled connection
+func serveTestConnection(conn net.Conn) {
+	defer conn.Close()
+	request, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	request.Body.Close()
+	io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+}
+
+func forwardTestRequest(session *Session) error {
+	visitorConn, visitor := net.Pipe()
+	defer visitor.Close()
+	go io.Copy(io.Discard, visitor)
+	request := &headers.HttpRequestHeader{Method: "GET", Path: "/", Protocol: "HTTP/1.1"}
+	_, err := session.Forward(request, bufio.NewReader(visitorConn), visitorConn)
+	visitorConn.Close()
+	return err
+}
+
+// Creates, joins, forwards and deletes race each other on a handful of keys,
+// meant to be run with -race
+func TestSessionRegistryParallel(t *testing.T) {
+	registry := NewSessionRegistry()
+	keys := []string{"a", "b", "c"}
+	var wg sync.WaitGroup
+	failures := make(chan error, 1024)
+
+	for worker := 0; worker < 12; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				key := keys[(worker+round)%len(keys)]
+				switch (worker + round) % 4 {
+				case 0:
+					session := NewSession(key, testLogger, 4, 50*time.Millisecond)
+					registry.Add(session)
+				case 1:
+					session := registry.Lookup(key)
+					if session == nil {
+						continue
+					}
+					if err := session.Reserve(); err != nil {
+						continue
+					}
+					conn, client := net.Pipe()
+					go serveTestConnection(client)
+					session.Join(fmt.Sprintf("%d-%d", worker, round), conn, false)
+				case 2:
+					session := registry.Lookup(key)
+					if session == nil {
+						continue
+					}
+					err := forwardTestRequest(session)
+					if err != nil &&
+						!errors.Is(err, ErrSessionClosed) &&
+						!errors.Is(err, ErrForwardFailedQueueFull) &&
+						!errors.Is(err, ErrForwardFailedQueueTimeout) &&
+						!errors.Is(err, io.ErrClosedPipe) &&
+						!errors.Is(err, io.EOF) {
+						failures <- fmt.Errorf("forward on %s: %w", key, err)
+					}
+				case 3:
+					registry.Delete(key)
+				}
+				registry.Sessions()
+				registry.CountOwner("", key)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	close(failures)
+	for err := range failures {
+		t.Error(err)
+	}
+
+	for _, session := range registry.Close() {
+		if session.State() != SessionClosed {
+			t.Errorf("session %s left in state %s", session.Key(), session.State())
+		}
+	}
+	if registry.Len() != 0 {
+		t.Errorf("%d sessions left after close", registry.Len())
+	}
+}
+
+// Requests queue up behind a pool smaller than their number, every one is
+// answered once the client joins a connection for it
+func TestSessionForwardParallel(t *testing.T) {
+	session := NewSession("web", testLogger, 16, 5*time.Second)
+	defer session.Disconnect()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for idx := 0; idx < 16; idx++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- forwardTestRequest(session)
+		}()
+		go func(idx int) {
+			defer wg.Done()
+			// A full pool frees a slot with every answered request
+			for session.Reserve() != nil {
+				time.Sleep(time.Millisecond)
+			}
+			conn, client := net.Pipe()
+			go serveTestConnection(client)
+			session.Join(fmt.Sprint(idx), conn, false)
+		}(idx)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if connected := session.Connected(); connected != 0 {
+		t.Errorf("%d connections left in the pool", connected)
+	}
+}
@@ -1,17 +1,21 @@
 package proxy
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
-	"math"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/mux"
 )
 
 const DUMMY_KEY string = "0000000000000000000000000000000000000000000"
@@ -36,18 +40,60 @@ func toIp(addr string, port string) (string, error) {
 
 type ReverseProxy struct {
 	Addr   Addr
-	Logger *log.Logger
+	Logger *slog.Logger
 	Proxy  string
 	Key    string
 	Quitch chan error
+	// Tunnel protocol, defaults to http
+	Protocol string
+	// Subdomain to claim for an HTTP tunnel, the proxy picks one if empty
+	Subdomain string
+	// Connect to the control channel over TLS if set
+	Tls *tls.Config
+	// The control connection is pinged every interval, no pings are sent
+	// if zero
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
 
-	sessionKey  string
+	// Replaced as a whole every time the session is created again, other
+	// goroutines read it while the tunnel reconnects
+	session     atomic.Pointer[tunnelSession]
 	waitGroup   *sync.WaitGroup
 	connections chan int
 	proxyIp     string
+	proxyIpMut  sync.Mutex
+	done        chan struct{}
+	stats       *requestStats
+	online      atomic.Bool
+	reconnects  atomic.Int64
+	// Pooled connections waiting for a request and forwarding one
+	idle atomic.Int64
+	busy atomic.Int64
+}
+
+// The session the proxy created for the tunnel
+type tunnelSession struct {
+	key         string
+	resumeToken string
+	resumed     bool
+	port        int
+	scheme      string
+	// Control connection, nil if the proxy does not multiplex
+	mux *mux.Session
+}
+
+// Session of the last connect, empty before the first one
+func (rp *ReverseProxy) current() *tunnelSession {
+	session := rp.session.Load()
+	if session == nil {
+		return &tunnelSession{}
+	}
+	return session
 }
 
 func (rp *ReverseProxy) ProxyURI() string {
+	rp.proxyIpMut.Lock()
+	defer rp.proxyIpMut.Unlock()
 	if rp.proxyIp != "" {
 		return rp.proxyIp
 	}
@@ -55,33 +101,94 @@ func (rp *ReverseProxy) ProxyURI() string {
 	return rp.proxyIp
 }
 
-func (rp *ReverseProxy) Connect() error {
-	conn, err := net.Dial("tcp", rp.ProxyURI())
+// Open a connection to the proxy control channel
+func (rp *ReverseProxy) dial() (net.Conn, error) {
+	if rp.Tls != nil {
+		return tls.Dial("tcp", rp.ProxyURI(), rp.Tls)
+	}
+	return net.Dial("tcp", rp.ProxyURI())
+}
+
+// Create the session on the proxy, the control connection is kept open and
+// multiplexed if the proxy supports it
+func (rp *ReverseProxy) createSession() error {
+	conn, err := rp.dial()
 	if err != nil {
 		return fmt.Errorf("Failed connecting to the proxy: %w", err)
 	}
 
-	createRequest := &headers.ProxyHeader{
-		Code: headers.ProxyRequestCreatePool,
+	createResponse, err := SendProxyRequest(conn, &headers.ProxyFrame{
+		Code: headers.RequestCreatePool,
 		Key:  rp.Key,
-	}
-	_, err = createRequest.Write(conn)
+		Payload: headers.MarshalPayload(headers.CreatePoolRequest{
+			Multiplex: true,
+			Protocol:  rp.Protocol,
+			Subdomain: rp.Subdomain,
+			Resume:    rp.current().resumeToken,
+		}),
+	})
 	if err != nil {
+		conn.Close()
 		return fmt.Errorf("Failed creating session: %w", err)
 	}
 
-	createResponse := &headers.ProxyHeader{}
-	err = createResponse.Read(conn)
+	if createResponse.Code == headers.ResponseAuthError {
+		conn.Close()
+		return ErrProxyAuth
+	}
+
+	if createResponse.Code == headers.ResponseForbidden {
+		conn.Close()
+		return fmt.Errorf("%w; %w", ErrProxyForbidden, createResponse.Err())
+	}
+
+	if createResponse.Code != headers.ResponseSuccess {
+		conn.Close()
+		return fmt.Errorf("Failed creating session: %w", createResponse.Err())
+	}
+
+	create := headers.CreatePoolResponse{}
+	err = createResponse.Decode(&create)
 	if err != nil {
-		return fmt.Errorf("Could not get the response from the proxy: %w", err)
+		conn.Close()
+		return fmt.Errorf("Could not parse the response from the proxy: %w", err)
 	}
 
-	if createResponse.Code == headers.ProxyResponseAuthError {
-		return ErrProxyAuth
+	session := &tunnelSession{
+		key:         create.Session,
+		resumeToken: create.Resume,
+		resumed:     create.Resumed,
+		port:        create.Port,
+		scheme:      create.Scheme,
+	}
+	if create.Multiplex {
+		session.mux = mux.Client(conn)
+		if rp.HeartbeatInterval > 0 {
+			session.mux.Keepalive(rp.HeartbeatInterval, rp.HeartbeatTimeout)
+		}
+	} else {
+		conn.Close()
+	}
+	rp.session.Store(session)
+	return nil
+}
+
+func (rp *ReverseProxy) Connect() error {
+	if rp.Protocol == "" {
+		rp.Protocol = headers.TunnelProtocolHttp
+	}
+	if rp.HeartbeatTimeout <= 0 {
+		rp.HeartbeatTimeout = DefaultHeartbeatTimeout
 	}
+	rp.stats = newRequestStats()
+	err := rp.createSession()
+	if err != nil {
+		return err
+	}
+	rp.online.Store(true)
 
-	rp.sessionKey = createResponse.Key
 	rp.Quitch = make(chan error)
+	rp.done = make(chan struct{})
 	rp.connections = make(chan int, MaxConnectionPoolSize)
 	for id := 0; id < MaxConnectionPoolSize; id++ {
 		rp.connections <- id
@@ -89,119 +196,313 @@ func (rp *ReverseProxy) Connect() error {
 	return nil
 }
 
+// Public address of the tunnel
+func (rp *ReverseProxy) URL() string {
+	session := rp.current()
+	if rp.Protocol != headers.TunnelProtocolHttp {
+		host := rp.Proxy
+		if h, _, err := net.SplitHostPort(rp.Proxy); err == nil {
+			host = h
+		}
+		return rp.Protocol + "://" + net.JoinHostPort(host, strconv.Itoa(session.port))
+	}
+	if session.scheme == "https" {
+		// The proxy address points to the control port, visitors use
+		// the HTTPS port
+		host := rp.Proxy
+		if h, _, err := net.SplitHostPort(rp.Proxy); err == nil {
+			host = h
+		}
+		if session.port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(session.port))
+		}
+		return "https://" + session.key + "." + host
+	}
+	return "http://" + session.key + "." + rp.Proxy
+}
+
 func (rp *ReverseProxy) Listen() {
-	var id int
-	var joinRequest *headers.ProxyHeader
-	var joinResponse *headers.ProxyHeader
-	var ticker *time.Ticker = time.NewTicker(3 * time.Second)
+	fmt.Println("Starting reverse proxy @", rp.URL())
+	if rp.current().mux != nil {
+		rp.listenMux()
+		return
+	}
+	rp.listenPool()
+}
 
-	fmt.Println("Starting reverse proxy @", "http://"+rp.sessionKey+"."+rp.Proxy)
+// Serve every stream the proxy opens on the control connection, and create
+// the session again if the control connection goes away or the proxy asks
+// to move to a new one
+func (rp *ReverseProxy) listenMux() {
+	var err error
+	backoff := Backoff{Min: ReconnectBackoffMin, Max: ReconnectBackoffMax}
 	for {
-		id = <-rp.connections
+		control := rp.current().mux
+		go rp.serveMux(control)
+		select {
+		case <-control.CloseChan():
+		case <-control.GoAwayChan():
+		case <-rp.done:
+			return
+		}
+
+		select {
+		case <-rp.done:
+			return
+		case <-control.CloseChan():
+			rp.Logger.Warn("Control connection closed", "error", control.Err())
+		default:
+			// Streams which are open finish on the old connection
+			rp.Logger.Info("Proxy is shutting down, reconnecting")
+		}
+		rp.online.Store(false)
+		backoff.Reset()
 		for {
-			proxyDial, err := net.Dial("tcp", rp.ProxyURI())
+			if !rp.sleep(backoff.Next()) {
+				return
+			}
+			err = rp.createSession()
+			if err == ErrProxyAuth {
+				rp.Quitch <- ErrProxyInvalidSessionKey
+				return
+			}
+			if errors.Is(err, ErrProxyForbidden) {
+				rp.Quitch <- err
+				return
+			}
 			if err != nil {
-				rp.Logger.Println("Failed connecting to the proxy:", err.Error())
-				<-ticker.C
+				rp.Logger.Warn("Failed reconnecting to the proxy", "error", err)
 				continue
 			}
+			break
+		}
+		select {
+		case <-rp.done:
+			// Disconnected while the session was created, it would
+			// not get closed otherwise
+			rp.current().mux.Close()
+			return
+		default:
+		}
+		rp.online.Store(true)
+		rp.reconnects.Add(1)
+		if rp.current().resumed {
+			rp.Logger.Info("Resumed the session", "url", rp.URL())
+		} else {
+			rp.Logger.Info("Reconnected to the proxy", "url", rp.URL())
+		}
+	}
+}
 
-			joinRequest = &headers.ProxyHeader{
-				Code:    headers.ProxyRequestJoinPool,
-				Key:     rp.sessionKey,
-				Message: strconv.Itoa(id),
-			}
-			_, err = joinRequest.Write(proxyDial)
+// Forward the streams of a control connection until it is closed
+func (rp *ReverseProxy) serveMux(control *mux.Session) {
+	for {
+		stream, err := control.Accept()
+		if err != nil {
+			return
+		}
+		go rp.ForwardStream(stream)
+	}
+}
+
+// Sleep for the delay, false if the reverse proxy is disconnecting meanwhile
+func (rp *ReverseProxy) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-rp.done:
+		return false
+	}
+}
+
+// Keep the pool full, every connection given back on rp.connections is
+// joined again
+func (rp *ReverseProxy) listenPool() {
+	var id int
+	var joinResponse *headers.ProxyFrame
+	backoff := Backoff{Min: ReconnectBackoffMin, Max: ReconnectBackoffMax}
+
+	for {
+		id = <-rp.connections
+		for {
+			proxyDial, err := rp.dial()
 			if err != nil {
-				rp.Logger.Println("Failed joining the proxy pool:", err.Error())
-				<-ticker.C
+				rp.Logger.Warn("Failed connecting to the proxy", "error", err)
+				if !rp.sleep(backoff.Next()) {
+					return
+				}
 				continue
 			}
 
-			joinResponse = &headers.ProxyHeader{}
-			err = joinResponse.Read(proxyDial)
+			joinResponse, err = SendProxyRequest(proxyDial, &headers.ProxyFrame{
+				Code: headers.RequestJoinPool,
+				Key:  rp.current().key,
+				Payload: headers.MarshalPayload(headers.JoinPoolRequest{
+					ID:        strconv.Itoa(id),
+					Heartbeat: true,
+					Resume:    rp.current().resumeToken,
+				}),
+			})
 			if err != nil {
-				rp.Logger.Println("Could not get the response from the proxy:", err.Error())
-				<-ticker.C
+				rp.Logger.Warn("Failed joining the proxy pool", "error", err)
+				proxyDial.Close()
+				if !rp.sleep(backoff.Next()) {
+					return
+				}
 				continue
 			}
 
-			if joinResponse.Code == headers.ProxyResponseMaxConnectionsLimitReached {
-				rp.Logger.Println("Max connections limit reached")
+			if joinResponse.Code == headers.ResponseMaxConnectionsLimitReached {
+				rp.Logger.Debug("Max connections limit reached")
+				proxyDial.Close()
 				break
 			}
 
-			if joinResponse.Code == headers.ProxyResponseAuthError {
+			if joinResponse.Code != headers.ResponseSuccess {
 				rp.Quitch <- ErrProxyInvalidSessionKey
 				return
 			}
 
-			// Wait until we get request
-			pumpBytes := make([]byte, 1)
-			proxyDial.Read(pumpBytes)
-			go rp.Forward(proxyDial, pumpBytes, id)
+			backoff.Reset()
+			join := headers.JoinPoolResponse{}
+			if len(joinResponse.Payload) > 0 {
+				joinResponse.Decode(&join)
+			}
+			go rp.waitPool(proxyDial, id, time.Duration(join.Heartbeat)*time.Millisecond)
 			break
 		}
 	}
 }
 
-func (rp *ReverseProxy) Forward(proxyDial net.Conn, pumpBytes []byte, id int) {
-	localDial, err := net.Dial("tcp", rp.Addr.ToString())
+// Wait for a request on a pooled connection and answer the pings the proxy
+// sends meanwhile. The connection is given up when a ping is missing for
+// twice the heartbeat interval, and joined again by listenPool.
+func (rp *ReverseProxy) waitPool(proxyDial net.Conn, id int, heartbeat time.Duration) {
+	rp.idle.Add(1)
+	pumpBytes := make([]byte, 1)
+	for {
+		if heartbeat > 0 {
+			proxyDial.SetReadDeadline(time.Now().Add(2 * heartbeat))
+		}
+		_, err := io.ReadFull(proxyDial, pumpBytes)
+		if err == nil && pumpBytes[0] == headers.ProxyHeaderV2 {
+			err = rp.pong(proxyDial, pumpBytes)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			rp.idle.Add(-1)
+			proxyDial.Close()
+			select {
+			case <-rp.done:
+				return
+			default:
+			}
+			rp.Logger.Warn("Lost pooled connection", "connection", id, "error", err)
+			rp.connections <- id
+			return
+		}
+		break
+	}
+	proxyDial.SetReadDeadline(time.Time{})
+	rp.idle.Add(-1)
+	rp.busy.Add(1)
+	rp.Forward(proxyDial, pumpBytes, id)
+	rp.busy.Add(-1)
+}
+
+// Answer a ping frame whose version byte has already been read
+func (rp *ReverseProxy) pong(proxyDial net.Conn, versionByte []byte) error {
+	ping := &headers.ProxyFrame{}
+	err := ping.ReadPartial(proxyDial, versionByte)
 	if err != nil {
-		rp.Logger.Println("Error connecting to local server:", err)
-		headers.HttpResponseCannotConnectToLocalserver.Write(proxyDial)
-		proxyDial.Close()
+		return err
+	}
+	if ping.Code != headers.RequestPing {
+		return fmt.Errorf("%w; got %s", ErrUnexpectedHeartbeat, ping.Code)
+	}
+	_, err = ping.Response(headers.ResponsePong, "", nil).Write(proxyDial)
+	return err
+}
+
+func (rp *ReverseProxy) Forward(proxyDial net.Conn, pumpBytes []byte, id int) {
+	requestHeader := rp.forward(proxyDial, pumpBytes)
+	rp.connections <- id
+	if requestHeader != nil {
+		rp.Logger.Info("Forwarded request", "request", "FORWARD", "connection", id, "method", requestHeader.Method, "path", requestHeader.Path)
+	}
+}
+
+func (rp *ReverseProxy) ForwardStream(stream *mux.Stream) {
+	switch rp.Protocol {
+	case headers.TunnelProtocolTcp:
+		rp.forwardTcp(stream)
 		return
+	case headers.TunnelProtocolUdp:
+		rp.forwardUdp(stream)
+		return
+	}
+	requestHeader := rp.forward(stream, nil)
+	if requestHeader != nil {
+		rp.Logger.Info("Forwarded request", "request", "FORWARD", "stream", stream.StreamID(), "method", requestHeader.Method, "path", requestHeader.Path)
 	}
+}
 
-	requestHeader := headers.HttpRequestHeader{
+// Forward a request to the local server and relay the response back, both
+// connections are closed once the response is complete
+func (rp *ReverseProxy) forward(proxyDial net.Conn, pumpBytes []byte) *headers.HttpRequestHeader {
+	defer proxyDial.Close()
+	reader := bufio.NewReader(proxyDial)
+	requestHeader := &headers.HttpRequestHeader{
 		Buffer: pumpBytes,
 	}
-	requestHeader.Read(proxyDial)
-	requestHeader.Write(localDial)
-	if requestHeader.Headers["Content-Length"] != "" {
-		contenLength, _ := strconv.Atoi(requestHeader.Headers["Content-Length"])
-		if contenLength <= HttpRequestPipeChunkSize {
-			pumpBytes = make([]byte, contenLength)
-			proxyDial.Read(pumpBytes)
-			localDial.Write(pumpBytes)
-		} else {
-			iter := int(math.Floor(float64(contenLength) / float64(HttpRequestPipeChunkSize)))
-			pumpBytes = make([]byte, HttpRequestPipeChunkSize)
-			for i := 0; i < iter; i++ {
-				proxyDial.Read(pumpBytes)
-				localDial.Write(pumpBytes)
-			}
-			pumpBytes = make([]byte, contenLength%HttpRequestPipeChunkSize)
-			proxyDial.Read(pumpBytes)
-			localDial.Write(pumpBytes)
-		}
+	err := requestHeader.Read(reader)
+	if err != nil {
+		rp.Logger.Warn("Error reading request", "error", err)
+		return nil
 	}
 
-	pumpBytes = make([]byte, 64)
-	for {
-		n, err := localDial.Read(pumpBytes)
-		if err != nil {
-			break
-		}
-		proxyDial.Write(pumpBytes[:n])
+	localDial, err := net.Dial("tcp", rp.Addr.ToString())
+	if err != nil {
+		rp.stats.fail(failureLocalDial)
+		rp.Logger.Error("Error connecting to local server", "addr", rp.Addr.ToString(), "error", err)
+		headers.HttpResponseCannotConnectToLocalserver.Write(proxyDial)
+		return nil
 	}
-	localDial.Close()
-	proxyDial.Close()
-	rp.connections <- id
-	rp.Logger.Println("/FORWARD Connection:", id, "->", requestHeader.Path, requestHeader.Method, requestHeader.Protocol)
+	defer localDial.Close()
+
+	start := time.Now()
+	exchange, err := forwardHttp(requestHeader, reader, proxyDial, localDial)
+	rp.stats.observe(exchange, err, time.Since(start))
+	if err != nil {
+		rp.Logger.Warn("Error forwarding request", "error", err)
+	}
+	return requestHeader
 }
 
 func (rp *ReverseProxy) Disconnect() {
-	rp.Logger.Println("Disconnecting...")
-	conn, err := net.Dial("tcp", rp.ProxyURI())
+	rp.Logger.Info("Disconnecting")
+	close(rp.done)
+	conn, err := rp.dial()
 	if err != nil {
 		// The proxy is not running
 		return
 	}
-	deleteSessionRequest := &headers.ProxyHeader{
-		Code: headers.ProxyRequestDeletePool,
-		Key:  rp.sessionKey,
+	defer conn.Close()
+	session := rp.current()
+	deleteSessionRequest := &headers.ProxyFrame{
+		Version: headers.ProxyHeaderV2,
+		Code:    headers.RequestDeletePool,
+		Key:     session.key,
+		Payload: headers.MarshalPayload(headers.DeletePoolRequest{
+			Resume: session.resumeToken,
+		}),
 	}
 	deleteSessionRequest.Write(conn)
+	if session.mux != nil {
+		session.mux.Close()
+	}
 }
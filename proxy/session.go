@@ -0,0 +1,536 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/mux"
+)
+
+type SessionState int32
+
+const SessionActive SessionState = 0
+const SessionClosing SessionState = 1
+const SessionClosed SessionState = 2
+
+// The control connection went away and the session waits for the client
+// to resume it
+const SessionOffline SessionState = 3
+
+func (ss SessionState) String() string {
+	switch ss {
+	case SessionActive:
+		return "active"
+	case SessionClosing:
+		return "closing"
+	case SessionClosed:
+		return "closed"
+	case SessionOffline:
+		return "offline"
+	}
+	return "unknown"
+}
+
+// Session holds the connections a reverse proxy has opened for a key, either
+// a pool of joined connections or a single multiplexed control connection.
+// Every method is safe to call from multiple goroutines.
+type Session struct {
+	key          string
+	connections  map[string]*Connection
+	free         []string
+	inUse        []string
+	connected    int
+	logger       *slog.Logger
+	mux          *mux.Session
+	queueSize    int
+	queueTimeout time.Duration
+	waiting      []chan string
+	state        SessionState
+	protocol     string
+	owner        string
+	listener     io.Closer
+	port         int
+	resumeToken  string
+	// The key is a subdomain anyone can see instead of a secret derived
+	// from the token
+	public       bool
+	offlineEpoch int
+	created      time.Time
+	stats        *requestStats
+	mut          sync.Mutex
+}
+
+// Traffic a session carried, TCP connections and UDP flows count as
+// requests and are added once they are closed
+type SessionTraffic struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+type PoolInfo struct {
+	Connected int `json:"connected"`
+	Free      int `json:"free"`
+	InUse     int `json:"in_use"`
+	Waiting   int `json:"waiting"`
+}
+
+// Snapshot of a session for the admin API
+type SessionInfo struct {
+	Key       string   `json:"key"`
+	Owner     string   `json:"owner,omitempty"`
+	Protocol  string   `json:"protocol"`
+	State     string   `json:"state"`
+	Port      int      `json:"port,omitempty"`
+	Created   int64    `json:"created"`
+	Multiplex bool     `json:"multiplex"`
+	Streams   int      `json:"streams"`
+	Remote    []string `json:"remote"`
+	// Only set for pooled sessions
+	Pool    *PoolInfo      `json:"pool,omitempty"`
+	Traffic SessionTraffic `json:"traffic"`
+}
+
+func NewSession(key string, logger *slog.Logger, queueSize int, queueTimeout time.Duration) *Session {
+	return &Session{
+		key:          key,
+		connections:  make(map[string]*Connection, MaxConnectionPoolSize),
+		free:         make([]string, 0),
+		inUse:        make([]string, 0),
+		logger:       logger.With("session", key),
+		queueSize:    queueSize,
+		queueTimeout: queueTimeout,
+		state:        SessionActive,
+		protocol:     headers.TunnelProtocolHttp,
+		created:      time.Now(),
+		stats:        newRequestStats(),
+	}
+}
+
+// Count traffic the session carried
+func (s *Session) addTraffic(requests int64, in int64, out int64) {
+	s.stats.addTraffic(requests, in, out)
+}
+
+func (s *Session) Traffic() SessionTraffic {
+	return s.stats.traffic()
+}
+
+func (s *Session) Info() SessionInfo {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	info := SessionInfo{
+		Key:       s.key,
+		Owner:     s.owner,
+		Protocol:  s.protocol,
+		State:     s.state.String(),
+		Port:      s.port,
+		Created:   s.created.Unix(),
+		Multiplex: s.mux != nil,
+		Remote:    []string{},
+		Traffic:   s.Traffic(),
+	}
+	if s.mux != nil {
+		info.Streams = s.mux.NumStreams()
+		info.Remote = append(info.Remote, s.mux.RemoteAddr().String())
+		return info
+	}
+	if s.state == SessionOffline {
+		return info
+	}
+	info.Pool = &PoolInfo{
+		Connected: s.connected,
+		Free:      len(s.free),
+		InUse:     len(s.inUse),
+		Waiting:   len(s.waiting),
+	}
+	for _, connection := range s.connections {
+		info.Remote = append(info.Remote, connection.conn.RemoteAddr().String())
+	}
+	sort.Strings(info.Remote)
+	return info
+}
+
+func (s *Session) Protocol() string {
+	return s.protocol
+}
+
+// Identity of the token or client certificate which opened the session
+func (s *Session) Owner() string {
+	return s.owner
+}
+
+// Open a stream to the reverse proxy on the multiplexed control connection
+func (s *Session) Open() (net.Conn, error) {
+	s.mut.Lock()
+	control := s.mux
+	state := s.state
+	s.mut.Unlock()
+	if state != SessionActive {
+		return nil, ErrSessionClosed
+	}
+	if control == nil {
+		return nil, ErrSessionNotMultiplexed
+	}
+	return control.Open()
+}
+
+func (s *Session) Key() string {
+	return s.key
+}
+
+func (s *Session) State() SessionState {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.state
+}
+
+func (s *Session) Connected() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.connected
+}
+
+// Attach the multiplexed control connection, the session is closed when the
+// control connection goes away
+func (s *Session) Multiplex(conn net.Conn) *mux.Session {
+	session := mux.Server(conn)
+	s.mut.Lock()
+	s.mux = session
+	s.mut.Unlock()
+	return session
+}
+
+// Ask the client to move to a new control connection, streams which are
+// open keep working until the session is closed
+func (s *Session) GoAway() {
+	s.mut.Lock()
+	control := s.mux
+	s.mut.Unlock()
+	if control != nil {
+		control.GoAway(mux.GoAwayNormal)
+	}
+}
+
+// Whether a client presenting the resume token can take the session over
+func (s *Session) Resumable(resumeToken string, owner string, protocol string) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.state != SessionActive && s.state != SessionOffline {
+		return false
+	}
+	// Pooled sessions have no control connection to replace
+	if s.state == SessionActive && s.mux == nil {
+		return false
+	}
+	return resumeToken != "" &&
+		s.resumeToken == resumeToken &&
+		s.owner == owner &&
+		s.protocol == protocol
+}
+
+// Whether a JOIN or DELETE request comes from the owner of the session.
+// Keys derived from the token are secret, sessions keyed by a subdomain
+// need the resume token as well.
+func (s *Session) Authorized(resumeToken string) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !s.public {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(resumeToken), []byte(s.resumeToken)) == 1
+}
+
+// Attach a new control connection to the session, the previous one is
+// closed in case it is still around
+func (s *Session) Resume(conn net.Conn) (*mux.Session, error) {
+	s.mut.Lock()
+	if s.state != SessionActive && s.state != SessionOffline {
+		s.mut.Unlock()
+		return nil, ErrSessionClosed
+	}
+	previous := s.mux
+	session := mux.Server(conn)
+	s.mux = session
+	s.state = SessionActive
+	s.mut.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return session, nil
+}
+
+// Take the session offline if the control connection is still the one in
+// use, returns the epoch to reap the session with
+func (s *Session) Offline(control *mux.Session) (int, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.state != SessionActive || s.mux != control {
+		return 0, false
+	}
+	s.state = SessionOffline
+	s.mux = nil
+	s.offlineEpoch += 1
+	return s.offlineEpoch, true
+}
+
+// Whether the session is still offline since the given epoch
+func (s *Session) Reapable(epoch int) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.state == SessionOffline && s.offlineEpoch == epoch
+}
+
+// Reserve a slot in the pool before the join is acknowledged, so concurrent
+// joins cannot grow the pool past MaxConnectionPoolSize
+func (s *Session) Reserve() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.state != SessionActive {
+		return ErrSessionClosed
+	}
+	if s.connected >= MaxConnectionPoolSize {
+		return ErrProxyMaxConnectionsLimitReached
+	}
+	s.connected += 1
+	return nil
+}
+
+func (s *Session) Unreserve() {
+	s.mut.Lock()
+	s.connected -= 1
+	s.mut.Unlock()
+}
+
+// Add a connection to a slot taken with Reserve, heartbeat tells whether the
+// client answers pings on it
+func (s *Session) Join(id string, conn net.Conn, heartbeat bool) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.state != SessionActive {
+		s.connected -= 1
+		conn.Close()
+		return ErrSessionClosed
+	}
+	s.connections[id] = &Connection{
+		conn:      conn,
+		heartbeat: heartbeat,
+	}
+	s.put(id)
+	return nil
+}
+
+// Make a connection available, the caller holds the lock
+func (s *Session) put(id string) {
+	connection := s.connections[id]
+	if len(s.waiting) > 0 {
+		// Hand the connection straight to the request waiting the longest
+		waiter := s.waiting[0]
+		s.waiting = s.waiting[1:]
+		connection.free = false
+		s.inUse = append(s.inUse, id)
+		waiter <- id
+		return
+	}
+	connection.free = true
+	s.free = append(s.free, id)
+}
+
+// Ping the free connections of the pool which answer heartbeats, the ones
+// which do not answer in time are closed and dropped so the client can open
+// new ones. Returns the number of dropped connections.
+func (s *Session) Heartbeat(timeout time.Duration) int {
+	s.mut.Lock()
+	if s.state != SessionActive {
+		s.mut.Unlock()
+		return 0
+	}
+	idle := make(map[string]*Connection)
+	free := make([]string, 0, len(s.free))
+	for _, id := range s.free {
+		connection := s.connections[id]
+		if !connection.heartbeat {
+			free = append(free, id)
+			continue
+		}
+		// Nobody can pick the connection up while the ping is in flight
+		connection.free = false
+		idle[id] = connection
+	}
+	s.free = free
+	s.mut.Unlock()
+
+	var wg sync.WaitGroup
+	var dropped atomic.Int32
+	for id, connection := range idle {
+		wg.Add(1)
+		go func(id string, connection *Connection) {
+			defer wg.Done()
+			err := connection.Ping(timeout)
+			if err != nil {
+				connection.conn.Close()
+				s.release(id)
+				dropped.Add(1)
+				s.logger.Warn("Dropped connection, ping failed", "request", "PING", "connection", id, "error", err)
+				return
+			}
+			s.mut.Lock()
+			defer s.mut.Unlock()
+			if s.state == SessionActive {
+				s.put(id)
+			}
+		}(id, connection)
+	}
+	wg.Wait()
+	return int(dropped.Load())
+}
+
+// Close the session and every connection it holds, requests waiting for a
+// connection fail right away. Calling it more than once is a no-op.
+func (s *Session) Disconnect() {
+	s.mut.Lock()
+	if s.state == SessionClosing || s.state == SessionClosed {
+		s.mut.Unlock()
+		return
+	}
+	s.state = SessionClosing
+	for _, waiter := range s.waiting {
+		close(waiter)
+	}
+	s.waiting = nil
+	for id, connection := range s.connections {
+		s.logger.Debug("Closed connection", "request", "DELETE", "connection", id)
+		connection.conn.Close()
+	}
+	control := s.mux
+	listener := s.listener
+	s.mut.Unlock()
+
+	if control != nil {
+		control.Close()
+	}
+	if listener != nil {
+		listener.Close()
+	}
+
+	s.mut.Lock()
+	s.state = SessionClosed
+	s.mut.Unlock()
+}
+
+// Take a free connection from the pool, if there is none wait in the queue
+// until one joins or the queue timeout expires
+func (s *Session) acquire() (*Connection, string, error) {
+	s.mut.Lock()
+	if s.state != SessionActive {
+		s.mut.Unlock()
+		return nil, "", ErrSessionClosed
+	}
+	if len(s.free) > 0 {
+		id := s.free[0]
+		s.free = s.free[1:]
+		s.inUse = append(s.inUse, id)
+		connection := s.connections[id]
+		connection.free = false
+		s.mut.Unlock()
+		return connection, id, nil
+	}
+	if len(s.waiting) >= s.queueSize {
+		s.mut.Unlock()
+		return nil, "", ErrForwardFailedQueueFull
+	}
+	waiter := make(chan string, 1)
+	s.waiting = append(s.waiting, waiter)
+	s.mut.Unlock()
+
+	timer := time.NewTimer(s.queueTimeout)
+	defer timer.Stop()
+	select {
+	case id, ok := <-waiter:
+		return s.waited(id, ok)
+	case <-timer.C:
+	}
+
+	s.mut.Lock()
+	for idx, w := range s.waiting {
+		if w == waiter {
+			s.waiting = append(s.waiting[:idx], s.waiting[idx+1:]...)
+			s.mut.Unlock()
+			return nil, "", ErrForwardFailedQueueTimeout
+		}
+	}
+	s.mut.Unlock()
+	// A connection was handed over while the timer fired
+	id, ok := <-waiter
+	return s.waited(id, ok)
+}
+
+func (s *Session) waited(id string, ok bool) (*Connection, string, error) {
+	if !ok {
+		return nil, "", ErrSessionClosed
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.connections[id], id, nil
+}
+
+func (s *Session) release(id string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	delete(s.connections, id)
+	for idx, inUse := range s.inUse {
+		if inUse == id {
+			s.inUse = append(s.inUse[:idx], s.inUse[idx+1:]...)
+			break
+		}
+	}
+	s.connected -= 1
+}
+
+// Forward a visitor request through the session, the caller closes the
+// visitor connection when an error is returned
+func (s *Session) Forward(requestHeader *headers.HttpRequestHeader, visitor *bufio.Reader, visitorConn net.Conn) (*HttpExchange, error) {
+	s.mut.Lock()
+	control := s.mux
+	state := s.state
+	s.mut.Unlock()
+
+	if state != SessionActive {
+		headers.HttpResponseNoSessionFound.Write(visitorConn)
+		return nil, ErrSessionClosed
+	}
+
+	if control != nil {
+		stream, err := control.Open()
+		if err != nil {
+			// Same answer as a pool which stays exhausted for the queue
+			// timeout
+			response := headers.MakeRetryAfterResponse(s.queueTimeout)
+			response.Write(visitorConn)
+			return nil, fmt.Errorf("%w; could not open stream: %w", ErrForwardFailedNoFreeConnection, err)
+		}
+		connection := &Connection{conn: stream}
+		return connection.Forward(requestHeader, visitor, visitorConn)
+	}
+
+	connection, id, err := s.acquire()
+	if err != nil {
+		response := headers.MakeRetryAfterResponse(s.queueTimeout)
+		_, writeErr := response.Write(visitorConn)
+		if writeErr != nil {
+			return nil, fmt.Errorf("%v; Error writing response: %v", err, writeErr)
+		}
+		return nil, err
+	}
+	defer s.release(id)
+	return connection.Forward(requestHeader, visitor, visitorConn)
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+)
+
+// A multiplexed session which can't open a stream answers like an
+// exhausted pool does
+func TestForwardNoFreeStream(t *testing.T) {
+	session := NewSession("web", testLogger, 0, 3*time.Second)
+	controlConn, peer := net.Pipe()
+	defer peer.Close()
+	session.Multiplex(controlConn).Close()
+
+	visitorConn, visitor := net.Pipe()
+	defer visitor.Close()
+	request := &headers.HttpRequestHeader{Method: "GET", Path: "/", Protocol: "HTTP/1.1"}
+	done := make(chan error, 1)
+	go func() {
+		_, err := session.Forward(request, bufio.NewReader(visitorConn), visitorConn)
+		visitorConn.Close()
+		done <- err
+	}()
+
+	response, err := http.ReadResponse(bufio.NewReader(visitor), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusServiceUnavailable || response.Header.Get("Retry-After") != "3" {
+		t.Errorf("response %d with Retry-After %q, want 503 with 3", response.StatusCode, response.Header.Get("Retry-After"))
+	}
+	if err := <-done; !errors.Is(err, ErrForwardFailedNoFreeConnection) {
+		t.Errorf("error %v, want %v", err, ErrForwardFailedNoFreeConnection)
+	}
+}
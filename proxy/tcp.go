@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"net"
+	"strconv"
+)
+
+// Accept connections on the public port of a TCP tunnel until the session
+// closes the listener, the port goes back to the allocator afterwards
+func (fp *ForwardProxy) serveTcp(session *Session, ln net.Listener, port int) {
+	defer fp.tcpPorts.Release(port)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go fp.forwardTcp(session, conn)
+	}
+}
+
+func (fp *ForwardProxy) forwardTcp(session *Session, conn net.Conn) {
+	defer fp.track()()
+	defer conn.Close()
+	stream, err := session.Open()
+	if err != nil {
+		fp.Logger.Warn("Could not open a stream", "request", "TCP", "session", session.Key(), "remote", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	defer stream.Close()
+	in, out := splice(conn, conn, stream, stream)
+	session.addTraffic(1, in, out)
+	fp.Logger.Info("Connection closed", "request", "TCP", "session", session.Key(), "remote", conn.RemoteAddr().String(), "bytes_in", in, "bytes_out", out)
+}
+
+func (fp *ForwardProxy) listenTcp() (net.Listener, int, error) {
+	var ln net.Listener
+	port, err := fp.tcpPorts.Acquire(func(port int) error {
+		var err error
+		ln, err = net.Listen("tcp", fp.Addr.Host+":"+strconv.Itoa(port))
+		return err
+	})
+	return ln, port, err
+}
+
+// Splice a stream opened by the forward proxy to the local port
+func (rp *ReverseProxy) forwardTcp(stream net.Conn) {
+	defer stream.Close()
+	localDial, err := net.Dial("tcp", rp.Addr.ToString())
+	if err != nil {
+		rp.stats.fail(failureLocalDial)
+		rp.Logger.Error("Error connecting to local server", "addr", rp.Addr.ToString(), "error", err)
+		return
+	}
+	defer localDial.Close()
+	in, out := splice(stream, stream, localDial, localDial)
+	rp.stats.addTraffic(1, in, out)
+	rp.Logger.Info("Connection closed", "request", "TCP", "bytes_in", in, "bytes_out", out)
+}
@@ -0,0 +1,490 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Interval the certificate files are checked for changes
+const CertificateReloadInterval time.Duration = 30 * time.Second
+
+const DefaultAcmeCacheDir string = "certs"
+
+type TlsConfig struct {
+	// Address of the HTTPS listener
+	Addr Addr
+	// Certificate and key served for every host the certificate covers,
+	// usually a wildcard like *.tunnel.example.com
+	CertFile string
+	KeyFile  string
+	// Obtain certificates for tunnel hosts from an ACME server, using the
+	// tls-alpn-01 challenge on the HTTPS listener
+	Acme          bool
+	AcmeDirectory string
+	AcmeEmail     string
+	AcmeCacheDir  string
+	// PEM file with the root of the ACME server, for test servers like Pebble
+	AcmeCaRoot string
+	// Redirect plain HTTP visitors to HTTPS
+	Redirect bool
+}
+
+// CertificateStore holds a certificate loaded from disk and replaces it when
+// the files change, connections which are already established keep theirs
+type CertificateStore struct {
+	certFile    string
+	keyFile     string
+	certificate *tls.Certificate
+	modTime     time.Time
+	mut         sync.RWMutex
+}
+
+func LoadCertificateStore(certFile string, keyFile string) (*CertificateStore, error) {
+	store := &CertificateStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	_, err := store.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (cs *CertificateStore) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{cs.certFile, cs.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// Load the certificate again if the files changed since the last load,
+// returns whether a new certificate is in use
+func (cs *CertificateStore) Reload() (bool, error) {
+	modTime, err := cs.lastModified()
+	if err != nil {
+		return false, err
+	}
+	cs.mut.RLock()
+	unchanged := cs.certificate != nil && modTime.Equal(cs.modTime)
+	cs.mut.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(cs.certFile, cs.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("Error loading certificate: %w", err)
+	}
+	if certificate.Leaf == nil {
+		certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return false, fmt.Errorf("Error parsing certificate: %w", err)
+		}
+	}
+
+	cs.mut.Lock()
+	cs.certificate = &certificate
+	cs.modTime = modTime
+	cs.mut.Unlock()
+	return true, nil
+}
+
+func (cs *CertificateStore) Certificate() *tls.Certificate {
+	cs.mut.RLock()
+	defer cs.mut.RUnlock()
+	return cs.certificate
+}
+
+// Whether the certificate is valid for the host name
+func (cs *CertificateStore) Covers(serverName string) bool {
+	certificate := cs.Certificate()
+	return serverName == "" || certificate.Leaf.VerifyHostname(serverName) == nil
+}
+
+func (fp *ForwardProxy) setupTls() error {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: fp.getCertificate,
+		// Visitors are served over HTTP/1.1 only
+		NextProtos: []string{"http/1.1"},
+	}
+
+	if fp.Tls.CertFile != "" {
+		store, err := LoadCertificateStore(fp.Tls.CertFile, fp.Tls.KeyFile)
+		if err != nil {
+			return err
+		}
+		fp.certificates = store
+		fp.Logger.Info("Using certificate", "file", fp.Tls.CertFile, "names", strings.Join(store.Certificate().Leaf.DNSNames, ", "))
+	}
+
+	if fp.Tls.Acme {
+		if fp.BaseDomain == "" {
+			return ErrAcmeNeedsBaseDomain
+		}
+		manager, err := fp.acmeManager()
+		if err != nil {
+			return err
+		}
+		fp.acme = manager
+		config.NextProtos = append(config.NextProtos, acme.ALPNProto)
+		fp.Logger.Info("Obtaining certificates with ACME", "directory", manager.Client.DirectoryURL)
+	}
+
+	if fp.certificates == nil && fp.acme == nil {
+		return ErrNoCertificateSource
+	}
+
+	ln, err := fp.listen(ListenerHttps, fp.Tls.Addr.ToString())
+	if err != nil {
+		return err
+	}
+	fp.tlsTcpLn = ln
+	fp.TlsLn = tls.NewListener(ln, config)
+	return nil
+}
+
+func (fp *ForwardProxy) acmeManager() (*autocert.Manager, error) {
+	directory := fp.Tls.AcmeDirectory
+	if directory == "" {
+		directory = autocert.DefaultACMEDirectory
+	}
+	cacheDir := fp.Tls.AcmeCacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultAcmeCacheDir
+	}
+
+	client := &acme.Client{DirectoryURL: directory}
+	if fp.Tls.AcmeCaRoot != "" {
+		data, err := os.ReadFile(fp.Tls.AcmeCaRoot)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s", fp.Tls.AcmeCaRoot)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: fp.acmeHostPolicy,
+		Email:      fp.Tls.AcmeEmail,
+		Client:     client,
+	}, nil
+}
+
+// Only ask for certificates for hosts with a live tunnel, so visitors can't
+// make the proxy burn through the rate limits of the ACME server. Hosts are
+// a single label under the base domain or a verified custom domain
+func (fp *ForwardProxy) acmeHostPolicy(ctx context.Context, host string) error {
+	var sessionKey string
+	if domain, ok := fp.domains.Route(host); ok {
+		sessionKey = domain.Subdomain
+	} else if label, found := strings.CutSuffix(host, "."+fp.BaseDomain); found && fp.BaseDomain != "" && isDnsLabel(label) {
+		sessionKey = label
+	} else {
+		return fmt.Errorf("%s is not a tunnel host", host)
+	}
+	if fp.sessions.Lookup(sessionKey) == nil {
+		return fmt.Errorf("No session found for %s", host)
+	}
+	return nil
+}
+
+func isAcmeChallenge(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acme.ALPNProto
+}
+
+// The configured certificate is used for every host it covers, ACME takes
+// care of the rest and of its own challenges
+func (fp *ForwardProxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if fp.certificates != nil && !isAcmeChallenge(hello) {
+		if fp.acme == nil || fp.certificates.Covers(hello.ServerName) {
+			return fp.certificates.Certificate(), nil
+		}
+	}
+	if fp.acme != nil {
+		return fp.acme.GetCertificate(hello)
+	}
+	return nil, fmt.Errorf("No certificate for %s", hello.ServerName)
+}
+
+// Load the certificate files again if they changed
+func (fp *ForwardProxy) ReloadCertificates() {
+	for _, store := range []*CertificateStore{fp.certificates, fp.controlCertificates, fp.adminApiCertificates} {
+		if store == nil {
+			continue
+		}
+		reloaded, err := store.Reload()
+		if err != nil {
+			fp.Logger.Error("Error reloading certificate", "error", err)
+			continue
+		}
+		if reloaded {
+			fp.Logger.Info("Reloaded certificate", "file", store.certFile)
+		}
+	}
+}
+
+func (fp *ForwardProxy) watchFiles() {
+	ticker := time.NewTicker(CertificateReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fp.Reload()
+		case <-fp.stopch:
+			return
+		}
+	}
+}
+
+func isTls(conn net.Conn) bool {
+	_, ok := conn.(*tls.Conn)
+	return ok
+}
+
+// Send plain HTTP visitors to the same URL on the HTTPS listener
+func (fp *ForwardProxy) redirectToHttps(request *headers.HttpRequestHeader, conn net.Conn) {
+	host := request.Get("Host")
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if fp.Tls.Addr.Port != 443 {
+		host = net.JoinHostPort(host, strconv.Itoa(fp.Tls.Addr.Port))
+	}
+	response := headers.MakeRedirectResponse("https://" + host + request.Path)
+	_, err := response.Write(conn)
+	if err != nil {
+		fp.Logger.Error("Error writing response", "request", "REDIRECT", "host", host, "path", request.Path, "error", err)
+		return
+	}
+	fp.Logger.Debug("Redirected to HTTPS", "request", "REDIRECT", "host", host, "path", request.Path)
+}
+
+// First byte of a TLS handshake record, control connections starting with it
+// are upgraded to TLS on the plain listener
+const tlsRecordTypeHandshake byte = 0x16
+
+// Max time a client gets to finish the TLS handshake
+const TlsHandshakeTimeout time.Duration = 10 * time.Second
+
+type ControlTlsConfig struct {
+	// Certificate for the control channel, the HTTPS certificate is used
+	// if not set
+	CertFile string
+	KeyFile  string
+	// CA which signs client certificates, clients with a valid certificate
+	// don't need an auth token
+	ClientCAFile string
+	// Reject control requests which are not sent over TLS
+	Require bool
+}
+
+func (fp *ForwardProxy) setupControlTls() error {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	switch {
+	case fp.ControlTls.CertFile != "":
+		store, err := LoadCertificateStore(fp.ControlTls.CertFile, fp.ControlTls.KeyFile)
+		if err != nil {
+			return err
+		}
+		fp.controlCertificates = store
+		config.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return store.Certificate(), nil
+		}
+		fp.Logger.Info("Control channel certificate", "pin", CertificatePin(store.Certificate().Leaf))
+	case fp.Tls != nil:
+		config.GetCertificate = fp.getCertificate
+	default:
+		return ErrNoCertificateSource
+	}
+
+	if fp.ControlTls.ClientCAFile != "" {
+		data, err := os.ReadFile(fp.ControlTls.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(data) {
+			return fmt.Errorf("No certificates found in %s", fp.ControlTls.ClientCAFile)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	fp.controlTlsConfig = config
+	return nil
+}
+
+// Upgrade a control connection which starts with a TLS handshake
+func (fp *ForwardProxy) upgradeControlTls(conn net.Conn, firstByte []byte) (*tls.Conn, error) {
+	tlsConn := tls.Server(&peekedConn{Conn: conn, peeked: firstByte}, fp.controlTlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(TlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Identity of a client which authenticated with a verified certificate, empty
+// if the client did not send one
+func clientIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// A connection which returns the bytes read while detecting the protocol
+// before reading from the network again
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (pc *peekedConn) Read(b []byte) (int, error) {
+	if len(pc.peeked) > 0 {
+		n := copy(b, pc.peeked)
+		pc.peeked = pc.peeked[n:]
+		return n, nil
+	}
+	return pc.Conn.Read(b)
+}
+
+// Pin of a certificate public key in the sha256/<base64> form
+func CertificatePin(certificate *x509.Certificate) string {
+	digest := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(digest[:])
+}
+
+type ClientTlsOptions struct {
+	// Host name the proxy certificate is verified against
+	ServerName string
+	// Verify the proxy certificate against this CA instead of the system roots
+	CAFile string
+	// Accept only a proxy certificate with this public key pin, the chain
+	// is only verified if a CA is given as well
+	Pin string
+	// Client certificate for mutual TLS
+	CertFile string
+	KeyFile  string
+}
+
+// Verify the certificate chain the proxy sent like crypto/tls does
+func verifyChain(certificates []*x509.Certificate, roots *x509.CertPool, serverName string) error {
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := certificates[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		DNSName:       serverName,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
+
+// TLS configuration for connections to the forward proxy control channel
+func NewClientTlsConfig(options ClientTlsOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: options.ServerName,
+	}
+
+	if options.CAFile != "" {
+		data, err := os.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("No certificates found in %s", options.CAFile)
+		}
+		config.RootCAs = roots
+	}
+
+	if options.Pin != "" {
+		if !strings.HasPrefix(options.Pin, "sha256/") {
+			return nil, ErrInvalidCertificatePin
+		}
+		// The pin replaces chain verification, so self signed proxy
+		// certificates work too. With a CA the chain is verified here, the
+		// default verification is off for both.
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrCertificatePinMismatch
+			}
+			certificates := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				certificate, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certificates = append(certificates, certificate)
+			}
+			if roots != nil {
+				err := verifyChain(certificates, roots, options.ServerName)
+				if err != nil {
+					return err
+				}
+			}
+			if CertificatePin(certificates[0]) != options.Pin {
+				return ErrCertificatePinMismatch
+			}
+			return nil
+		}
+	}
+
+	if options.CertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
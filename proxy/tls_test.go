@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// Certificate for the host signed by the parent, self signed without one
+func newTestCertificate(t *testing.T, host string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if host == "" {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.Subject.CommonName = "Test CA"
+	} else {
+		template.DNSNames = []string{host}
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.certificate, parent.key
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{certificate: certificate, key: key}
+}
+
+func (tc *testCertificate) writePem(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.certificate.Raw})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Write the certificate and its key for a server to load
+func (tc *testCertificate) writeKeyPair(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	key, err := x509.MarshalECPrivateKey(tc.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tc.certificate.Raw}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	return certFile, keyFile
+}
+
+// Handshake with a server presenting the certificate. The server runs on a
+// socket, a pipe would block the client alert behind the server flight
+func testHandshake(t *testing.T, server *testCertificate, config *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{server.certificate.Raw},
+			PrivateKey:  server.key,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return tls.Client(conn, config).Handshake()
+}
+
+func TestClientTlsPinning(t *testing.T) {
+	ca := newTestCertificate(t, "", nil)
+	caFile := ca.writePem(t)
+	signed := newTestCertificate(t, "proxy.test", ca)
+	selfSigned := newTestCertificate(t, "proxy.test", nil)
+	wrongHost := newTestCertificate(t, "other.test", ca)
+
+	tests := []struct {
+		name   string
+		server *testCertificate
+		caFile string
+		pin    string
+		ok     bool
+	}{
+		{"ca", signed, caFile, "", true},
+		{"ca with self signed", selfSigned, caFile, "", false},
+		{"pin of self signed", selfSigned, "", CertificatePin(selfSigned.certificate), true},
+		{"wrong pin", selfSigned, "", CertificatePin(signed.certificate), false},
+		{"ca and pin", signed, caFile, CertificatePin(signed.certificate), true},
+		{"ca and wrong pin", signed, caFile, CertificatePin(selfSigned.certificate), false},
+		{"ca and pin of self signed", selfSigned, caFile, CertificatePin(selfSigned.certificate), false},
+		{"ca and pin of other host", wrongHost, caFile, CertificatePin(wrongHost.certificate), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := NewClientTlsConfig(ClientTlsOptions{
+				ServerName: "proxy.test",
+				CAFile:     test.caFile,
+				Pin:        test.pin,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = testHandshake(t, test.server, config)
+			if (err == nil) != test.ok {
+				t.Errorf("handshake error %v, want success %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestClientTlsInvalidPin(t *testing.T) {
+	_, err := NewClientTlsConfig(ClientTlsOptions{Pin: "md5/abc"})
+	if err != ErrInvalidCertificatePin {
+		t.Errorf("error %v, want %v", err, ErrInvalidCertificatePin)
+	}
+}
+
+// Certificates are only asked for a single label under the base domain or a
+// verified custom domain with a live tunnel behind it
+func TestAcmeHostPolicy(t *testing.T) {
+	domains, _ := LoadDomainRegistry("")
+	fp := &ForwardProxy{
+		BaseDomain: "tunnel.test",
+		sessions:   NewSessionRegistry(),
+		domains:    domains,
+	}
+	fp.sessions.Add(NewSession("web", testLogger, 0, time.Second))
+	verified, _ := domains.Add("web.example.com", "web", "owner")
+	domains.setVerified(verified.Name, verified.Challenge)
+	domains.Add("pending.example.com", "web", "owner")
+
+	tests := []struct {
+		host  string
+		valid bool
+	}{
+		{"web.tunnel.test", true},
+		{"web.example.com", true},
+		{"other.tunnel.test", false},
+		{"pending.example.com", false},
+		{"web.attacker.test", false},
+		{"a.web.tunnel.test", false},
+		{"web.tunnel.test.attacker.test", false},
+		{"tunnel.test", false},
+		{"web", false},
+	}
+	for _, test := range tests {
+		if err := fp.acmeHostPolicy(context.Background(), test.host); (err == nil) != test.valid {
+			t.Errorf("acmeHostPolicy(%q) = %v, want valid %v", test.host, err, test.valid)
+		}
+	}
+}
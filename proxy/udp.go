@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Largest datagram which can be carried over a tunnel
+const MaxDatagramSize int = 65535
+
+// Max time a UDP flow is kept open without any datagram in either direction
+const DefaultUdpIdleTimeout time.Duration = 60 * time.Second
+
+// Datagrams waiting to be written to a flow, newer datagrams are dropped
+// when the reverse proxy can't keep up
+const udpFlowQueueSize int = 64
+
+// Datagrams are carried on a stream with a two byte length prefix
+func writeDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readDatagram(r io.Reader, buffer []byte) (int, error) {
+	var length [2]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(length[:]))
+	if size > len(buffer) {
+		return 0, ErrDatagramTooLarge
+	}
+	return io.ReadFull(r, buffer[:size])
+}
+
+// A flow carries the datagrams of one public peer on its own stream, so
+// replies from the local server go back to the address which sent the request
+type udpFlow struct {
+	peer   net.Addr
+	stream net.Conn
+	queue  chan []byte
+	done   chan struct{}
+	timer  *time.Timer
+	in     atomic.Int64
+	out    atomic.Int64
+}
+
+type udpTunnel struct {
+	session     *Session
+	conn        net.PacketConn
+	idleTimeout time.Duration
+	flows       map[string]*udpFlow
+	fp          *ForwardProxy
+	mut         sync.Mutex
+}
+
+// Read datagrams on the public port of a UDP tunnel until the session closes
+// the connection, the port goes back to the allocator afterwards
+func (fp *ForwardProxy) serveUdp(session *Session, conn net.PacketConn, port int) {
+	defer fp.udpPorts.Release(port)
+	tunnel := &udpTunnel{
+		session:     session,
+		conn:        conn,
+		idleTimeout: fp.UdpIdleTimeout,
+		flows:       make(map[string]*udpFlow),
+		fp:          fp,
+	}
+	defer tunnel.close()
+
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, peer, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		flow, err := tunnel.flow(peer)
+		if err != nil {
+			fp.Logger.Warn("Could not open a flow", "request", "UDP", "session", session.Key(), "remote", peer.String(), "error", err)
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buffer[:n])
+		select {
+		case flow.queue <- datagram:
+		default:
+		}
+	}
+}
+
+func (fp *ForwardProxy) listenUdp() (net.PacketConn, int, error) {
+	var conn net.PacketConn
+	port, err := fp.udpPorts.Acquire(func(port int) error {
+		var err error
+		conn, err = net.ListenPacket("udp", fp.Addr.Host+":"+strconv.Itoa(port))
+		return err
+	})
+	return conn, port, err
+}
+
+// Find the flow of a peer, a new stream is opened for peers seen the first
+// time. Opening waits on the reverse proxy, the other flows are not held up
+// by it.
+func (ut *udpTunnel) flow(peer net.Addr) (*udpFlow, error) {
+	ut.mut.Lock()
+	flow, ok := ut.flows[peer.String()]
+	ut.mut.Unlock()
+	if ok {
+		return flow, nil
+	}
+	stream, err := ut.session.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	ut.mut.Lock()
+	defer ut.mut.Unlock()
+	flow, ok = ut.flows[peer.String()]
+	if ok {
+		stream.Close()
+		return flow, nil
+	}
+	flow = &udpFlow{
+		peer:   peer,
+		stream: stream,
+		queue:  make(chan []byte, udpFlowQueueSize),
+		done:   make(chan struct{}),
+	}
+	flow.timer = time.AfterFunc(ut.idleTimeout, func() {
+		ut.closeFlow(flow)
+	})
+	ut.flows[peer.String()] = flow
+	go ut.send(flow)
+	go ut.receive(flow)
+	return flow, nil
+}
+
+// Write datagrams from the peer to the stream
+func (ut *udpTunnel) send(flow *udpFlow) {
+	for {
+		select {
+		case datagram := <-flow.queue:
+			err := writeDatagram(flow.stream, datagram)
+			if err != nil {
+				ut.closeFlow(flow)
+				return
+			}
+			flow.in.Add(int64(len(datagram)))
+			flow.timer.Reset(ut.idleTimeout)
+		case <-flow.done:
+			return
+		}
+	}
+}
+
+// Write datagrams from the stream back to the peer
+func (ut *udpTunnel) receive(flow *udpFlow) {
+	defer ut.closeFlow(flow)
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, err := readDatagram(flow.stream, buffer)
+		if err != nil {
+			return
+		}
+		_, err = ut.conn.WriteTo(buffer[:n], flow.peer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			continue
+		}
+		flow.out.Add(int64(n))
+		flow.timer.Reset(ut.idleTimeout)
+	}
+}
+
+func (ut *udpTunnel) closeFlow(flow *udpFlow) {
+	ut.mut.Lock()
+	if ut.flows[flow.peer.String()] != flow {
+		ut.mut.Unlock()
+		return
+	}
+	delete(ut.flows, flow.peer.String())
+	ut.mut.Unlock()
+
+	flow.timer.Stop()
+	close(flow.done)
+	flow.stream.Close()
+	ut.session.addTraffic(1, flow.in.Load(), flow.out.Load())
+	ut.fp.Logger.Info("Flow closed", "request", "UDP", "session", ut.session.Key(), "remote", flow.peer.String(), "bytes_in", flow.in.Load(), "bytes_out", flow.out.Load())
+}
+
+func (ut *udpTunnel) close() {
+	ut.mut.Lock()
+	flows := make([]*udpFlow, 0, len(ut.flows))
+	for _, flow := range ut.flows {
+		flows = append(flows, flow)
+	}
+	ut.mut.Unlock()
+	for _, flow := range flows {
+		ut.closeFlow(flow)
+	}
+}
+
+// Relay datagrams between a stream opened by the forward proxy and the local
+// port, the forward proxy closes the stream once the flow is idle
+func (rp *ReverseProxy) forwardUdp(stream net.Conn) {
+	defer stream.Close()
+	localDial, err := net.Dial("udp", rp.Addr.ToString())
+	if err != nil {
+		rp.stats.fail(failureLocalDial)
+		rp.Logger.Error("Error connecting to local server", "addr", rp.Addr.ToString(), "error", err)
+		return
+	}
+	defer localDial.Close()
+
+	var out atomic.Int64
+	go func() {
+		buffer := make([]byte, MaxDatagramSize)
+		for {
+			n, err := localDial.Read(buffer)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// The local server is not listening yet, the next
+				// datagram might get an answer
+				continue
+			}
+			err = writeDatagram(stream, buffer[:n])
+			if err != nil {
+				localDial.Close()
+				return
+			}
+			out.Add(int64(n))
+		}
+	}()
+
+	var in int64
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, err := readDatagram(stream, buffer)
+		if err != nil {
+			break
+		}
+		localDial.Write(buffer[:n])
+		in += int64(n)
+	}
+	rp.stats.addTraffic(1, in, out.Load())
+	rp.Logger.Info("Flow closed", "request", "UDP", "bytes_in", in, "bytes_out", out.Load())
+}
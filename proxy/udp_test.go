@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/angrybayblade/tunnel/proxy/headers"
+	"github.com/angrybayblade/tunnel/proxy/mux"
+)
+
+// Stand in for the reverse proxy, every datagram is echoed back on its stream
+// and the streams of closed flows are reported
+func echoUdpFlows(client *mux.Session, opened chan<- net.Conn, closed chan<- struct{}) {
+	for {
+		stream, err := client.Accept()
+		if err != nil {
+			return
+		}
+		opened <- stream
+		go func() {
+			defer func() { closed <- struct{}{} }()
+			buffer := make([]byte, MaxDatagramSize)
+			for {
+				n, err := readDatagram(stream, buffer)
+				if err != nil {
+					return
+				}
+				if writeDatagram(stream, buffer[:n]) != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Every peer gets a flow of its own which is closed once it is idle
+func TestUdpFlows(t *testing.T) {
+	session := NewSession("udp", testLogger, 0, time.Second)
+	session.protocol = headers.TunnelProtocolUdp
+	controlConn, clientConn := net.Pipe()
+	session.Multiplex(controlConn)
+	client := mux.Client(clientConn)
+	defer client.Close()
+	opened := make(chan net.Conn, 4)
+	closed := make(chan struct{}, 4)
+	go echoUdpFlows(client, opened, closed)
+
+	fp := &ForwardProxy{
+		Logger:         testLogger,
+		Addr:           Addr{Host: "127.0.0.1"},
+		UdpIdleTimeout: 200 * time.Millisecond,
+		udpPorts:       NewPortAllocator(41000, 41100),
+	}
+	conn, port, err := fp.listenUdp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.listener = conn
+	go fp.serveUdp(session, conn, port)
+	defer session.Disconnect()
+
+	peers := []string{"first", "second"}
+	for _, name := range peers {
+		peer, err := net.Dial("udp", conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer peer.Close()
+		for round := 0; round < 2; round++ {
+			peer.Write([]byte(name))
+			peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buffer := make([]byte, 64)
+			n, err := peer.Read(buffer)
+			if err != nil || string(buffer[:n]) != name {
+				t.Fatalf("%s got %q with error %v", name, buffer[:n], err)
+			}
+		}
+	}
+	if len(opened) != len(peers) {
+		t.Errorf("%d flows opened for %d peers", len(opened), len(peers))
+	}
+
+	for range peers {
+		select {
+		case <-closed:
+		case <-time.After(2 * time.Second):
+			t.Fatal("idle flow was not closed")
+		}
+	}
+	// Traffic is counted right after the stream is closed
+	want := SessionTraffic{Requests: int64(len(peers)), BytesIn: 22, BytesOut: 22}
+	deadline := time.Now().Add(2 * time.Second)
+	for session.Traffic() != want && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if traffic := session.Traffic(); traffic != want {
+		t.Errorf("traffic %+v after the flows closed, want %+v", traffic, want)
+	}
+}
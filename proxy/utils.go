@@ -1,14 +1,22 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/angrybayblade/tunnel/auth"
+	"github.com/angrybayblade/tunnel/proxy/headers"
 )
 
-func ConnectTo(addr string, exitOnErr bool, defaultPort int) (net.Conn, error) {
+// Connect to the proxy, over TLS if a config is given
+func ConnectTo(addr string, exitOnErr bool, defaultPort int, config *tls.Config) (net.Conn, error) {
 	if defaultPort == 0 {
 		defaultPort = 80
 	}
@@ -17,10 +25,63 @@ func ConnectTo(addr string, exitOnErr bool, defaultPort int) (net.Conn, error) {
 		addr += ":" + strconv.Itoa(defaultPort)
 	}
 
-	conn, err := net.Dial("tcp", addr)
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial("tcp", addr, config)
+	} else {
+		conn, err = net.Dial("tcp", addr)
+	}
 	if exitOnErr && err != nil {
 		fmt.Println("Error connecting to", addr+";", err)
 		os.Exit(1)
 	}
 	return conn, err
 }
+
+// Sign an admin request with the admin key, the payload must not change
+// afterwards
+func SignAdminRequest(request *headers.ProxyFrame, kp *auth.KeyPair) {
+	signature := kp.Sign(headers.AdminMessage(request.Code, request.Payload))
+	request.Key = base64.StdEncoding.EncodeToString(signature)
+}
+
+// Write a v2 request frame and wait for the response
+func SendProxyRequest(conn net.Conn, request *headers.ProxyFrame) (*headers.ProxyFrame, error) {
+	request.Version = headers.ProxyHeaderV2
+	_, err := request.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	response := &headers.ProxyFrame{}
+	err = response.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Backoff hands out exponentially growing delays with jitter, so clients
+// which lost the proxy at the same time do not reconnect in lockstep
+type Backoff struct {
+	Min     time.Duration
+	Max     time.Duration
+	attempt int
+}
+
+// Delay before the next attempt, somewhere between half and all of the
+// current step
+func (b *Backoff) Next() time.Duration {
+	step := b.Min << b.attempt
+	if step <= 0 || step >= b.Max {
+		step = b.Max
+	} else {
+		b.attempt += 1
+	}
+	half := step / 2
+	return half + time.Duration(rand.Int63n(int64(step-half)+1))
+}
+
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}